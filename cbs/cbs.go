@@ -0,0 +1,233 @@
+// Package cbs implements circular binary segmentation (Olshen et al. 2004) of a series of
+// measurements along a chromosome, with significance assessed by permutation or, for long
+// segments, by the tail probability approximation of Siegmund (1988) used by DNAcopy.
+package cbs
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Params of the segmentation.
+type Params struct {
+	Alpha     float64 // significance level for accepting a change point
+	NPerm     int     // number of permutations for p-values
+	MinWidth  int     // minimum number of points in a segment
+	ApproxMin int     // segments with at least this many points use the tail approximation instead of permutations
+}
+
+var DefaultParams = Params{
+	Alpha:     0.01,
+	NPerm:     1000,
+	MinWidth:  2,
+	ApproxMin: 300,
+}
+
+// Segment is a range [Start, End) of indexes in the segmented series.
+type Segment struct {
+	Start int
+	End   int
+	Mean  float64
+	P     float64 // p-value of the change point at Start. NaN for the first segment.
+}
+
+// exactMax is the longest series for which the maximal statistic is found by exhaustive search.
+// Longer series are searched on a coarse grid of block boundaries then refined near the best pair.
+const exactMax int = 1000
+
+// Run segments x, which must not contain NaN.
+func Run(x []float64, p Params, rng *rand.Rand) []Segment {
+	if len(x) == 0 {
+		return nil
+	}
+	var bounds []int
+	var pvals []float64
+	bounds, pvals = split(x, 0, len(x), p, rng, bounds, pvals)
+	ans := []Segment{{Start: 0, P: math.NaN()}}
+	for i := range bounds {
+		ans[len(ans)-1].End = bounds[i]
+		ans = append(ans, Segment{Start: bounds[i], P: pvals[i]})
+	}
+	ans[len(ans)-1].End = len(x)
+	for i := range ans {
+		ans[i].Mean = mean(x[ans[i].Start:ans[i].End])
+	}
+	return ans
+}
+
+// split recursively segments x[start:end], appending interior change points in order.
+func split(x []float64, start, end int, p Params, rng *rand.Rand, bounds []int, pvals []float64) ([]int, []float64) {
+	n := end - start
+	if n < 2*p.MinWidth {
+		return bounds, pvals
+	}
+	t, i, j := MaxT(x[start:end], p.MinWidth)
+	if t == 0 {
+		return bounds, pvals
+	}
+	var pval float64
+	if n >= p.ApproxMin {
+		pval = TailP(t, n, float64(p.MinWidth)/float64(n))
+	} else {
+		pval = permP(x[start:end], t, p, rng)
+	}
+	if pval > p.Alpha {
+		return bounds, pvals
+	}
+	i, j = start+i, start+j
+	if i > start {
+		bounds, pvals = split(x, start, i, p, rng, bounds, pvals)
+		bounds, pvals = append(bounds, i), append(pvals, pval)
+	}
+	bounds, pvals = split(x, i, j, p, rng, bounds, pvals)
+	if j < end {
+		bounds, pvals = append(bounds, j), append(pvals, pval)
+		bounds, pvals = split(x, j, end, p, rng, bounds, pvals)
+	}
+	return bounds, pvals
+}
+
+// MaxT returns the maximal absolute two-sample t statistic comparing the arc x[i:j] with the
+// rest of the circle x[:i]+x[j:], where each resulting segment is at least minWidth long.
+func MaxT(x []float64, minWidth int) (t float64, i, j int) {
+	n := len(x)
+	sums := make([]float64, n+1)
+	for k := range x {
+		sums[k+1] = sums[k] + x[k]
+	}
+	sd := stdDev(x)
+	if sd == 0 || n < 2*minWidth {
+		return 0, 0, n
+	}
+	if n <= exactMax {
+		return searchT(sums, sd, minWidth, 0, n, 0, n, 1)
+	}
+	b := (n + exactMax/2 - 1) / (exactMax / 2)
+	t, i, j = searchT(sums, sd, minWidth, 0, n, 0, n, b)
+	return searchT(sums, sd, minWidth, i-b, i+b, j-b, j+b, 1)
+}
+
+// searchT finds the maximal statistic for arcs starting in [iLo, iHi] and ending in [jLo, jHi] with step size step.
+func searchT(sums []float64, sd float64, minWidth, iLo, iHi, jLo, jHi, step int) (best float64, bi, bj int) {
+	n := len(sums) - 1
+	iLo, jLo = max(iLo, 0), max(jLo, 0)
+	iHi, jHi = min(iHi, n), min(jHi, n)
+	var k int
+	var t float64
+	bi, bj = 0, n
+	for i := iLo; i <= iHi; i += step {
+		if i > 0 && i < minWidth {
+			continue
+		}
+		for j := max(jLo, i+minWidth); j <= jHi; j += step {
+			k = j - i
+			if n-k < minWidth || (j < n && n-j < minWidth) {
+				continue
+			}
+			t = math.Abs(tStat(sums, sd, i, j))
+			if t > best {
+				best, bi, bj = t, i, j
+			}
+		}
+	}
+	return
+}
+
+func tStat(sums []float64, sd float64, i, j int) float64 {
+	n := len(sums) - 1
+	k := float64(j - i)
+	in := sums[j] - sums[i]
+	out := sums[n] - in
+	return (in/k - out/(float64(n)-k)) / (sd * math.Sqrt(1/k+1/(float64(n)-k)))
+}
+
+// permP returns the permutation p-value of a maximal statistic, stopping early once the
+// p-value can no longer fall below alpha.
+func permP(x []float64, t float64, p Params, rng *rand.Rand) float64 {
+	perm := make([]float64, len(x))
+	copy(perm, x)
+	var exceed int
+	maxExceed := int(p.Alpha*float64(p.NPerm+1)) + 1
+	for i := 0; i < p.NPerm; i++ {
+		rng.Shuffle(len(perm), func(a, b int) { perm[a], perm[b] = perm[b], perm[a] })
+		if pt, _, _ := MaxT(perm, p.MinWidth); pt >= t {
+			exceed++
+			if exceed >= maxExceed {
+				return float64(exceed+1) / float64(i+2)
+			}
+		}
+	}
+	return float64(exceed+1) / float64(p.NPerm+1)
+}
+
+const tailGrid int = 100
+
+// TailP approximates the probability that the maximal statistic of m independent standard
+// normal points exceeds b when arcs cover at least a fraction delta of the points (Siegmund 1988).
+func TailP(b float64, m int, delta float64) float64 {
+	delta = math.Min(math.Max(delta, 1/float64(m)), 0.5)
+	incr := (0.5 - delta) / float64(tailGrid)
+	bsqrtm := b / math.Sqrt(float64(m))
+	var ans, t, nux float64
+	for i := 0; i < tailGrid; i++ {
+		t = delta + (float64(i)+0.5)*incr
+		nux = nu(bsqrtm / math.Sqrt(t*(1-t)))
+		ans += nux * nux * (intInvSq(delta+float64(i+1)*incr) - intInvSq(delta+float64(i)*incr))
+	}
+	// 1/(4*sqrt(2*pi)), doubled for a two-sided test
+	ans = 2 * 0.09973557 * b * b * b * math.Exp(-b*b/2) * ans
+	return math.Min(ans, 1)
+}
+
+// intInvSq is an antiderivative of 1/(t*(1-t))^2.
+func intInvSq(t float64) float64 {
+	return -1/t + 1/(1-t) + 2*math.Log(t) - 2*math.Log(1-t)
+}
+
+// nu is the overshoot correction of Siegmund for a Gaussian random walk, using the closed form
+// approximation of Siegmund and Yakir (2007).
+func nu(x float64) float64 {
+	if x < 1e-6 {
+		return 1
+	}
+	half := x / 2
+	return (2 / x) * (normCdf(half) - 0.5) / (half*normCdf(half) + math.Exp(-half*half/2)/math.Sqrt(2*math.Pi))
+}
+
+func normCdf(x float64) float64 {
+	return 0.5 * math.Erfc(-x/math.Sqrt2)
+}
+
+func mean(x []float64) float64 {
+	var sum float64
+	for i := range x {
+		sum += x[i]
+	}
+	return sum / float64(len(x))
+}
+
+func stdDev(x []float64) float64 {
+	m := mean(x)
+	var ss float64
+	for i := range x {
+		ss += (x[i] - m) * (x[i] - m)
+	}
+	if len(x) < 2 {
+		return 0
+	}
+	return math.Sqrt(ss / float64(len(x)-1))
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/illumina"
+	"github.com/dasnellings/PGC_mCNV/refpanel"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// marker status values
+const (
+	statusOk          string = "ok"
+	statusStrandFlip  string = "strand_flip"  // alleles are on the opposite strand of the panel
+	statusRefAltSwap  string = "ref_alt_swap" // genotypes encode the opposite allele
+	statusFlipSwap    string = "strand_flip_ref_alt_swap"
+	statusDiscordant  string = "af_discordant" // frequency differs from panel under either encoding
+	statusLowInfo     string = "low_info"      // palindromic marker that frequency cannot resolve
+	statusMismatch    string = "allele_mismatch"
+	statusRefMismatch string = "ref_mismatch"
+	statusNoPanel     string = "not_in_panel"
+)
+
+const minFreqAlleles int = 20 // min called alleles in a group to use it in the frequency test
+const freqEpsilon float64 = 0.001
+
+func usage() {
+	fmt.Print(
+		"afStrandCheck - Compare per-marker B allele frequencies computed from genotypes with a reference panel\n" +
+			"to flag markers whose frequency suggests a strand flip or REF/ALT swap.\n" +
+			"Usage:\n" +
+			"./afStrandCheck [options] -i converted.vcf -panel panelSites.vcf -o markerReport.tsv\n\n")
+	flag.PrintDefaults()
+}
+
+type group struct {
+	name    string
+	afKey   string
+	samples []int
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy).")
+	panelFile := flag.String("panel", "", "Reference panel sites VCF with allele frequencies in INFO (e.g. 1000G or gnomAD).")
+	output := flag.String("o", "stdout", "Output per-marker report (.tsv).")
+	table := flag.String("table", "", "Output long-format frequency comparison table with one line per marker per ancestry group (.tsv).")
+	corrected := flag.String("corrected", "", "Output VCF with strand flips and REF/ALT swaps corrected. All records are tagged with INFO/AF_CHECK.")
+	dropDiscordant := flag.Bool("dropDiscordant", false, "Exclude markers with discordant frequencies or mismatched alleles from -corrected.")
+	panelAf := flag.String("panelAf", "AF", "INFO field in -panel holding the ALT allele frequency used when -ancestry is not set.")
+	ancestryFile := flag.String("ancestry", "", "Tab separated file assigning samples to ancestry groups (sample<TAB>group). Unassigned samples are ignored.")
+	groupAf := flag.String("groupAf", "", "Comma separated list linking ancestry groups to panel INFO fields, e.g. EUR:AF_nfe,AFR:AF_afr. Required with -ancestry.")
+	minLlr := flag.Float64("minLlr", 10, "Minimum log-likelihood ratio favoring the swapped encoding to call a REF/ALT swap or palindromic strand flip.")
+	maxDiff := flag.Float64("maxDiff", 0.2, "Maximum absolute difference between cohort and panel frequency before a marker is flagged as discordant.")
+	maxMaf := flag.Float64("maxMaf", 0.4, "Maximum panel minor allele frequency for resolving palindromic markers by frequency.")
+	flag.Parse()
+
+	if *input == "" || *panelFile == "" {
+		usage()
+		log.Fatal("ERROR: input VCF and reference panel are required (-i, -panel)")
+	}
+
+	afStrandCheck(*input, *panelFile, *output, *table, *corrected, *dropDiscordant, *panelAf, *ancestryFile, *groupAf, *minLlr, *maxDiff, *maxMaf)
+}
+
+func afStrandCheck(input, panelFile, output, table, corrected string, dropDiscordant bool, panelAf, ancestryFile, groupAf string, minLlr, maxDiff, maxMaf float64) {
+	data, header := vcf.GoReadToChan(input)
+	groups := makeGroups(vcf.HeaderGetSampleList(header), panelAf, ancestryFile, groupAf)
+	afKeys := make([]string, len(groups))
+	for i := range groups {
+		afKeys[i] = groups[i].afKey
+	}
+	panel := refpanel.Read(panelFile, afKeys)
+
+	out := fileio.EasyCreate(output)
+	_, err := fmt.Fprintln(out, "#CHROM\tPOS\tID\tREF\tALT\tPANEL_REF\tPANEL_ALT\tSTATUS\tN_ALLELES\tCOHORT_AF\tPANEL_AF\tLLR_SWAP")
+	exception.PanicOnErr(err)
+
+	var tableOut, vcfOut *fileio.EasyWriter
+	if table != "" {
+		tableOut = fileio.EasyCreate(table)
+		_, err = fmt.Fprintln(tableOut, "GROUP\tCHROM\tPOS\tID\tSTATUS\tN_ALLELES\tCOHORT_AF\tPANEL_AF")
+		exception.PanicOnErr(err)
+	}
+	if corrected != "" {
+		vcfOut = fileio.EasyCreate(corrected)
+		header.Text = append(header.Text[:len(header.Text)-1],
+			"##INFO=<ID=AF_CHECK,Number=1,Type=String,Description=\"Reference panel allele frequency check status (afStrandCheck)\">",
+			header.Text[len(header.Text)-1])
+		vcf.NewWriteHeader(vcfOut, header)
+	}
+
+	counts := make(map[string]int)
+	var r result
+	for v := range data {
+		r = checkMarker(v, panel, groups, minLlr, maxDiff, maxMaf)
+		counts[r.status]++
+		writeResult(out, v, r)
+		if tableOut != nil && r.site.Chr != "" {
+			writeTable(tableOut, v, r, groups)
+		}
+		if vcfOut != nil {
+			if dropDiscordant && (r.status == statusDiscordant || r.status == statusMismatch || r.status == statusRefMismatch) {
+				continue
+			}
+			vcf.WriteVcf(vcfOut, correct(v, r))
+		}
+	}
+
+	err = out.Close()
+	exception.PanicOnErr(err)
+	if tableOut != nil {
+		err = tableOut.Close()
+		exception.PanicOnErr(err)
+	}
+	if vcfOut != nil {
+		err = vcfOut.Close()
+		exception.PanicOnErr(err)
+	}
+
+	statuses := make([]string, 0, len(counts))
+	for s := range counts {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		log.Printf("%s\t%d", s, counts[s])
+	}
+}
+
+func makeGroups(samples []string, panelAf, ancestryFile, groupAf string) []group {
+	if ancestryFile == "" {
+		all := group{name: "ALL", afKey: panelAf, samples: make([]int, len(samples))}
+		for i := range samples {
+			all.samples[i] = i
+		}
+		return []group{all}
+	}
+	if groupAf == "" {
+		log.Fatal("ERROR: -groupAf is required with -ancestry")
+	}
+
+	var groups []group
+	groupIdx := make(map[string]int)
+	var words []string
+	for _, g := range strings.Split(groupAf, ",") {
+		words = strings.Split(g, ":")
+		if len(words) != 2 {
+			log.Fatalf("ERROR: could not parse '%s' in -groupAf. Expecting GROUP:INFO_FIELD", g)
+		}
+		groupIdx[words[0]] = len(groups)
+		groups = append(groups, group{name: words[0], afKey: words[1]})
+	}
+
+	sampleIdx := make(map[string]int, len(samples))
+	for i := range samples {
+		sampleIdx[samples[i]] = i
+	}
+	file := fileio.EasyOpen(ancestryFile)
+	var s, g int
+	var found bool
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		words = strings.Fields(line)
+		if len(words) < 2 {
+			log.Fatalf("ERROR: could not parse line in ancestry file:\n%s", line)
+		}
+		if s, found = sampleIdx[words[0]]; !found {
+			continue
+		}
+		if g, found = groupIdx[words[1]]; !found {
+			log.Printf("WARNING: ancestry group '%s' for sample '%s' is not listed in -groupAf. Ignoring sample.", words[1], words[0])
+			continue
+		}
+		groups[g].samples = append(groups[g].samples, s)
+	}
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return groups
+}
+
+type result struct {
+	status  string
+	site    refpanel.Site
+	mapA    int16 // panel allele (0 = panel REF, 1 = panel ALT) carried by the A allele after correction
+	mapB    int16
+	aInt    int16 // A and B allele indexes in the input record
+	bInt    int16
+	nAll    int     // called alleles in the groups used for the frequency test
+	freq    float64 // cohort panel-ALT frequency after correction
+	panelAf float64 // allele count weighted panel ALT frequency
+	llr     float64
+	groupN  []int
+	groupF  []float64
+}
+
+func checkMarker(v vcf.Vcf, panel map[string]refpanel.Site, groups []group, minLlr, maxDiff, maxMaf float64) result {
+	var r result
+	var found bool
+	r.freq, r.panelAf = math.NaN(), math.NaN()
+	r.site, found = panel[refpanel.Key(v.Chr, v.Pos)]
+	if !found {
+		r.status = statusNoPanel
+		return r
+	}
+	if strings.ToUpper(v.Ref) != r.site.Ref {
+		r.status = statusRefMismatch
+		return r
+	}
+
+	r.aInt, r.bInt = alleleCodes(v.Info)
+	bases := append([]string{strings.ToUpper(v.Ref)}, v.Alt...)
+	if int(r.aInt) >= len(bases) || int(r.bInt) >= len(bases) || r.aInt == r.bInt {
+		r.status = statusMismatch
+		return r
+	}
+	baseA, baseB := strings.ToUpper(bases[r.aInt]), strings.ToUpper(bases[r.bInt])
+
+	var flipped bool
+	switch {
+	case baseA == r.site.Ref && baseB == r.site.Alt:
+		r.mapA, r.mapB = 0, 1
+	case baseA == r.site.Alt && baseB == r.site.Ref:
+		r.mapA, r.mapB = 1, 0
+	case illumina.RevComp(baseA) == r.site.Ref && illumina.RevComp(baseB) == r.site.Alt:
+		r.mapA, r.mapB = 0, 1
+		flipped = true
+	case illumina.RevComp(baseA) == r.site.Alt && illumina.RevComp(baseB) == r.site.Ref:
+		r.mapA, r.mapB = 1, 0
+		flipped = true
+	default:
+		r.status = statusMismatch
+		return r
+	}
+	palindromic := baseA == illumina.RevComp(baseB)
+
+	// log likelihood of the observed allele counts with the current and swapped encoding
+	var logLik, logLikSwap, panelAltSum, altSum float64
+	var aCount, bCount, informative int
+	var p float64
+	r.groupN = make([]int, len(groups))
+	r.groupF = make([]float64, len(groups))
+	for g := range groups {
+		aCount, bCount = countAlleles(v.Samples, groups[g].samples, r.aInt, r.bInt)
+		r.groupN[g] = aCount + bCount
+		if r.mapB == 1 {
+			r.groupF[g] = float64(bCount) / float64(aCount+bCount)
+		} else {
+			r.groupF[g] = float64(aCount) / float64(aCount+bCount)
+		}
+		p, found = r.site.Af[groups[g].afKey]
+		if !found || r.groupN[g] < minFreqAlleles {
+			continue
+		}
+		informative++
+		p = math.Min(math.Max(p, freqEpsilon), 1-freqEpsilon)
+		altCount := float64(r.groupN[g]) * r.groupF[g]
+		refCount := float64(r.groupN[g]) - altCount
+		logLik += altCount*math.Log(p) + refCount*math.Log(1-p)
+		logLikSwap += refCount*math.Log(p) + altCount*math.Log(1-p)
+		panelAltSum += float64(r.groupN[g]) * p
+		altSum += altCount
+		r.nAll += r.groupN[g]
+	}
+
+	// the frequency, panel frequency, and allele count are all over the informative groups
+	if informative > 0 {
+		r.llr = logLikSwap - logLik
+		r.panelAf = panelAltSum / float64(r.nAll)
+		r.freq = altSum / float64(r.nAll)
+	}
+
+	resolvable := informative > 0 && math.Min(r.panelAf, 1-r.panelAf) <= maxMaf
+	swap := resolvable && r.llr >= minLlr
+	if swap {
+		r.mapA, r.mapB = r.mapB, r.mapA
+		r.freq = 1 - r.freq
+		for g := range r.groupF {
+			r.groupF[g] = 1 - r.groupF[g]
+		}
+	}
+
+	switch {
+	case palindromic && !resolvable:
+		r.status = statusLowInfo
+	case informative > 0 && math.Abs(r.freq-r.panelAf) > maxDiff:
+		r.status = statusDiscordant
+	case palindromic && swap, !palindromic && flipped && !swap:
+		r.status = statusStrandFlip
+	case !palindromic && !flipped && swap:
+		r.status = statusRefAltSwap
+	case !palindromic && flipped && swap:
+		r.status = statusFlipSwap
+	default:
+		r.status = statusOk
+	}
+	return r
+}
+
+func alleleCodes(info string) (alleleA, alleleB int16) {
+	alleleA, alleleB = 0, 1
+	var kv []string
+	for _, field := range strings.Split(info, ";") {
+		kv = strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "ALLELE_A":
+			alleleA = parseInt16(kv[1])
+		case "ALLELE_B":
+			alleleB = parseInt16(kv[1])
+		}
+	}
+	return
+}
+
+func parseInt16(s string) int16 {
+	i, err := strconv.ParseInt(s, 10, 16)
+	exception.PanicOnErr(err)
+	return int16(i)
+}
+
+func countAlleles(samples []vcf.Sample, idx []int, aInt, bInt int16) (aCount, bCount int) {
+	for _, i := range idx {
+		for _, a := range samples[i].Alleles {
+			switch a {
+			case aInt:
+				aCount++
+			case bInt:
+				bCount++
+			}
+		}
+	}
+	return
+}
+
+// correct rewrites a record using the panel alleles so that the A and B alleles carry the panel allele in mapA and mapB.
+func correct(v vcf.Vcf, r result) vcf.Vcf {
+	v.Info += ";AF_CHECK=" + r.status
+	switch r.status {
+	case statusStrandFlip, statusRefAltSwap, statusFlipSwap:
+	default:
+		return v
+	}
+	v.Alt = []string{r.site.Alt}
+	var i, j int
+	for i = range v.Samples {
+		for j = range v.Samples[i].Alleles {
+			switch v.Samples[i].Alleles[j] {
+			case r.aInt:
+				v.Samples[i].Alleles[j] = r.mapA
+			case r.bInt:
+				v.Samples[i].Alleles[j] = r.mapB
+			default:
+				v.Samples[i].Alleles[j] = -1
+			}
+		}
+	}
+	fields := strings.Split(v.Info, ";")
+	for i = range fields {
+		switch {
+		case strings.HasPrefix(fields[i], "ALLELE_A="):
+			fields[i] = fmt.Sprintf("ALLELE_A=%d", r.mapA)
+		case strings.HasPrefix(fields[i], "ALLELE_B="):
+			fields[i] = fmt.Sprintf("ALLELE_B=%d", r.mapB)
+		}
+	}
+	v.Info = strings.Join(fields, ";")
+	return v
+}
+
+func writeResult(out io.Writer, v vcf.Vcf, r result) {
+	_, err := fmt.Fprintf(out, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%.4g\t%.4g\t%.4g\n",
+		v.Chr, v.Pos, v.Id, v.Ref, strings.Join(v.Alt, ","), orDot(r.site.Ref), orDot(r.site.Alt), r.status, r.nAll, r.freq, r.panelAf, r.llr)
+	exception.PanicOnErr(err)
+}
+
+func writeTable(out io.Writer, v vcf.Vcf, r result, groups []group) {
+	var err error
+	var p float64
+	var found bool
+	for g := range groups {
+		if r.groupN == nil || r.groupN[g] == 0 {
+			continue
+		}
+		if p, found = r.site.Af[groups[g].afKey]; !found {
+			continue
+		}
+		_, err = fmt.Fprintf(out, "%s\t%s\t%d\t%s\t%s\t%d\t%.4g\t%.4g\n", groups[g].name, v.Chr, v.Pos, v.Id, r.status, r.groupN[g], r.groupF[g], p)
+		exception.PanicOnErr(err)
+	}
+}
+
+func orDot(s string) string {
+	if s == "" {
+		return "."
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/vcfmerge"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"appendSamples - Add the samples of new GT/BAF/LRR VCFs (e.g. single-sample or per-batch output of illuminaToVcf)\n" +
+			"to an existing cohort VCF without reconverting the cohort. New samples are added after the existing samples.\n" +
+			"Markers missing from the cohort or from a new VCF are written with missing values for the samples that lack\n" +
+			"them. Sample IDs already in the cohort are refused. The update is recorded as an ##appendSamples header line.\n" +
+			"To add samples directly from GenomeStudio reports use illuminaToVcf -append.\n" +
+			"Usage:\n" +
+			"./appendSamples [options] -i cohort.vcf -add new1.vcf,new2.vcf -o updated.vcf\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Existing cohort VCF.")
+	add := flag.String("add", "", "Comma separated VCFs with the samples to add.")
+	addList := flag.String("addList", "", "File listing VCFs with samples to add, one per line.")
+	output := flag.String("o", "", "Output VCF. Must not be the input.")
+	maxOpenFiles := flag.Int("maxOpenFiles", 1000, "Maximum number of VCFs open at once. More are merged in rounds through temporary files.")
+	tmpDir := flag.String("tmpDir", "", "Directory for temporary files. Defaults to the directory of -o.")
+	flag.Parse()
+
+	if *input == "" || *output == "" || (*add == "" && *addList == "") {
+		usage()
+		log.Fatal("ERROR: cohort VCF (-i), output (-o), and VCFs to add (-add or -addList) are required")
+	}
+	if path.Clean(*input) == path.Clean(*output) {
+		log.Fatal("ERROR: output must not overwrite the input cohort VCF")
+	}
+	if *maxOpenFiles < 3 {
+		log.Fatal("ERROR: -maxOpenFiles must be at least 3")
+	}
+	var inputs []string
+	if *add != "" {
+		inputs = strings.Split(*add, ",")
+	}
+	if *addList != "" {
+		inputs = append(inputs, readList(*addList)...)
+	}
+	if *tmpDir == "" {
+		*tmpDir = path.Dir(*output)
+	}
+
+	history := func(added []string) []string {
+		log.Printf("Adding %d samples from %d files", len(added), len(inputs))
+		return []string{vcfmerge.HistoryLine("appendSamples", strings.Join(os.Args, " "), added, inputs)}
+	}
+	vcfmerge.Append(*input, inputs, *output, *maxOpenFiles-1, path.Join(*tmpDir, fmt.Sprintf("appendSamples.%d", os.Getpid())), history)
+}
+
+func readList(filename string) []string {
+	var ans []string
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		if line = strings.TrimSpace(line); line != "" {
+			ans = append(ans, line)
+		}
+	}
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return ans
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/pca"
+	"github.com/dasnellings/PGC_mCNV/samplesheet"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"batchPca - Detect batch structure by principal component analysis of LRR and of genotype dosages. An evenly\n" +
+			"spaced subsample of autosomal markers is read into memory and the leading components are found by randomized\n" +
+			"SVD. LRR is centered on the marker mean and dosages are standardized by allele frequency. Missing values are\n" +
+			"set to the marker mean. Writes the components of each sample, the marker loadings, the variance explained,\n" +
+			"and, with -samples, the association of each component with sample sheet covariates.\n" +
+			"Output files are <prefix>.<lrr|gt>.{pcs,loadings,variance,assoc}.tsv\n" +
+			"Usage:\n" +
+			"./batchPca [options] -i converted.vcf -samples sheet.tsv -o prefix\n\n")
+	flag.PrintDefaults()
+}
+
+type matrix struct {
+	name    string
+	chr, id []string
+	pos     []int
+	xt      [][]float32 // [marker][sample]
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields.")
+	output := flag.String("o", "", "Output prefix.")
+	sheetFile := flag.String("samples", "", "Tab separated sample sheet with a header line for covariate associations.")
+	covariates := flag.String("covariates", "site,plate,array_version,scan_date", "Comma separated sample sheet columns to test for association with "+
+		"the components. Columns absent from the sheet are skipped.")
+	data := flag.String("data", "lrr,gt", "Comma separated data to analyze: lrr and/or gt.")
+	k := flag.Int("k", 10, "Number of components.")
+	maxMarkers := flag.Int("maxMarkers", 20000, "Maximum number of markers to use.")
+	minMaf := flag.Float64("minMaf", 0.01, "Minimum minor allele frequency of markers for the genotype analysis.")
+	oversample := flag.Int("oversample", 10, "Extra random vectors for the randomized SVD.")
+	iters := flag.Int("iters", 4, "Power iterations for the randomized SVD.")
+	seed := flag.Int64("seed", 1, "Random seed.")
+	flag.Parse()
+
+	if *input == "" || *output == "" {
+		usage()
+		log.Fatal("ERROR: input VCF (-i) and output prefix (-o) are required")
+	}
+	var doLrr, doGt bool
+	for _, d := range strings.Split(*data, ",") {
+		switch strings.TrimSpace(d) {
+		case "lrr":
+			doLrr = true
+		case "gt":
+			doGt = true
+		default:
+			log.Fatalf("ERROR: unknown -data '%s'. Options are lrr and gt.", d)
+		}
+	}
+
+	samples := signal.SampleNames(*input)
+	if len(samples) < 2 {
+		log.Fatalf("ERROR: %s has %d samples. At least 2 are needed to compute principal components.", *input, len(samples))
+	}
+	var covs []pca.Covariate
+	if *sheetFile != "" {
+		sheet := samplesheet.Read(*sheetFile)
+		for _, name := range strings.Split(*covariates, ",") {
+			name = strings.TrimSpace(name)
+			if !sheet.Has(name) {
+				log.Printf("WARNING: sample sheet %s does not have a '%s' column", *sheetFile, name)
+				continue
+			}
+			covs = append(covs, pca.ParseCovariate(name, sheet.Column(samples, name)))
+		}
+	}
+
+	lrr, gt := read(*input, len(samples), stride(*input, *maxMarkers), *minMaf, doLrr, doGt)
+	for _, m := range []*matrix{lrr, gt} {
+		if m == nil {
+			continue
+		}
+		if len(m.xt) == 0 {
+			log.Printf("WARNING: no markers for the %s analysis", m.name)
+			continue
+		}
+		log.Printf("Computing %d components of %s from %d markers and %d samples", *k, m.name, len(m.xt), len(samples))
+		r := pca.Randomized(m.xt, *k, *oversample, *iters, *seed)
+		prefix := *output + "." + m.name
+		writePcs(prefix+".pcs.tsv", samples, r)
+		writeLoadings(prefix+".loadings.tsv", m, r)
+		writeVariance(prefix+".variance.tsv", r)
+		if len(covs) > 0 {
+			writeAssoc(prefix+".assoc.tsv", covs, r)
+		}
+	}
+}
+
+// stride returns the spacing between used markers so that at most maxMarkers autosomal markers are read.
+func stride(input string, maxMarkers int) int {
+	var n int
+	for _, m := range signal.Read(input, nil, []int{}).Markers {
+		if signal.IsAutosome(m.Chr) {
+			n++
+		}
+	}
+	if n <= maxMarkers {
+		return 1
+	}
+	return (n + maxMarkers - 1) / maxMarkers
+}
+
+// read returns the centered LRR and standardized dosages of every stride-th autosomal marker. Markers with
+// minor allele frequency below minMaf are left out of the dosages.
+func read(input string, nSamples, stride int, minMaf float64, doLrr, doGt bool) (lrr, gt *matrix) {
+	if doLrr {
+		lrr = &matrix{name: "lrr"}
+	}
+	if doGt {
+		gt = &matrix{name: "gt"}
+	}
+	records, _ := vcf.GoReadToChan(input)
+	var n, lrrIdx, nCalled int
+	var sum, mean, freq, sd float64
+	var dosage int8
+	for v := range records {
+		if !signal.IsAutosome(v.Chr) {
+			continue
+		}
+		n++
+		if (n-1)%stride != 0 {
+			continue
+		}
+		if lrr != nil {
+			_, lrrIdx = signal.Index(v)
+			row := make([]float32, nSamples)
+			sum, nCalled = 0, 0
+			for s := range v.Samples {
+				if x := signal.Value(v.Samples[s], lrrIdx); !math.IsNaN(x) {
+					row[s] = float32(x)
+					sum += x
+					nCalled++
+				} else {
+					row[s] = float32(math.NaN())
+				}
+			}
+			if nCalled > 0 {
+				mean = sum / float64(nCalled)
+				for s := range row {
+					if math.IsNaN(float64(row[s])) {
+						row[s] = 0
+					} else {
+						row[s] -= float32(mean)
+					}
+				}
+				lrr.add(v, row)
+			}
+		}
+		if gt != nil {
+			row := make([]float32, nSamples)
+			sum, nCalled = 0, 0
+			for s := range v.Samples {
+				if dosage = signal.Dosage(v.Samples[s]); dosage >= 0 {
+					row[s] = float32(dosage)
+					sum += float64(dosage)
+					nCalled++
+				} else {
+					row[s] = -1
+				}
+			}
+			if nCalled == 0 {
+				continue
+			}
+			freq = sum / float64(2*nCalled)
+			if freq < minMaf || freq > 1-minMaf {
+				continue
+			}
+			sd = math.Sqrt(2 * freq * (1 - freq))
+			for s := range row {
+				if row[s] < 0 {
+					row[s] = 0
+				} else {
+					row[s] = float32((float64(row[s]) - 2*freq) / sd)
+				}
+			}
+			gt.add(v, row)
+		}
+	}
+	return lrr, gt
+}
+
+func (m *matrix) add(v vcf.Vcf, row []float32) {
+	m.chr = append(m.chr, v.Chr)
+	m.pos = append(m.pos, v.Pos)
+	m.id = append(m.id, v.Id)
+	m.xt = append(m.xt, row)
+}
+
+func pcNames(k int) string {
+	names := make([]string, k)
+	for c := range names {
+		names[c] = fmt.Sprintf("PC%d", c+1)
+	}
+	return strings.Join(names, "\t")
+}
+
+func joinFloats(x []float64) string {
+	s := make([]string, len(x))
+	for i := range x {
+		s[i] = fmt.Sprintf("%.6g", x[i])
+	}
+	return strings.Join(s, "\t")
+}
+
+func writePcs(filename string, samples []string, r pca.Result) {
+	out := fileio.EasyCreate(filename)
+	_, err := fmt.Fprintf(out, "sample\t%s\n", pcNames(len(r.Variance)))
+	exception.PanicOnErr(err)
+	for i := range samples {
+		_, err = fmt.Fprintf(out, "%s\t%s\n", samples[i], joinFloats(r.Scores[i]))
+		exception.PanicOnErr(err)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+func writeLoadings(filename string, m *matrix, r pca.Result) {
+	out := fileio.EasyCreate(filename)
+	_, err := fmt.Fprintf(out, "#CHROM\tPOS\tID\t%s\n", pcNames(len(r.Variance)))
+	exception.PanicOnErr(err)
+	for j := range r.Loadings {
+		_, err = fmt.Fprintf(out, "%s\t%d\t%s\t%s\n", m.chr[j], m.pos[j], m.id[j], joinFloats(r.Loadings[j]))
+		exception.PanicOnErr(err)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+func writeVariance(filename string, r pca.Result) {
+	out := fileio.EasyCreate(filename)
+	_, err := fmt.Fprintln(out, "PC\tVARIANCE\tFRACTION")
+	exception.PanicOnErr(err)
+	for c := range r.Variance {
+		_, err = fmt.Fprintf(out, "PC%d\t%.6g\t%.4f\n", c+1, r.Variance[c], r.Variance[c]/r.TotalVariance)
+		exception.PanicOnErr(err)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+// writeAssoc writes one line per component and covariate.
+func writeAssoc(filename string, covs []pca.Covariate, r pca.Result) {
+	out := fileio.EasyCreate(filename)
+	_, err := fmt.Fprintln(out, "PC\tCOVARIATE\tTYPE\tN\tLEVELS\tR2\tF\tP")
+	exception.PanicOnErr(err)
+	scores := make([]float64, len(r.Scores))
+	var a pca.Assoc
+	var kind string
+	for c := range r.Variance {
+		for i := range scores {
+			scores[i] = r.Scores[i][c]
+		}
+		for _, cov := range covs {
+			a = pca.Associate(scores, cov)
+			kind = "categorical"
+			if cov.Numeric {
+				kind = "numeric"
+			}
+			_, err = fmt.Fprintf(out, "PC%d\t%s\t%s\t%d\t%d\t%.4f\t%.4g\t%.4g\n", c+1, cov.Name, kind, a.N, a.Levels, a.R2, a.F, a.P)
+			exception.PanicOnErr(err)
+		}
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
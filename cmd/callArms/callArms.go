@@ -0,0 +1,244 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"github.com/dasnellings/PGC_mCNV/mosaic"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"log"
+	"math"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"callArms - Call arm-level and whole-chromosome mosaic gains, losses, and copy neutral LOH on autosomes. Chromosome\n" +
+			"arms are read from a UCSC cytoBand file. For each sample and arm, the median LRR and the median BAF deviation of\n" +
+			"heterozygous markers are used to estimate the event type and cell fraction. Markers in centromeres (acen bands)\n" +
+			"and the p arms of acrocentric chromosomes (13, 14, 15, 21, 22) are masked. If all arms of a chromosome have the\n" +
+			"same event, a single whole-chromosome call is made.\n" +
+			"Usage:\n" +
+			"./callArms [options] -i converted.vcf -cytoBand cytoBand.txt -o calls.bed\n\n")
+	flag.PrintDefaults()
+}
+
+// wholeChrom is the ARM of whole chromosome estimates in the table.
+const wholeChrom string = "whole"
+
+type settings struct {
+	compression float64
+	minMarkers  int
+	minLlr      float64
+}
+
+// armMarkers are the unmasked markers of one arm.
+type armMarkers struct {
+	arm     cnv.Arm
+	markers []int
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy). Must be sorted by position.")
+	cytoBand := flag.String("cytoBand", "", "UCSC cytoBand file with chromosome bands of the genome build of the input.")
+	output := flag.String("o", "stdout", "Output calls (.bed).")
+	table := flag.String("table", "", "Output table with the signal and estimates of every arm and chromosome of every sample.")
+	batchSize := flag.Int("batchSize", 500, "Number of samples loaded into memory at once. The input is read once per batch.")
+	var s settings
+	flag.Float64Var(&s.compression, "compression", 0.5, "LRR compression of the array. Observed LRR is assumed to be compression*log2(copy ratio).")
+	flag.IntVar(&s.minMarkers, "minMarkers", 50, "Minimum number of unmasked markers for an arm to be evaluated.")
+	flag.Float64Var(&s.minLlr, "minLlr", 20, "Minimum log likelihood ratio against the copy neutral state for a call.")
+	flag.Parse()
+
+	if *input == "" || *cytoBand == "" {
+		usage()
+		log.Fatal("ERROR: input VCF (-i) and cytoBand file (-cytoBand) are required")
+	}
+	if *batchSize < 1 {
+		log.Fatal("ERROR: -batchSize must be at least 1")
+	}
+
+	arms, centromeres := cnv.ReadCytoBand(*cytoBand)
+	out := fileio.EasyCreate(*output)
+	_, err := fmt.Fprintln(out, cnv.BedHeader)
+	exception.PanicOnErr(err)
+	var tableFile *fileio.EasyWriter
+	var tableOut io.Writer
+	if *table != "" {
+		tableFile = fileio.EasyCreate(*table)
+		tableOut = tableFile
+		_, err = fmt.Fprintln(tableFile, "SAMPLE\tCHROM\tARM\tSTART\tEND\tN_MARKERS\tN_HET\tLRR\tBAF_DEV\tTYPE\tCELL_FRACTION\tCF_CI_LOW\tCF_CI_HIGH\tLLR")
+		exception.PanicOnErr(err)
+	}
+	callArms(*input, arms, centromeres, out, tableOut, *batchSize, s)
+	err = out.Close()
+	exception.PanicOnErr(err)
+	if tableFile != nil {
+		err = tableFile.Close()
+		exception.PanicOnErr(err)
+	}
+}
+
+func callArms(input string, arms []cnv.Arm, centromeres cnv.Regions, out io.Writer, tableOut io.Writer, batchSize int, s settings) {
+	samples := signal.SampleNames(input)
+	keep := func(chr string, pos int) bool { return signal.IsAutosome(chr) }
+	var batch []int
+	var byChrom [][]armMarkers
+	var nCalls int
+	for start := 0; start < len(samples); start += batchSize {
+		batch = batch[:0]
+		for i := start; i < start+batchSize && i < len(samples); i++ {
+			batch = append(batch, i)
+		}
+		data := signal.Read(input, keep, batch)
+		if len(data.Markers) == 0 {
+			log.Fatal("ERROR: no autosomal markers found in input")
+		}
+		if byChrom == nil {
+			byChrom = assignMarkers(data, arms, centromeres, s.minMarkers)
+		}
+		for si := range data.Samples {
+			median, noise := sampleNoise(data, si, s.compression)
+			for _, chromArms := range byChrom {
+				for _, c := range callChrom(data, si, chromArms, median, noise, s, tableOut) {
+					cnv.WriteBed(out, c)
+					nCalls++
+				}
+			}
+		}
+		log.Printf("Processed %d of %d samples", start+len(batch), len(samples))
+	}
+	log.Printf("Wrote %d calls", nCalls)
+}
+
+// assignMarkers returns the unmasked markers of each arm with at least minMarkers markers, grouped by chromosome.
+func assignMarkers(d signal.Data, arms []cnv.Arm, centromeres cnv.Regions, minMarkers int) [][]armMarkers {
+	chromRange := make(map[string][2]int)
+	for _, r := range d.ChromRanges() {
+		chromRange[strings.TrimPrefix(d.Markers[r[0]].Chr, "chr")] = r
+	}
+	var ans [][]armMarkers
+	chromIdx := make(map[string]int)
+	var curr armMarkers
+	var name string
+	var r [2]int
+	var found bool
+	for _, a := range arms {
+		name = strings.TrimPrefix(a.Chr, "chr")
+		if !signal.IsAutosome(name) || (a.Name == "p" && cnv.IsAcrocentric(name)) {
+			continue
+		}
+		if r, found = chromRange[name]; !found {
+			continue
+		}
+		curr = armMarkers{arm: a}
+		for m := r[0]; m < r[1]; m++ {
+			if d.Markers[m].Pos > a.Start && d.Markers[m].Pos <= a.End && !centromeres.Contains(a.Chr, d.Markers[m].Pos) {
+				curr.markers = append(curr.markers, m)
+			}
+		}
+		if len(curr.markers) < minMarkers {
+			log.Printf("WARNING: skipping %s%s with %d unmasked markers", a.Chr, a.Name, len(curr.markers))
+			continue
+		}
+		if _, found = chromIdx[name]; !found {
+			chromIdx[name] = len(ans)
+			ans = append(ans, nil)
+		}
+		ans[chromIdx[name]] = append(ans[chromIdx[name]], curr)
+	}
+	return ans
+}
+
+// callChrom estimates the state of each arm and the whole chromosome, writes them to tableOut if not nil,
+// and returns a whole-chromosome call if every arm has the same event, and otherwise arm calls.
+func callChrom(d signal.Data, s int, arms []armMarkers, median float64, noise cnv.Noise, p settings, tableOut io.Writer) []cnv.Call {
+	var calls []cnv.Call
+	var all []int
+	var sig cnv.SegmentSignal
+	var est cnv.Estimate
+	for _, a := range arms {
+		sig = regionSignal(d, s, a.markers, median)
+		est = cnv.EstimateState(sig, noise)
+		writeRow(tableOut, d, s, a.arm.Chr, a.arm.Name, a.markers, sig, est)
+		if est.Type != cnv.Neutral && est.Llr >= p.minLlr {
+			calls = append(calls, makeCall(d, s, a.markers, est))
+		}
+		all = append(all, a.markers...)
+	}
+
+	sig = regionSignal(d, s, all, median)
+	est = cnv.EstimateState(sig, noise)
+	writeRow(tableOut, d, s, arms[0].arm.Chr, wholeChrom, all, sig, est)
+	if len(arms) > 1 && len(calls) == len(arms) && sameTypes(calls, est.Type) && est.Llr >= p.minLlr {
+		return []cnv.Call{makeCall(d, s, all, est)}
+	}
+	return calls
+}
+
+func sameTypes(calls []cnv.Call, t cnv.Type) bool {
+	for i := range calls {
+		if calls[i].Type != t {
+			return false
+		}
+	}
+	return true
+}
+
+func makeCall(d signal.Data, s int, markers []int, est cnv.Estimate) cnv.Call {
+	return cnv.Call{Sample: d.Samples[s], Chr: d.Markers[markers[0]].Chr, Start: d.Markers[markers[0]].Pos - 1,
+		End: d.Markers[markers[len(markers)-1]].Pos, NMarkers: len(markers), Type: est.Type,
+		CellFraction: est.CellFraction, Score: est.Llr}
+}
+
+// regionSignal returns the median LRR, centered on the sample median, and the median BAF deviation of
+// heterozygous markers in sample s.
+func regionSignal(d signal.Data, s int, markers []int, median float64) cnv.SegmentSignal {
+	ans := cnv.SegmentSignal{Lrr: math.NaN(), BafDev: math.NaN()}
+	var lrr, mBaf []float64
+	for _, m := range markers {
+		if !math.IsNaN(float64(d.Lrr[s][m])) {
+			lrr = append(lrr, float64(d.Lrr[s][m])-median)
+		}
+		if d.Het(s, m) && !math.IsNaN(float64(d.Baf[s][m])) {
+			mBaf = append(mBaf, math.Abs(float64(d.Baf[s][m])-0.5)+0.5)
+		}
+	}
+	ans.NMarkers = len(lrr)
+	if ans.NMarkers > 0 {
+		ans.Lrr = signal.Median(lrr)
+	}
+	ans.NHet = len(mBaf)
+	if ans.NHet > 0 {
+		ans.BafDev = signal.Median(mBaf) - 0.5
+	}
+	return ans
+}
+
+// sampleNoise returns the autosomal LRR median and noise of sample s. Since arm LRR is summarized
+// by the median, the LRR noise is scaled by the asymptotic efficiency of the median.
+func sampleNoise(d signal.Data, s int, compression float64) (float64, cnv.Noise) {
+	acc := mosaic.NewNoiseAccumulator()
+	for m := range d.Markers {
+		acc.Add(float64(d.Lrr[s][m]), float64(d.Baf[s][m]), d.Het(s, m))
+	}
+	median := acc.LrrMedian()
+	if math.IsNaN(median) {
+		median = 0
+	}
+	n := acc.Noise()
+	return median, cnv.Noise{LrrSd: n.LrrSd * math.Sqrt(math.Pi/2), BafSd: n.BafSd, Compression: compression}
+}
+
+func writeRow(out io.Writer, d signal.Data, s int, chr, arm string, markers []int, sig cnv.SegmentSignal, est cnv.Estimate) {
+	if out == nil {
+		return
+	}
+	_, err := fmt.Fprintf(out, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%.4f\t%.4f\t%s\t%.3f\t%.3f\t%.3f\t%.4g\n", d.Samples[s], chr, arm,
+		d.Markers[markers[0]].Pos-1, d.Markers[markers[len(markers)-1]].Pos, sig.NMarkers, sig.NHet, sig.Lrr, sig.BafDev,
+		est.Type, est.CellFraction, est.CfLow, est.CfHigh, est.Llr)
+	exception.PanicOnErr(err)
+}
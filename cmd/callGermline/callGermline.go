@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"github.com/dasnellings/PGC_mCNV/germline"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+)
+
+func usage() {
+	fmt.Print(
+		"callGermline - Call germline deletions and duplications on autosomes with a PennCNV-style HMM. LRR and BAF\n" +
+			"emissions are modeled per copy number state using the population B allele frequency (PFB) of each marker,\n" +
+			"computed from the input cohort, and transitions depend on the distance between markers. Emission\n" +
+			"parameters can be trained on the cohort with -train.\n" +
+			"Usage:\n" +
+			"./callGermline [options] -i converted.vcf -o calls.bed\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy). Must be sorted by position.")
+	output := flag.String("o", "stdout", "Output calls (.bed).")
+	modelFile := flag.String("model", "", "Model parameter file (output of -modelOut). Default parameters are similar to PennCNV for Illumina arrays.")
+	train := flag.Int("train", 0, "Number of Viterbi training iterations used to re-estimate emission parameters on the input cohort before calling.")
+	modelOut := flag.String("modelOut", "", "Write the model used for calling (after any training) to this file.")
+	minMarkers := flag.Int("minMarkers", 3, "Minimum number of markers in a reported call.")
+	batchSize := flag.Int("batchSize", 500, "Number of samples loaded into memory at once. The input is read once per batch and training iteration.")
+	flag.Parse()
+
+	if *input == "" {
+		usage()
+		log.Fatal("ERROR: input VCF is required (-i)")
+	}
+	if *batchSize < 1 {
+		log.Fatal("ERROR: -batchSize must be at least 1")
+	}
+
+	m := germline.DefaultModel
+	if *modelFile != "" {
+		m = germline.ReadModel(*modelFile)
+	}
+	callGermline(*input, *output, *modelOut, m, *train, *minMarkers, *batchSize)
+}
+
+func callGermline(input, output, modelOut string, m germline.Model, train, minMarkers, batchSize int) {
+	keep := func(chr string, pos int) bool { return signal.IsAutosome(chr) }
+	pfb := cohortPfb(input)
+	samples := signal.SampleNames(input)
+	batches := makeBatches(len(samples), batchSize)
+
+	// reuse the data between passes when the whole cohort fits in one batch
+	var cached *signal.Data
+	load := func(batch []int) signal.Data {
+		if len(batches) > 1 {
+			return signal.Read(input, keep, batch)
+		}
+		if cached == nil {
+			d := signal.Read(input, keep, batch)
+			cached = &d
+		}
+		return *cached
+	}
+
+	for iter := 0; iter < train; iter++ {
+		var t germline.Trainer
+		for _, batch := range batches {
+			forEachChrom(load(batch), pfb, func(sample int, chr string, pos []int, lrr, baf, chromPfb []float64) {
+				t.Add(m.Viterbi(pos, lrr, baf, chromPfb), lrr, baf, chromPfb)
+			})
+		}
+		m = t.Update(m)
+		log.Printf("Training iteration %d: LRR means %.3f, sds %.3f, BAF het sd %.4f, hom sd %.4f",
+			iter+1, m.LrrMean, m.LrrSd, m.BafHetSd, m.BafHomSd)
+	}
+	if modelOut != "" {
+		germline.WriteModel(modelOut, m)
+	}
+
+	out := fileio.EasyCreate(output)
+	_, err := fmt.Fprintln(out, cnv.BedHeader)
+	exception.PanicOnErr(err)
+	var nCalls int
+	for _, batch := range batches {
+		d := load(batch)
+		forEachChrom(d, pfb, func(sample int, chr string, pos []int, lrr, baf, chromPfb []float64) {
+			for _, c := range m.CallChrom(d.Samples[sample], chr, pos, lrr, baf, chromPfb, minMarkers) {
+				cnv.WriteBed(out, c)
+				nCalls++
+			}
+		})
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+	log.Printf("Wrote %d calls", nCalls)
+}
+
+func makeBatches(nSamples, batchSize int) [][]int {
+	var ans [][]int
+	for start := 0; start < nSamples; start += batchSize {
+		batch := make([]int, 0, batchSize)
+		for i := start; i < start+batchSize && i < nSamples; i++ {
+			batch = append(batch, i)
+		}
+		ans = append(ans, batch)
+	}
+	return ans
+}
+
+// forEachChrom calls fn with the signal of each sample on each chromosome.
+func forEachChrom(d signal.Data, pfb []float64, fn func(sample int, chr string, pos []int, lrr, baf, chromPfb []float64)) {
+	if len(d.Markers) != len(pfb) {
+		log.Fatalf("ERROR: found %d autosomal markers but %d PFB values", len(d.Markers), len(pfb))
+	}
+	pos := make([]int, len(d.Markers))
+	for i := range d.Markers {
+		pos[i] = d.Markers[i].Pos
+	}
+	var lrr, baf []float64
+	for s := range d.Samples {
+		lrr, baf = signal.Float64s(d.Lrr[s]), signal.Float64s(d.Baf[s])
+		for _, r := range d.ChromRanges() {
+			fn(s, d.Markers[r[0]].Chr, pos[r[0]:r[1]], lrr[r[0]:r[1]], baf[r[0]:r[1]], pfb[r[0]:r[1]])
+		}
+	}
+}
+
+// cohortPfb returns the population B allele frequency of each autosomal marker as the mean BAF
+// across samples. Markers without BAF in any sample are NaN.
+func cohortPfb(input string) []float64 {
+	records, _ := vcf.GoReadToChan(input)
+	var ans []float64
+	var bafIdx, n int
+	var sum, baf float64
+	for v := range records {
+		if !signal.IsAutosome(v.Chr) {
+			continue
+		}
+		bafIdx, _ = signal.Index(v)
+		sum, n = 0, 0
+		for i := range v.Samples {
+			if baf = signal.Value(v.Samples[i], bafIdx); !math.IsNaN(baf) {
+				sum += baf
+				n++
+			}
+		}
+		if n == 0 {
+			ans = append(ans, math.NaN())
+		} else {
+			ans = append(ans, sum/float64(n))
+		}
+	}
+	return ans
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"github.com/dasnellings/PGC_mCNV/mosaic"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"log"
+	"math"
+)
+
+func usage() {
+	fmt.Print(
+		"callMosaic - Call mosaic gains, losses, and copy neutral LOH on autosomes from the BAF deviation of heterozygous\n" +
+			"markers and LRR using an HMM over a grid of cell fractions. Calls are written as BED with the estimated cell\n" +
+			"fraction and the log likelihood ratio against the copy neutral state.\n" +
+			"Usage:\n" +
+			"./callMosaic [options] -i converted.vcf -o calls.bed\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy). Must be sorted by position.")
+	output := flag.String("o", "stdout", "Output calls (.bed).")
+	batchSize := flag.Int("batchSize", 500, "Number of samples loaded into memory at once. The input is read once per batch.")
+	p := mosaic.DefaultParams
+	flag.Float64Var(&p.Compression, "compression", p.Compression, "LRR compression of the array. Observed LRR is assumed to be compression*log2(copy ratio).")
+	flag.Float64Var(&p.FractionStep, "fractionStep", p.FractionStep, "Spacing of the cell fraction grid used for HMM states.")
+	flag.Float64Var(&p.SwitchProb, "switchProb", p.SwitchProb, "Per-marker probability of changing state. Lower values call fewer, longer events.")
+	flag.Float64Var(&p.Outlier, "outlier", p.Outlier, "Probability that a marker is an outlier under any state.")
+	flag.IntVar(&p.MinMarkers, "minMarkers", p.MinMarkers, "Minimum number of markers in a reported call.")
+	flag.Float64Var(&p.MinLlr, "minLlr", p.MinLlr, "Minimum log likelihood ratio against the copy neutral state for a reported call.")
+	flag.Parse()
+
+	if *input == "" {
+		usage()
+		log.Fatal("ERROR: input VCF is required (-i)")
+	}
+	if *batchSize < 1 {
+		log.Fatal("ERROR: -batchSize must be at least 1")
+	}
+	if p.FractionStep <= 0 || p.FractionStep > 1 {
+		log.Fatal("ERROR: -fractionStep must be in (0, 1]")
+	}
+	if 3/p.FractionStep+1 > 256 {
+		log.Fatal("ERROR: -fractionStep is too small. Must be at least 0.012")
+	}
+
+	out := fileio.EasyCreate(*output)
+	_, err := fmt.Fprintln(out, cnv.BedHeader)
+	exception.PanicOnErr(err)
+	callMosaic(*input, out, *batchSize, p)
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+func callMosaic(input string, out io.Writer, batchSize int, p mosaic.Params) {
+	samples := signal.SampleNames(input)
+	keep := func(chr string, pos int) bool { return signal.IsAutosome(chr) }
+	var batch []int
+	var nCalls int
+	for start := 0; start < len(samples); start += batchSize {
+		batch = batch[:0]
+		for i := start; i < start+batchSize && i < len(samples); i++ {
+			batch = append(batch, i)
+		}
+		data := signal.Read(input, keep, batch)
+		if len(data.Markers) == 0 {
+			log.Fatal("ERROR: no autosomal markers found in input")
+		}
+		for s := range data.Samples {
+			for _, c := range callSample(data, s, p) {
+				cnv.WriteBed(out, c)
+				nCalls++
+			}
+		}
+		log.Printf("Processed %d of %d samples", start+len(batch), len(samples))
+	}
+	log.Printf("Wrote %d calls", nCalls)
+}
+
+// callSample centers LRR on the sample median, estimates noise genome-wide, and calls each chromosome.
+func callSample(data signal.Data, s int, p mosaic.Params) []cnv.Call {
+	n := len(data.Markers)
+	pos := make([]int, n)
+	lrr := make([]float64, n)
+	baf := make([]float64, n)
+	het := make([]bool, n)
+	for m := range data.Markers {
+		pos[m] = data.Markers[m].Pos
+		lrr[m] = float64(data.Lrr[s][m])
+		baf[m] = float64(data.Baf[s][m])
+		het[m] = data.Het(s, m)
+	}
+	median := signal.Median(lrr)
+	if math.IsNaN(median) {
+		log.Printf("WARNING: sample %s has no LRR signal. Skipping.", data.Samples[s])
+		return nil
+	}
+	for m := range lrr {
+		lrr[m] -= median
+	}
+	noise := mosaic.EstimateNoise(lrr, baf, het)
+
+	var ans []cnv.Call
+	for _, r := range data.ChromRanges() {
+		ans = append(ans, mosaic.CallChrom(data.Samples[s], data.Markers[r[0]].Chr, pos[r[0]:r[1]],
+			lrr[r[0]:r[1]], baf[r[0]:r[1]], het[r[0]:r[1]], noise, p)...)
+	}
+	return ans
+}
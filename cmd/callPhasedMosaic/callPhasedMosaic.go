@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"github.com/dasnellings/PGC_mCNV/mosaic"
+	"github.com/dasnellings/PGC_mCNV/phased"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"io"
+	"log"
+	"math"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"callPhasedMosaic - Call mosaic gains, losses, and copy neutral LOH on autosomes from phased BAF (pBAF).\n" +
+			"BAF/LRR from the converted VCF are merged onto phased genotypes from an external phasing tool run on the\n" +
+			"same markers. Runs of consistent imbalance between haplotypes are detected with a likelihood ratio test, which\n" +
+			"is more sensitive to low cell fraction events than unphased BAF. Records are matched by chromosome, position,\n" +
+			"and alleles, and samples are matched by name. Both VCFs must be sorted with chromosomes in the same order.\n" +
+			"Usage:\n" +
+			"./callPhasedMosaic [options] -i converted.vcf -phased phased.vcf -o calls.bed\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy).")
+	phasedFile := flag.String("phased", "", "Phased VCF of the same markers and samples (e.g. output of SHAPEIT or Eagle).")
+	output := flag.String("o", "stdout", "Output calls (.bed).")
+	phaseErr := flag.Float64("phaseErr", 1e-3, "Per-site probability of a phase switch error.")
+	p := mosaic.DefaultParams
+	flag.Float64Var(&p.Compression, "compression", p.Compression, "LRR compression of the array. Observed LRR is assumed to be compression*log2(copy ratio).")
+	flag.Float64Var(&p.FractionStep, "fractionStep", p.FractionStep, "Spacing of the cell fraction grid used for HMM states.")
+	flag.Float64Var(&p.SwitchProb, "switchProb", p.SwitchProb, "Per-marker probability of entering or leaving an event. Lower values call fewer, longer events.")
+	flag.Float64Var(&p.Outlier, "outlier", p.Outlier, "Probability that a marker is an outlier under any state.")
+	flag.IntVar(&p.MinMarkers, "minMarkers", p.MinMarkers, "Minimum number of phased heterozygous sites in a reported call.")
+	flag.Float64Var(&p.MinLlr, "minLlr", p.MinLlr, "Minimum log likelihood ratio against the balanced state for a reported call.")
+	flag.Parse()
+
+	if *input == "" || *phasedFile == "" {
+		usage()
+		log.Fatal("ERROR: input and phased VCFs are required (-i, -phased)")
+	}
+	if p.FractionStep <= 0 || p.FractionStep > 1 {
+		log.Fatal("ERROR: -fractionStep must be in (0, 1]")
+	}
+	if 2/p.FractionStep+1 > 256 {
+		log.Fatal("ERROR: -fractionStep is too small. Must be at least 0.008")
+	}
+	if *phaseErr <= 0 || *phaseErr+p.SwitchProb >= 1 {
+		log.Fatal("ERROR: -phaseErr must be in (0, 1)")
+	}
+
+	out := fileio.EasyCreate(*output)
+	_, err := fmt.Fprintln(out, cnv.BedHeader)
+	exception.PanicOnErr(err)
+	callPhasedMosaic(*input, *phasedFile, out, p, *phaseErr)
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+// chromBuffer holds the merged signal of the current chromosome for each phased sample.
+type chromBuffer struct {
+	chr  string
+	pos  []int
+	pbaf [][]float32
+	lrr  [][]float32
+}
+
+func callPhasedMosaic(input, phasedFile string, out io.Writer, p mosaic.Params, phaseErr float64) {
+	signalSamples := signal.SampleNames(input)
+	phasedSamples := signal.SampleNames(phasedFile)
+	idx, signalOnly, phasedOnly := phased.SampleIndex(signalSamples, phasedSamples)
+	if len(signalOnly) > 0 {
+		log.Printf("WARNING: %d samples in %s are not in %s and will not be called: %s", len(signalOnly), input, phasedFile, strings.Join(signalOnly, ","))
+	}
+	if len(phasedOnly) > 0 {
+		log.Printf("WARNING: %d samples in %s are not in %s and will not be called: %s", len(phasedOnly), phasedFile, input, strings.Join(phasedOnly, ","))
+	}
+	if len(phasedOnly) == len(phasedSamples) {
+		log.Fatal("ERROR: no samples in common between the input and phased VCFs")
+	}
+
+	medians, noise := estimateNoise(input, len(signalSamples))
+
+	buf := chromBuffer{pbaf: make([][]float32, len(phasedSamples)), lrr: make([][]float32, len(phasedSamples))}
+	var nMatched, nSwapped, nSignalOnly, nPhasedOnly, nCalls int
+	flush := func() {
+		if len(buf.pos) == 0 {
+			return
+		}
+		for i := range phasedSamples {
+			if idx[i] == -1 {
+				continue
+			}
+			for _, c := range mosaic.CallPhased(phasedSamples[i], buf.chr, buf.pos, signal.Float64s(buf.pbaf[i]), signal.Float64s(buf.lrr[i]), noise[idx[i]], p, phaseErr) {
+				cnv.WriteBed(out, c)
+				nCalls++
+			}
+			buf.pbaf[i], buf.lrr[i] = buf.pbaf[i][:0], buf.lrr[i][:0]
+		}
+		buf.pos = buf.pos[:0]
+	}
+
+	var bafIdx, lrrIdx int
+	var baf float64
+	matched := func(sig, ph vcf.Vcf, m phased.Match) {
+		if !signal.IsAutosome(sig.Chr) {
+			return
+		}
+		nMatched++
+		if m == phased.Swapped {
+			nSwapped++
+		}
+		if sig.Chr != buf.chr {
+			flush()
+			buf.chr = sig.Chr
+		}
+		bafIdx, lrrIdx = signal.Index(sig)
+		buf.pos = append(buf.pos, sig.Pos)
+		for i, j := range idx {
+			if j == -1 {
+				continue
+			}
+			baf = phased.AltBaf(sig, signal.Value(sig.Samples[j], bafIdx))
+			if m == phased.Swapped {
+				baf = 1 - baf
+			}
+			buf.pbaf[i] = append(buf.pbaf[i], float32(phased.PBaf(baf, ph.Samples[i])))
+			buf.lrr[i] = append(buf.lrr[i], float32(signal.Value(sig.Samples[j], lrrIdx)-medians[j]))
+		}
+	}
+	phased.Join(input, phasedFile, matched,
+		func(v vcf.Vcf) {
+			if signal.IsAutosome(v.Chr) {
+				nSignalOnly++
+			}
+		},
+		func(v vcf.Vcf) {
+			if signal.IsAutosome(v.Chr) {
+				nPhasedOnly++
+			}
+		})
+	flush()
+
+	log.Printf("Matched %d autosomal markers (%d with REF/ALT swapped). %d markers only in %s. %d markers only in %s.",
+		nMatched, nSwapped, nSignalOnly, input, nPhasedOnly, phasedFile)
+	if nMatched == 0 {
+		log.Fatal("ERROR: no markers matched between the input and phased VCFs")
+	}
+	log.Printf("Wrote %d calls", nCalls)
+}
+
+// estimateNoise streams the autosomes of the input to get the LRR median and noise of each sample.
+func estimateNoise(input string, nSamples int) ([]float64, []mosaic.Noise) {
+	acc := make([]*mosaic.NoiseAccumulator, nSamples)
+	for i := range acc {
+		acc[i] = mosaic.NewNoiseAccumulator()
+	}
+	records, _ := vcf.GoReadToChan(input)
+	var bafIdx, lrrIdx, i int
+	for v := range records {
+		if !signal.IsAutosome(v.Chr) {
+			continue
+		}
+		bafIdx, lrrIdx = signal.Index(v)
+		for i = range v.Samples {
+			acc[i].Add(signal.Value(v.Samples[i], lrrIdx), signal.Value(v.Samples[i], bafIdx), signal.Dosage(v.Samples[i]) == 1)
+		}
+	}
+	medians := make([]float64, nSamples)
+	noise := make([]mosaic.Noise, nSamples)
+	for i = range acc {
+		medians[i] = acc[i].LrrMedian()
+		if math.IsNaN(medians[i]) {
+			medians[i] = 0
+		}
+		noise[i] = acc[i].Noise()
+	}
+	return medians, noise
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/dna"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fasta"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"strconv"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"callsToVcf - Convert CNV calls in BED format (output of callMosaic, callPhasedMosaic, or callGermline) to a\n" +
+			"multi-sample VCF with symbolic <DEL>, <DUP>, <CNV>, and <CNLOH> records. Calls with identical breakpoints are\n" +
+			"merged into one record. Samples without a call overlapping a record are genotyped 0/0 with copy number 2, and\n" +
+			"samples with an overlapping call at different breakpoints are written as missing.\n" +
+			"Usage:\n" +
+			"./callsToVcf [options] -i calls.bed -o calls.vcf\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Input calls (.bed).")
+	output := flag.String("o", "stdout", "Output VCF.")
+	vcfFile := flag.String("vcf", "", "VCF used for calling. Its samples are written as the sample columns in the same order. "+
+		"Without -vcf or -samples only samples with calls are written.")
+	samplesFile := flag.String("samples", "", "File with one sample name per line written as the sample columns.")
+	refFile := flag.String("ref", "", "Reference fasta file for REF bases and ##contig lengths. Must have a .fai index. "+
+		"REF is N and ##contig lines have no length if not provided.")
+	flag.Parse()
+
+	if *input == "" {
+		usage()
+		log.Fatal("ERROR: input calls are required (-i)")
+	}
+	if *vcfFile != "" && *samplesFile != "" {
+		log.Fatal("ERROR: -vcf and -samples cannot be used together")
+	}
+
+	calls := cnv.ReadBed(*input)
+	var samples []string
+	switch {
+	case *vcfFile != "":
+		samples = signal.SampleNames(*vcfFile)
+	case *samplesFile != "":
+		samples = fileio.Read(*samplesFile)
+	}
+	samples = addMissingSamples(samples, calls)
+
+	var refBase func(chr string, pos int) string
+	var contigs map[string]int
+	if *refFile != "" {
+		contigs = readContigs(*refFile + ".fai")
+		ref := fasta.NewSeeker(*refFile, *refFile+".fai")
+		refBase = func(chr string, pos int) string {
+			seq, err := fasta.SeekByName(ref, chr, pos-1, pos)
+			if err != nil {
+				log.Printf("WARNING: could not retrieve reference base at %s:%d. Using N.", chr, pos)
+				return "N"
+			}
+			return strings.ToUpper(dna.BaseToString(seq[0]))
+		}
+	}
+
+	out := fileio.EasyCreate(*output)
+	cnv.WriteVcf(out, calls, samples, refBase, contigs, "##source=callsToVcf")
+	err := out.Close()
+	exception.PanicOnErr(err)
+}
+
+// addMissingSamples appends samples with calls that are not in samples, warning if a sample list was given.
+func addMissingSamples(samples []string, calls []cnv.Call) []string {
+	known := make(map[string]bool, len(samples))
+	for _, s := range samples {
+		known[s] = true
+	}
+	hadList := len(samples) > 0
+	for _, c := range calls {
+		if known[c.Sample] {
+			continue
+		}
+		if hadList {
+			log.Printf("WARNING: sample %s has calls but is not in the sample list. Adding it as the last column.", c.Sample)
+		}
+		known[c.Sample] = true
+		samples = append(samples, c.Sample)
+	}
+	return samples
+}
+
+// readContigs returns the chromosome lengths in a fasta index.
+func readContigs(faiFile string) map[string]int {
+	ans := make(map[string]int)
+	var words []string
+	var err error
+	file := fileio.EasyOpen(faiFile)
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		words = strings.Split(line, "\t")
+		if len(words) < 2 {
+			log.Fatalf("ERROR: malformed fasta index %s:\n%s", faiFile, line)
+		}
+		ans[words[0]], err = strconv.Atoi(words[1])
+		if err != nil {
+			log.Fatalf("ERROR: could not parse '%s' as an integer in %s:\n%s", words[1], faiFile, line)
+		}
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return ans
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/gcmodel"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+)
+
+func usage() {
+	fmt.Print(
+		"correctGc - Correct LRR for genomic waves by regressing each sample's LRR on the GC content of the reference\n" +
+			"in windows of several sizes around each marker. The fit uses autosomal markers with |LRR| below -maxLrr so\n" +
+			"that copy number changes do not bias the correction. The corrected LRR is written as a new FORMAT field or\n" +
+			"replaces LRR. The input is read three times.\n" +
+			"Usage:\n" +
+			"./correctGc [options] -i converted.vcf -ref ref.fa -o corrected.vcf\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy). Must be sorted by position.")
+	refFile := flag.String("ref", "", "Reference fasta file. Must have a .fai index.")
+	modelFile := flag.String("gcModel", "", "GC table for the markers of the input (output of gcModel), used instead of -ref.")
+	output := flag.String("o", "stdout", "Output VCF.")
+	windowList := flag.String("windows", gcmodel.JoinWindows(gcmodel.DefaultWindows), "Comma separated window sizes in bp for GC content with -ref.")
+	field := flag.String("field", "LRR_GC", "FORMAT field for the corrected LRR.")
+	replace := flag.Bool("replace", false, "Replace FORMAT/LRR with the corrected LRR instead of adding -field.")
+	maxLrr := flag.Float64("maxLrr", 0.5, "Markers with |LRR| above this value are not used to fit the correction.")
+	flag.Parse()
+
+	if *input == "" || (*refFile == "") == (*modelFile == "") {
+		usage()
+		log.Fatal("ERROR: input VCF (-i) and one of reference fasta (-ref) or GC table (-gcModel) are required")
+	}
+	if *replace {
+		*field = "LRR"
+	}
+
+	markers := signal.Read(*input, nil, []int{}).Markers
+	chr := make([]string, len(markers))
+	pos := make([]int, len(markers))
+	for i := range markers {
+		chr[i], pos[i] = markers[i].Chr, markers[i].Pos
+	}
+	var windows []int
+	var gc gcmodel.Table
+	if *modelFile != "" {
+		windows, gc = readModel(*modelFile, chr, pos)
+	} else {
+		windows = gcmodel.ParseWindows(*windowList)
+		ref := gcmodel.OpenReference(*refFile)
+		gc = gcmodel.Compute(ref, chr, pos, windows)
+		ref.Close()
+		log.Printf("Computed GC content of %d windows for %d markers", len(windows), len(markers))
+	}
+
+	corrections := fit(*input, gc, windows, *maxLrr)
+	write(*input, *output, gc, corrections, *field)
+}
+
+// readModel reads a GC table and checks that it has the same markers as the input.
+func readModel(filename string, chr []string, pos []int) ([]int, gcmodel.Table) {
+	modelChr, modelPos, windows, gc := gcmodel.ReadTable(filename)
+	if len(modelPos) != len(pos) {
+		log.Fatalf("ERROR: %s has %d markers but the input has %d", filename, len(modelPos), len(pos))
+	}
+	for i := range pos {
+		if modelChr[i] != chr[i] || modelPos[i] != pos[i] {
+			log.Fatalf("ERROR: marker %d of %s (%s:%d) does not match the input (%s:%d)", i+1, filename, modelChr[i], modelPos[i], chr[i], pos[i])
+		}
+	}
+	return windows, gc
+}
+
+// fit returns the correction of each sample, or nil for samples with too few markers to fit.
+func fit(input string, gc gcmodel.Table, windows []int, maxLrr float64) []*gcmodel.Correction {
+	records, header := vcf.GoReadToChan(input)
+	samples := vcf.HeaderGetSampleList(header)
+	fits := make([]*gcmodel.Fit, len(samples))
+	for i := range fits {
+		fits[i] = gcmodel.NewFit(len(windows))
+	}
+	var m, lrrIdx int
+	var lrr float64
+	for v := range records {
+		if signal.IsAutosome(v.Chr) {
+			_, lrrIdx = signal.Index(v)
+			for s := range v.Samples {
+				if lrr = signal.Value(v.Samples[s], lrrIdx); math.Abs(lrr) <= maxLrr {
+					fits[s].Add(lrr, gc[m])
+				}
+			}
+		}
+		m++
+	}
+
+	ans := make([]*gcmodel.Correction, len(samples))
+	var nFailed int
+	for s := range fits {
+		c, ok := fits[s].Solve()
+		if !ok {
+			log.Printf("WARNING: too few markers (%d) to fit the GC correction of %s. LRR is not corrected.", fits[s].N(), samples[s])
+			nFailed++
+			continue
+		}
+		ans[s] = &c
+	}
+	log.Printf("Fit GC corrections for %d of %d samples", len(samples)-nFailed, len(samples))
+	return ans
+}
+
+func write(input, output string, gc gcmodel.Table, corrections []*gcmodel.Correction, field string) {
+	signal.WriteLrr(input, output, field, "Log R Ratio corrected for GC content", func(m, s int, lrr float64) float64 {
+		if corrections[s] == nil || math.IsNaN(lrr) {
+			return lrr
+		}
+		return corrections[s].Adjust(lrr, gc[m])
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"estimateFraction - Estimate the copy number state (loss, gain, CN-LOH) and cell fraction of segments from their\n" +
+			"LRR shift and BAF deviation, with profile likelihood confidence intervals. Segments can be read from a BED file\n" +
+			"(chrom, start, end, sample, e.g. output of callMosaic) or a .seg file (e.g. output of segmentCbs). With -vcf the\n" +
+			"segment signal and per-sample noise are computed from the converted VCF, which is required for BED input.\n" +
+			"Without -vcf, .seg LRR is centered on the marker weighted median of each sample's autosomal segments.\n" +
+			"The LRR compression of each sample is estimated from its own segments with a clear LRR shift and BAF deviation,\n" +
+			"whose cell fraction is known from BAF alone. Samples with fewer than -minCompressionSegs such segments use\n" +
+			"-compression. Compression values in -noise override both.\n" +
+			"Usage:\n" +
+			"./estimateFraction [options] -i segments.seg -o estimates.tsv\n\n")
+	flag.PrintDefaults()
+}
+
+type region struct {
+	sample string
+	chr    string
+	start  int // 0-based
+	end    int
+	sig    cnv.SegmentSignal
+	est    cnv.Estimate
+	ok     bool
+}
+
+func main() {
+	input := flag.String("i", "", "Input segments (.bed or .seg).")
+	vcfFile := flag.String("vcf", "", "Input VCF with GT/BAF/LRR format fields used to compute segment signal and sample noise.")
+	output := flag.String("o", "stdout", "Output table (.tsv).")
+	noiseFile := flag.String("noise", "", "Tab separated per-sample noise and compression (sample, lrr_sd, baf_sd, compression). "+
+		"Values of '.' or missing samples use the values estimated from -vcf or the defaults below.")
+	compression := flag.Float64("compression", 0.5, "LRR compression of the array used for samples where it cannot be estimated. "+
+		"Observed LRR is assumed to be compression*log2(copy ratio).")
+	minCompressionSegs := flag.Int("minCompressionSegs", 3, "Minimum number of informative segments to estimate the LRR compression of a sample. "+
+		"0 uses -compression for all samples.")
+	lrrSd := flag.Float64("lrrSd", 0.2, "Per-marker LRR standard deviation used without -vcf or -noise.")
+	bafSd := flag.Float64("bafSd", 0.04, "Per-marker heterozygous BAF standard deviation used without -vcf or -noise.")
+	batchSize := flag.Int("batchSize", 500, "Number of samples loaded into memory at once with -vcf. The VCF is read once per batch.")
+	flag.Parse()
+
+	if *input == "" {
+		usage()
+		log.Fatal("ERROR: input segments are required (-i)")
+	}
+	if *batchSize < 1 {
+		log.Fatal("ERROR: -batchSize must be at least 1")
+	}
+	if *minCompressionSegs < 0 {
+		log.Fatal("ERROR: -minCompressionSegs must not be negative")
+	}
+
+	var regions []region
+	switch {
+	case strings.HasSuffix(*input, ".seg") || strings.HasSuffix(*input, ".seg.gz"):
+		regions = fromSeg(cnv.ReadSeg(*input))
+	case strings.HasSuffix(*input, ".bed") || strings.HasSuffix(*input, ".bed.gz"):
+		if *vcfFile == "" {
+			log.Fatal("ERROR: -vcf is required for BED input")
+		}
+		regions = fromBed(cnv.ReadBed(*input))
+	default:
+		log.Fatalf("ERROR: unrecognized segment file extension '%s'. Expecting .bed or .seg", *input)
+	}
+
+	defaults := cnv.Noise{LrrSd: *lrrSd, BafSd: *bafSd, Compression: *compression}
+	noise := make(map[string]cnv.Noise)
+	if *vcfFile != "" {
+		addVcfSignal(*vcfFile, regions, noise, defaults, *batchSize)
+	} else {
+		centerSegments(regions)
+	}
+	var fixed map[string]bool
+	if *noiseFile != "" {
+		fixed = readNoise(*noiseFile, noise, defaults)
+	}
+	if *minCompressionSegs > 0 {
+		estimateCompression(regions, noise, fixed, defaults, *minCompressionSegs)
+	}
+
+	var n cnv.Noise
+	var found bool
+	for i := range regions {
+		if n, found = noise[regions[i].sample]; !found {
+			n = defaults
+		}
+		if regions[i].sig.NMarkers > 0 {
+			regions[i].est = cnv.EstimateState(regions[i].sig, n)
+			regions[i].ok = true
+		}
+	}
+	writeRegions(*output, regions)
+}
+
+func fromSeg(segs []cnv.Seg) []region {
+	ans := make([]region, len(segs))
+	for i, s := range segs {
+		ans[i] = region{sample: s.Sample, chr: s.Chr, start: s.Start - 1, end: s.End,
+			sig: cnv.SegmentSignal{Lrr: s.Mean, BafDev: s.BafDev, NMarkers: s.NMarkers, NHet: s.NHet}}
+	}
+	return ans
+}
+
+func fromBed(calls []cnv.Call) []region {
+	ans := make([]region, len(calls))
+	for i, c := range calls {
+		ans[i] = region{sample: c.Sample, chr: c.Chr, start: c.Start, end: c.End, sig: cnv.SegmentSignal{BafDev: math.NaN()}}
+	}
+	return ans
+}
+
+// addVcfSignal replaces the signal of each region with the LRR (centered on the sample autosomal median)
+// and BAF of its markers in the VCF, and estimates per-sample noise on the autosomes.
+func addVcfSignal(vcfFile string, regions []region, noise map[string]cnv.Noise, defaults cnv.Noise, batchSize int) {
+	bySample := make(map[string][]int)
+	for i := range regions {
+		bySample[regions[i].sample] = append(bySample[regions[i].sample], i)
+	}
+	var sampleIdx []int
+	for i, s := range signal.SampleNames(vcfFile) {
+		if _, found := bySample[s]; found {
+			sampleIdx = append(sampleIdx, i)
+			delete(bySample, s)
+		}
+	}
+	for s := range bySample {
+		log.Printf("WARNING: sample %s is not in %s. Using signal from the segment file if present.", s, vcfFile)
+	}
+
+	for start := 0; start < len(sampleIdx); start += batchSize {
+		data := signal.Read(vcfFile, nil, sampleIdx[start:minInt(start+batchSize, len(sampleIdx))])
+		idx := cnv.NewMarkerIndex(data)
+		sampleRegions := make(map[string][]int)
+		for i := range regions {
+			sampleRegions[regions[i].sample] = append(sampleRegions[regions[i].sample], i)
+		}
+		for s := range data.Samples {
+			median, n := cnv.SampleNoise(data, s, defaults)
+			noise[data.Samples[s]] = n
+			for _, i := range sampleRegions[data.Samples[s]] {
+				regions[i].sig = cnv.IntervalSignal(data, s, idx, regions[i].chr, regions[i].start, regions[i].end, median)
+			}
+		}
+	}
+}
+
+// centerSegments centers the LRR of each sample's segments on the median of its autosomal segment
+// means weighted by number of markers.
+func centerSegments(regions []region) {
+	bySample := make(map[string][]int)
+	for i := range regions {
+		bySample[regions[i].sample] = append(bySample[regions[i].sample], i)
+	}
+	var auto []int
+	var median float64
+	for _, idx := range bySample {
+		auto = auto[:0]
+		for _, i := range idx {
+			if signal.IsAutosome(regions[i].chr) && regions[i].sig.NMarkers > 0 && !math.IsNaN(regions[i].sig.Lrr) {
+				auto = append(auto, i)
+			}
+		}
+		if len(auto) == 0 {
+			continue
+		}
+		sort.Slice(auto, func(a, b int) bool { return regions[auto[a]].sig.Lrr < regions[auto[b]].sig.Lrr })
+		var total, cum int
+		for _, i := range auto {
+			total += regions[i].sig.NMarkers
+		}
+		for _, i := range auto {
+			cum += regions[i].sig.NMarkers
+			if 2*cum >= total {
+				median = regions[i].sig.Lrr
+				break
+			}
+		}
+		for _, i := range idx {
+			regions[i].sig.Lrr -= median
+		}
+	}
+}
+
+// estimateCompression sets the compression of each sample not in fixed that has at least minSegments
+// informative segments.
+func estimateCompression(regions []region, noise map[string]cnv.Noise, fixed map[string]bool, defaults cnv.Noise, minSegments int) {
+	bySample := make(map[string][]cnv.SegmentSignal)
+	for i := range regions {
+		bySample[regions[i].sample] = append(bySample[regions[i].sample], regions[i].sig)
+	}
+	var n cnv.Noise
+	var c float64
+	var found, ok bool
+	var nEstimated int
+	for s, segs := range bySample {
+		if fixed[s] {
+			continue
+		}
+		if n, found = noise[s]; !found {
+			n = defaults
+		}
+		if c, ok = cnv.EstimateCompression(segs, n, minSegments); ok {
+			n.Compression = c
+			noise[s] = n
+			nEstimated++
+		}
+	}
+	log.Printf("Estimated LRR compression of %d of %d samples. Other samples use the -compression or -noise value.", nEstimated, len(bySample))
+}
+
+// readNoise reads per-sample noise into noise and returns the samples with a compression value.
+func readNoise(filename string, noise map[string]cnv.Noise, defaults cnv.Noise) map[string]bool {
+	fixed := make(map[string]bool)
+	file := fileio.EasyOpen(filename)
+	var words []string
+	var n cnv.Noise
+	var found bool
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		words = strings.Fields(line)
+		if len(words) < 2 {
+			log.Fatalf("ERROR: could not parse line in noise file:\n%s", line)
+		}
+		if n, found = noise[words[0]]; !found {
+			n = defaults
+		}
+		setValue(&n.LrrSd, words, 1, line)
+		setValue(&n.BafSd, words, 2, line)
+		setValue(&n.Compression, words, 3, line)
+		noise[words[0]] = n
+		if len(words) > 3 && words[3] != "." {
+			fixed[words[0]] = true
+		}
+	}
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return fixed
+}
+
+func setValue(dest *float64, words []string, col int, line string) {
+	if col >= len(words) || words[col] == "." {
+		return
+	}
+	f, err := strconv.ParseFloat(words[col], 64)
+	if err != nil {
+		log.Fatalf("ERROR: could not parse '%s' in noise file line:\n%s", words[col], line)
+	}
+	*dest = f
+}
+
+func writeRegions(output string, regions []region) {
+	out := fileio.EasyCreate(output)
+	_, err := fmt.Fprintln(out, "#CHROM\tSTART\tEND\tSAMPLE\tN_MARKERS\tN_HET\tLRR\tBAF_DEV\tTYPE\tCELL_FRACTION\tCF_CI_LOW\tCF_CI_HIGH\tLLR")
+	exception.PanicOnErr(err)
+	for _, r := range regions {
+		if !r.ok {
+			_, err = fmt.Fprintf(out, "%s\t%d\t%d\t%s\t%d\t%d\tNA\tNA\tNA\tNA\tNA\tNA\tNA\n", r.chr, r.start, r.end, r.sample, r.sig.NMarkers, r.sig.NHet)
+			exception.PanicOnErr(err)
+			continue
+		}
+		_, err = fmt.Fprintf(out, "%s\t%d\t%d\t%s\t%d\t%d\t%.4f\t%.4f\t%s\t%.3f\t%.3f\t%.3f\t%.4g\n", r.chr, r.start, r.end, r.sample,
+			r.sig.NMarkers, r.sig.NHet, r.sig.Lrr, r.sig.BafDev, r.est.Type, r.est.CellFraction, r.est.CfLow, r.est.CfHigh, r.est.Llr)
+		exception.PanicOnErr(err)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
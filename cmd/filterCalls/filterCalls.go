@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"math"
+)
+
+func usage() {
+	fmt.Print(
+		"filterCalls - Filter CNV calls with rules from a filter expression file. Each line of the file is a rule with a\n" +
+			"name, a field, a comparison, and a value that a call must satisfy to pass, e.g.:\n\n" +
+			"\tminMarkers   markers                 >=  10\n" +
+			"\tminLength    length                  >=  50000\n" +
+			"\tminDensity   density                 >=  5\n" +
+			"\tmaxSampleSd  sample.lrr_sd           <=  0.35\n" +
+			"\tsegdup       overlap:segdup.bed      <   0.5\n" +
+			"\tcentromere   overlap:centromeres.bed ==  0\n" +
+			"\tknownCnv     overlap:known_cnv.bed   <   0.5\n\n" +
+			"Fields are: markers, length (bp), density (markers per Mb), cellFraction, llr, copyNumber, sample.<column> for a\n" +
+			"column of the -sampleStats table (lrr_sd and baf_sd can be computed from -vcf), and overlap:<bed file> for the\n" +
+			"fraction of the call covered by the regions in a BED file. Comparisons are <, <=, >, >=, ==, and !=. Rules on\n" +
+			"missing values pass. Calls are written with a FILTER column listing the failed rules, or PASS.\n" +
+			"Usage:\n" +
+			"./filterCalls [options] -i calls.bed -rules filters.txt -o filtered.bed\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Input calls (.bed or .vcf).")
+	rulesFile := flag.String("rules", "", "Filter expression file.")
+	output := flag.String("o", "stdout", "Output calls (.bed) with a FILTER column.")
+	summary := flag.String("summary", "", "Output table with the number of calls failing each rule.")
+	statsFile := flag.String("sampleStats", "", "Tab separated table of per-sample values with a header line and the sample in the "+
+		"first column (e.g. output of sampleQc) for sample.<column> rules.")
+	vcfFile := flag.String("vcf", "", "Input VCF with GT/BAF/LRR format fields used to compute sample.lrr_sd (SD of autosomal LRR) "+
+		"and sample.baf_sd (SD of autosomal heterozygous BAF around 0.5) for samples not in -sampleStats.")
+	passOnly := flag.Bool("passOnly", false, "Only write calls that pass all rules.")
+	batchSize := flag.Int("batchSize", 500, "Number of samples loaded into memory at once with -vcf. The VCF is read once per batch.")
+	flag.Parse()
+
+	if *input == "" || *rulesFile == "" {
+		usage()
+		log.Fatal("ERROR: input calls (-i) and a rules file (-rules) are required")
+	}
+	if *batchSize < 1 {
+		log.Fatal("ERROR: -batchSize must be at least 1")
+	}
+
+	rules := cnv.ReadRules(*rulesFile)
+	var calls []cnv.Call
+	if cnv.IsVcf(*input) {
+		calls = cnv.ReadVcf(*input)
+	} else {
+		calls = cnv.ReadBed(*input)
+	}
+
+	stats := make(map[string]map[string]float64)
+	if *statsFile != "" {
+		stats = cnv.ReadSampleStats(*statsFile)
+	}
+	if *vcfFile != "" {
+		addVcfStats(*vcfFile, calls, stats, *batchSize)
+	}
+	for _, col := range cnv.SampleColumns(rules) {
+		checkColumn(col, calls, stats)
+	}
+
+	failed := make([]int, len(rules))
+	failedOnly := make([]int, len(rules))
+	var nPass, nFailedRules, lastFailed int
+	out := fileio.EasyCreate(*output)
+	_, err := fmt.Fprintln(out, cnv.FilteredBedHeader)
+	exception.PanicOnErr(err)
+	for _, c := range calls {
+		nFailedRules = 0
+		for i := range rules {
+			if !rules[i].Pass(c, stats) {
+				failed[i]++
+				nFailedRules++
+				lastFailed = i
+			}
+		}
+		if nFailedRules == 1 {
+			failedOnly[lastFailed]++
+		}
+		if nFailedRules == 0 {
+			nPass++
+		} else if *passOnly {
+			continue
+		}
+		cnv.WriteFilteredBed(out, c, cnv.Filter(c, rules, stats))
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+
+	log.Printf("%d of %d calls passed all filters", nPass, len(calls))
+	for i := range rules {
+		log.Printf("%s: %d failed, %d failed only this rule", rules[i], failed[i], failedOnly[i])
+	}
+	if *summary != "" {
+		writeSummary(*summary, rules, failed, failedOnly, nPass, len(calls))
+	}
+}
+
+func writeSummary(filename string, rules []cnv.Rule, failed, failedOnly []int, nPass, nCalls int) {
+	out := fileio.EasyCreate(filename)
+	_, err := fmt.Fprintln(out, "RULE\tFIELD\tOP\tVALUE\tN_FAILED\tN_FAILED_ONLY\tN_CALLS")
+	exception.PanicOnErr(err)
+	for i := range rules {
+		_, err = fmt.Fprintf(out, "%s\t%s\t%s\t%g\t%d\t%d\t%d\n", rules[i].Name, rules[i].Field, rules[i].Op, rules[i].Value, failed[i], failedOnly[i], nCalls)
+		exception.PanicOnErr(err)
+	}
+	_, err = fmt.Fprintf(out, "ANY\t.\t.\t.\t%d\t.\t%d\n", nCalls-nPass, nCalls)
+	exception.PanicOnErr(err)
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+// checkColumn warns about samples with calls that are missing a sample statistic used by a rule.
+func checkColumn(col string, calls []cnv.Call, stats map[string]map[string]float64) {
+	missing := make(map[string]bool)
+	for _, c := range calls {
+		if _, found := stats[c.Sample][col]; !found {
+			missing[c.Sample] = true
+		}
+	}
+	if len(missing) > 0 {
+		log.Printf("WARNING: %d samples with calls have no value for sample.%s. Rules on this column pass for these samples.", len(missing), col)
+	}
+}
+
+// addVcfStats computes lrr_sd and baf_sd for samples with calls that do not already have both values.
+func addVcfStats(vcfFile string, calls []cnv.Call, stats map[string]map[string]float64, batchSize int) {
+	need := make(map[string]bool)
+	for _, c := range calls {
+		if _, found := stats[c.Sample]["lrr_sd"]; !found {
+			need[c.Sample] = true
+		}
+		if _, found := stats[c.Sample]["baf_sd"]; !found {
+			need[c.Sample] = true
+		}
+	}
+	var sampleIdx []int
+	for i, s := range signal.SampleNames(vcfFile) {
+		if need[s] {
+			sampleIdx = append(sampleIdx, i)
+		}
+	}
+	keep := func(chr string, pos int) bool { return signal.IsAutosome(chr) }
+	for start := 0; start < len(sampleIdx); start += batchSize {
+		end := start + batchSize
+		if end > len(sampleIdx) {
+			end = len(sampleIdx)
+		}
+		data := signal.Read(vcfFile, keep, sampleIdx[start:end])
+		for s, name := range data.Samples {
+			if stats[name] == nil {
+				stats[name] = make(map[string]float64)
+			}
+			lrrSd, bafSd := sampleSd(data, s)
+			if _, found := stats[name]["lrr_sd"]; !found {
+				stats[name]["lrr_sd"] = lrrSd
+			}
+			if _, found := stats[name]["baf_sd"]; !found {
+				stats[name]["baf_sd"] = bafSd
+			}
+		}
+	}
+}
+
+func sampleSd(d signal.Data, s int) (lrrSd, bafSd float64) {
+	var lrrSum, lrrSumSq, bafSumSq float64
+	var nLrr, nBaf int
+	var x float64
+	for m := range d.Markers {
+		if x = float64(d.Lrr[s][m]); !math.IsNaN(x) {
+			lrrSum += x
+			lrrSumSq += x * x
+			nLrr++
+		}
+		if x = float64(d.Baf[s][m]); d.Het(s, m) && !math.IsNaN(x) {
+			bafSumSq += (x - 0.5) * (x - 0.5)
+			nBaf++
+		}
+	}
+	lrrSd, bafSd = math.NaN(), math.NaN()
+	if nLrr > 1 {
+		lrrSd = math.Sqrt((lrrSumSq - lrrSum*lrrSum/float64(nLrr)) / float64(nLrr-1))
+	}
+	if nBaf > 1 {
+		bafSd = math.Sqrt(bafSumSq / float64(nBaf-1))
+	}
+	return lrrSd, bafSd
+}
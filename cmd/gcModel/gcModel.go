@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/gcmodel"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"gcModel - Compute the GC content of the reference in windows of several sizes centered on each marker of a VCF.\n" +
+			"N and IUPAC ambiguity codes are excluded from both the GC count and the window size. Writes a table with one\n" +
+			"column per window (input for correctGc -gcModel), optionally a PennCNV .gcmodel file, and optionally a copy of\n" +
+			"the VCF with the values as INFO/GC_<size> fields.\n" +
+			"Usage:\n" +
+			"./gcModel [options] -i converted.vcf -ref ref.fa -o gc.tsv\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF. Must be sorted by position.")
+	refFile := flag.String("ref", "", "Reference fasta file. Must have a .fai index.")
+	output := flag.String("o", "stdout", "Output GC table.")
+	windowList := flag.String("windows", gcmodel.JoinWindows(gcmodel.DefaultWindows), "Comma separated window sizes in bp.")
+	pennCnv := flag.String("gcmodel", "", "Output PennCNV .gcmodel file with the GC percent of the -pennWindow window.")
+	pennWindow := flag.Int("pennWindow", 1000000, "Window size in bp for -gcmodel. PennCNV uses 1Mb windows.")
+	vcfOut := flag.String("vcfOut", "", "Output VCF with GC content of each window added as INFO/GC_<size>.")
+	flag.Parse()
+
+	if *input == "" || *refFile == "" {
+		usage()
+		log.Fatal("ERROR: input VCF (-i) and reference fasta (-ref) are required")
+	}
+	windows := gcmodel.ParseWindows(*windowList)
+	pennIdx := -1
+	if *pennCnv != "" {
+		for i := range windows {
+			if windows[i] == *pennWindow {
+				pennIdx = i
+			}
+		}
+		if pennIdx == -1 {
+			windows = append(windows, *pennWindow)
+			pennIdx = len(windows) - 1
+		}
+	}
+
+	markers := signal.Read(*input, nil, []int{}).Markers
+	chr := make([]string, len(markers))
+	id := make([]string, len(markers))
+	pos := make([]int, len(markers))
+	for i := range markers {
+		chr[i], id[i], pos[i] = markers[i].Chr, markers[i].Id, markers[i].Pos
+	}
+	ref := gcmodel.OpenReference(*refFile)
+	gc := gcmodel.Compute(ref, chr, pos, windows)
+	ref.Close()
+	log.Printf("Computed GC content of %d windows for %d markers", len(windows), len(markers))
+
+	gcmodel.WriteTable(*output, chr, id, pos, windows, gc)
+	if *pennCnv != "" {
+		pennGc := make([]float32, len(gc))
+		for m := range gc {
+			pennGc[m] = gc[m][pennIdx]
+		}
+		gcmodel.WritePennCnv(*pennCnv, chr, id, pos, pennGc)
+	}
+	if *vcfOut != "" {
+		annotate(*input, *vcfOut, windows, gc)
+	}
+}
+
+// annotate writes the input VCF with INFO/GC_<size> fields, replacing existing values.
+func annotate(input, output string, windows []int, gc gcmodel.Table) {
+	keys := gcmodel.InfoKeys(windows)
+	records, header := vcf.GoReadToChan(input)
+	header = addInfoHeader(header, keys, windows)
+	out := fileio.EasyCreate(output)
+	vcf.NewWriteHeader(out, header)
+	var m int
+	var info []string
+	for v := range records {
+		info = info[:0]
+		if v.Info != "." && v.Info != "" {
+			for _, kv := range strings.Split(v.Info, ";") {
+				if !isGcKey(kv, keys) {
+					info = append(info, kv)
+				}
+			}
+		}
+		for w := range windows {
+			if !math.IsNaN(float64(gc[m][w])) {
+				info = append(info, fmt.Sprintf("%s=%.4f", keys[w], gc[m][w]))
+			}
+		}
+		v.Info = "."
+		if len(info) > 0 {
+			v.Info = strings.Join(info, ";")
+		}
+		vcf.WriteVcf(out, v)
+		m++
+	}
+	err := out.Close()
+	exception.PanicOnErr(err)
+}
+
+func isGcKey(kv string, keys []string) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(kv, k+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// addInfoHeader adds INFO lines for the GC windows before #CHROM if not already present.
+func addInfoHeader(header vcf.Header, keys []string, windows []int) vcf.Header {
+	last := header.Text[len(header.Text)-1]
+	header.Text = header.Text[:len(header.Text)-1]
+	var found bool
+	for i := range keys {
+		found = false
+		for _, line := range header.Text {
+			found = found || strings.HasPrefix(line, "##INFO=<ID="+keys[i]+",")
+		}
+		if !found {
+			header.Text = append(header.Text, fmt.Sprintf("##INFO=<ID=%s,Number=1,Type=Float,Description=\"GC fraction of the reference "+
+				"in a %d bp window centered on the variant, excluding N and ambiguity codes\">", keys[i], windows[i]))
+		}
+	}
+	header.Text = append(header.Text, last)
+	return header
+}
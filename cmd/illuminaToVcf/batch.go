@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/illumina"
+	"github.com/dasnellings/PGC_mCNV/sexchrom"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/dasnellings/PGC_mCNV/vcfmerge"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// converter writes the VCF of a set of reports (see joinConverter).
+type converter func(gsReportFiles, samples, meta []string, manifestFile, fastaFile, output string, pal *palindromicPolicy,
+	sexes map[string]sexchrom.Sex, buildName string, silent bool, cp checkpointOptions)
+
+// batch is a range of samples converted to one temporary VCF.
+type batch struct {
+	start, end int
+	file       string
+}
+
+// convertBatched converts batchSize samples at a time to temporary VCFs and merges them into output with at
+// most maxOpen files open. Markers are merged in manifest order, or with -join lockstep or coordinate in the
+// order of the batch VCFs. With -join lockstep each batch follows the order of its own first report.
+// Each batch is checkpointed as its own conversion, so that a resumed run keeps the finished batches and
+// continues the interrupted one.
+func convertBatched(convert converter, gsReportFiles, samples, meta []string, manifestFile, fastaFile, output string,
+	pal *palindromicPolicy, sexes map[string]sexchrom.Sex, buildName string, silent bool, cp checkpointOptions, join string,
+	batchSize, maxOpen int, tmpDir string) {
+	prefix := tmpPrefix(tmpDir, output, cp)
+
+	var batchFiles []string
+	var batchMeta []string
+	var firstBatch palindromicPolicy
+	for i, b := range planBatches(samples, batchSize, prefix, cp.resume) {
+		batchMeta = nil
+		if meta != nil {
+			batchMeta = meta[b.start:b.end]
+		}
+		batchFiles = append(batchFiles, b.file)
+		convert(gsReportFiles[b.start:b.end], samples[b.start:b.end], batchMeta, manifestFile, fastaFile, b.file,
+			pal, sexes, buildName, silent, cp)
+		log.Printf("Converted samples %d-%d of %d", b.start+1, b.end, len(gsReportFiles))
+		if i == 0 {
+			firstBatch = *pal
+		}
+	}
+	*pal = firstBatch // every batch converts the same markers, so the first batch has the run summary
+
+	var less vcfmerge.Less
+	switch join {
+	case joinManifest, joinHash:
+		rank := manifestRank(manifestFile)
+		less = func(a, b vcf.Vcf) bool {
+			return rank[strings.ToLower(a.Id)] < rank[strings.ToLower(b.Id)]
+		}
+	default:
+		less = vcfmerge.UnionOrder(batchFiles)
+	}
+	vcfmerge.MergeFiles(batchFiles, output, less, maxOpen-1, prefix)
+	for _, f := range batchFiles {
+		err := os.Remove(f)
+		exception.PanicOnErr(err)
+		removeCheckpoint(f)
+	}
+}
+
+// planBatches divides samples into batches of batchSize. When resuming, the batches with checkpoints keep
+// the samples they had less any that were excluded, and batches with every sample excluded are removed.
+func planBatches(samples []string, batchSize int, prefix string, resume bool) []batch {
+	var ans []batch
+	var start, j, n int
+	var file string
+	if resume {
+		current := make(map[string]bool, len(samples))
+		for _, s := range samples {
+			current[s] = true
+		}
+		for file = batchFile(prefix, j); hasCheckpoint(file); file = batchFile(prefix, j) {
+			n = 0
+			for _, s := range readCheckpoint(file).samples {
+				if current[s] {
+					n++
+				}
+			}
+			j++
+			if n == 0 {
+				err := os.Remove(file)
+				exception.PanicOnErr(err)
+				removeCheckpoint(file)
+				continue
+			}
+			ans = append(ans, batch{start: start, end: minInt(start+n, len(samples)), file: file})
+			start += n
+		}
+	}
+	for ; start < len(samples); start += batchSize {
+		ans = append(ans, batch{start: start, end: minInt(start+batchSize, len(samples)), file: batchFile(prefix, j)})
+		j++
+	}
+	return ans
+}
+
+func batchFile(prefix string, i int) string {
+	return fmt.Sprintf("%s.batch%d.vcf.gz", prefix, i)
+}
+
+// tmpPrefix returns the prefix of temporary files in tmpDir, which defaults to the directory of output.
+// With checkpoints the prefix is named after output so that a resumed run finds the files of the interrupted run.
+func tmpPrefix(tmpDir, output string, cp checkpointOptions) string {
+	if tmpDir == "" {
+		tmpDir = path.Dir(output)
+		if output == "stdout" {
+			tmpDir = os.TempDir()
+		}
+	}
+	if cp.every > 0 {
+		return path.Join(tmpDir, path.Base(output)+".illuminaToVcf")
+	}
+	return path.Join(tmpDir, fmt.Sprintf("illuminaToVcf.%d", os.Getpid()))
+}
+
+// appendTo converts the reports to a temporary VCF and writes the cohort VCF with the new samples added.
+func appendTo(cohort string, convert func(output string), gsReportFiles, samples []string, output string, maxOpen int, prefix string) {
+	if path.Clean(cohort) == path.Clean(output) {
+		log.Fatal("ERROR: output must not overwrite the cohort VCF given to -append")
+	}
+	existing := make(map[string]bool)
+	for _, s := range signal.SampleNames(cohort) {
+		existing[s] = true
+	}
+	for _, s := range samples {
+		if existing[s] {
+			log.Fatalf("ERROR: sample %s is already in %s", s, cohort)
+		}
+	}
+	converted := prefix + ".new.vcf.gz"
+	convert(converted)
+	history := func(added []string) []string {
+		return []string{vcfmerge.HistoryLine("illuminaToVcf", strings.Join(os.Args, " "), added, gsReportFiles)}
+	}
+	vcfmerge.Append(cohort, []string{converted}, output, maxOpen-1, prefix, history)
+	err := os.Remove(converted)
+	exception.PanicOnErr(err)
+	removeCheckpoint(converted)
+}
+
+// manifestRank returns the index of the first occurrence of each marker name in the manifest.
+func manifestRank(manifestFile string) map[string]int {
+	ans := make(map[string]int)
+	var i int
+	var found bool
+	for m := range illumina.GoReadManifestToChan(manifestFile) {
+		if _, found = ans[strings.ToLower(m.Name)]; !found {
+			ans[strings.ToLower(m.Name)] = i
+		}
+		i++
+	}
+	return ans
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
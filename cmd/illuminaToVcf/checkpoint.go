@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/illumina"
+	"github.com/vertgenlab/gonomics/bgzf"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const checkpointHeader string = "##illuminaToVcf checkpoint"
+
+// blockSize is the number of uncompressed bytes in each full BGZF block of the output.
+const blockSize int = 64000
+
+// checkpointOptions controls checkpoints of a conversion.
+type checkpointOptions struct {
+	every  int  // markers converted between checkpoints, 0 for none
+	resume bool // continue from the checkpoint of the output
+}
+
+// reportState is the position reached in a report at a checkpoint. Size and modification time identify the
+// report, so that a report that was replaced is read again from the start rather than from the saved offset.
+type reportState struct {
+	file     string
+	size     int64
+	modified int64
+	pos      illumina.ResumePoint
+}
+
+// checkpointState is the progress of a conversion saved to <output>.ckpt.
+type checkpointState struct {
+	join    string
+	done    bool
+	markers int   // rows of the join converted
+	output  int64 // bytes of output written, ending on a BGZF block boundary for .gz output
+	pal     [5]int
+	samples []string
+	reports []reportState
+}
+
+func checkpointFile(output string) string {
+	return output + ".ckpt"
+}
+
+func hasCheckpoint(output string) bool {
+	_, err := os.Stat(checkpointFile(output))
+	return err == nil
+}
+
+// removeCheckpoint removes the checkpoint of output if there is one.
+func removeCheckpoint(output string) {
+	err := os.Remove(checkpointFile(output))
+	if err != nil && !os.IsNotExist(err) {
+		exception.PanicOnErr(err)
+	}
+}
+
+// write saves s to the checkpoint file of output through a temporary file, so that an interrupted write
+// leaves the previous checkpoint in place.
+func (s checkpointState) write(output string) {
+	tmp := checkpointFile(output) + ".tmp"
+	out := fileio.EasyCreate(tmp)
+	var err error
+	_, err = fmt.Fprintf(out, "%s\njoin\t%s\ndone\t%t\nmarkers\t%d\noutput\t%d\npalindromic\t%d\t%d\t%d\t%d\t%d\n", checkpointHeader, s.join,
+		s.done, s.markers, s.output, s.pal[0], s.pal[1], s.pal[2], s.pal[3], s.pal[4])
+	exception.PanicOnErr(err)
+	_, err = fmt.Fprintln(out, "#sample\treport\tsize\tmodified\trecord\toffset\tmarker")
+	exception.PanicOnErr(err)
+	for i := range s.samples {
+		_, err = fmt.Fprintf(out, "%s\t%s\t%d\t%d\t%d\t%d\t%s\n", s.samples[i], s.reports[i].file, s.reports[i].size,
+			s.reports[i].modified, s.reports[i].pos.Record, s.reports[i].pos.Offset, s.reports[i].pos.Marker)
+		exception.PanicOnErr(err)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+	err = os.Rename(tmp, checkpointFile(output))
+	exception.PanicOnErr(err)
+}
+
+// readCheckpoint reads the checkpoint of output.
+func readCheckpoint(output string) checkpointState {
+	var s checkpointState
+	var words []string
+	var err error
+	var r reportState
+	filename := checkpointFile(output)
+	file := fileio.EasyOpen(filename)
+	line, done := fileio.EasyNextLine(file)
+	if done || line != checkpointHeader {
+		log.Fatalf("ERROR: %s is not an illuminaToVcf checkpoint", filename)
+	}
+	for line, done = fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		words = strings.Split(line, "\t")
+		switch {
+		case words[0] == "join" && len(words) == 2:
+			s.join = words[1]
+		case words[0] == "done" && len(words) == 2:
+			s.done, err = strconv.ParseBool(words[1])
+		case words[0] == "markers" && len(words) == 2:
+			s.markers, err = strconv.Atoi(words[1])
+		case words[0] == "output" && len(words) == 2:
+			s.output, err = strconv.ParseInt(words[1], 10, 64)
+		case words[0] == "palindromic" && len(words) == 6:
+			for i := range s.pal {
+				if s.pal[i], err = strconv.Atoi(words[i+1]); err != nil {
+					break
+				}
+			}
+		case len(words) == 7:
+			r = reportState{file: words[1], pos: illumina.ResumePoint{Marker: words[6]}}
+			r.size, err = strconv.ParseInt(words[2], 10, 64)
+			if err == nil {
+				r.modified, err = strconv.ParseInt(words[3], 10, 64)
+			}
+			if err == nil {
+				r.pos.Record, err = strconv.Atoi(words[4])
+			}
+			if err == nil {
+				r.pos.Offset, err = strconv.ParseInt(words[5], 10, 64)
+			}
+			s.samples = append(s.samples, words[0])
+			s.reports = append(s.reports, r)
+		default:
+			log.Fatalf("ERROR: unexpected line in %s:\n%s", filename, line)
+		}
+		if err != nil {
+			log.Fatalf("ERROR: could not parse line in %s: %v\n%s", filename, err, line)
+		}
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return s
+}
+
+// setPalindromic copies the run summary of the palindromic policy to s, or from s to the policy if restore is true.
+func (s *checkpointState) setPalindromic(pal *palindromicPolicy, restore bool) {
+	counts := [5]*int{&pal.total, &pal.byContext, &pal.byAf, &pal.unresolved, &pal.dropped}
+	for i := range counts {
+		if restore {
+			*counts[i] = s.pal[i]
+		} else {
+			s.pal[i] = *counts[i]
+		}
+	}
+}
+
+// statReport returns the state of a report that has not been read.
+func statReport(filename string) reportState {
+	info, err := os.Stat(filename)
+	exception.PanicOnErr(err)
+	return reportState{file: filename, size: info.Size(), modified: info.ModTime().UnixNano()}
+}
+
+// checkpointWriter writes output that can be cut back to the last checkpoint: BGZF blocks ending at each
+// checkpoint for .gz files, and plain text otherwise.
+type checkpointWriter struct {
+	file *os.File
+	bgzf *bgzf.BlockWriter
+	buf  bytes.Buffer
+}
+
+// newCheckpointWriter opens output for writing after its first size bytes, which are kept.
+func newCheckpointWriter(output string, size int64) *checkpointWriter {
+	var err error
+	w := &checkpointWriter{}
+	w.file, err = os.OpenFile(output, os.O_WRONLY|os.O_CREATE, 0644)
+	exception.PanicOnErr(err)
+	err = w.file.Truncate(size)
+	exception.PanicOnErr(err)
+	_, err = w.file.Seek(size, io.SeekStart)
+	exception.PanicOnErr(err)
+	if strings.HasSuffix(output, ".gz") {
+		w.bgzf = bgzf.NewBlockWriter(w.file)
+	}
+	return w
+}
+
+func (w *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := w.buf.Write(p)
+	for w.buf.Len() >= blockSize {
+		w.writeBlock(w.buf.Next(blockSize))
+	}
+	return n, err
+}
+
+func (w *checkpointWriter) writeBlock(p []byte) {
+	var err error
+	if w.bgzf != nil {
+		_, err = w.bgzf.Write(p)
+	} else {
+		_, err = w.file.Write(p)
+	}
+	exception.PanicOnErr(err)
+}
+
+// flush writes all buffered output, ending a BGZF block, syncs the file, and returns its size.
+func (w *checkpointWriter) flush() int64 {
+	if w.buf.Len() > 0 {
+		w.writeBlock(w.buf.Next(w.buf.Len()))
+	}
+	err := w.file.Sync()
+	exception.PanicOnErr(err)
+	size, err := w.file.Seek(0, io.SeekCurrent)
+	exception.PanicOnErr(err)
+	return size
+}
+
+// Close flushes the output, adds the BGZF end of file marker, and returns the size of the output before the marker.
+func (w *checkpointWriter) Close() (int64, error) {
+	size := w.flush()
+	var err error
+	if w.bgzf != nil {
+		err = w.bgzf.Close()
+		exception.PanicOnErr(err)
+	}
+	return size, w.file.Close()
+}
+
+// checkpointer writes the output of a conversion and saves its progress every opt.every markers.
+type checkpointer struct {
+	output string
+	opt    checkpointOptions
+	w      *checkpointWriter
+	plain  *fileio.EasyWriter // output when not checkpointing
+	state  checkpointState
+	pal    *palindromicPolicy
+}
+
+// startConversion opens the output and reports of a conversion. With opt.resume the output is cut back
+// to its last checkpoint and the reports continue after the records read by then. Samples that were in the
+// checkpoint but are not in samples are removed from the output. Reports that changed since the checkpoint
+// are read again from the start and must have the same markers up to the checkpoint. Returns false if the
+// checkpoint is of a finished conversion.
+func startConversion(output, join string, gsReportFiles, samples []string, header vcf.Header, pal *palindromicPolicy,
+	opt checkpointOptions) (*checkpointer, []<-chan illumina.GsReport, bool) {
+	c := &checkpointer{output: output, opt: opt, pal: pal}
+	chans := make([]<-chan illumina.GsReport, len(gsReportFiles))
+	if opt.every == 0 {
+		c.plain = fileio.EasyCreate(output)
+		vcf.NewWriteHeader(c.plain, header)
+		for i := range gsReportFiles {
+			chans[i] = illumina.GoReadGsReportToChanBuffered(gsReportFiles[i], reportBuffer)
+		}
+		return c, chans, true
+	}
+
+	if !opt.resume || !hasCheckpoint(output) {
+		if opt.resume {
+			log.Printf("WARNING: no checkpoint found for %s. Converting from the start.", output)
+		}
+		c.state = checkpointState{join: join, samples: samples, reports: make([]reportState, len(gsReportFiles))}
+		for i := range gsReportFiles {
+			c.state.reports[i] = statReport(gsReportFiles[i])
+			chans[i] = illumina.GoReadGsReportToChanBuffered(gsReportFiles[i], reportBuffer)
+		}
+		c.w = newCheckpointWriter(output, 0)
+		vcf.NewWriteHeader(c.w, header)
+		c.state.output = c.w.flush()
+		c.state.write(output)
+		return c, chans, true
+	}
+
+	c.state = readCheckpoint(output)
+	if c.state.join != join {
+		log.Fatalf("ERROR: %s was started with -join %s and must be resumed with it", output, c.state.join)
+	}
+	c.state.setPalindromic(pal, true)
+	keep := keptSamples(c.state.samples, samples, checkpointFile(output))
+	if len(keep) < len(c.state.samples) {
+		c.w = dropSamples(output, c.state.output, header, keep)
+		reports := make([]reportState, len(keep))
+		for i := range keep {
+			reports[i] = c.state.reports[keep[i]]
+		}
+		c.state.samples, c.state.reports = samples, reports
+	}
+	if c.state.done {
+		log.Printf("Conversion of %s was already finished", output)
+		if c.w != nil {
+			var err error
+			c.state.output, err = c.w.Close()
+			exception.PanicOnErr(err)
+			c.state.write(output)
+		}
+		return c, nil, false
+	}
+	var curr reportState
+	var seek bool
+	for i := range gsReportFiles {
+		curr = statReport(gsReportFiles[i])
+		seek = curr.file == c.state.reports[i].file && curr.size == c.state.reports[i].size && curr.modified == c.state.reports[i].modified
+		if !seek {
+			log.Printf("Report of %s changed since the checkpoint. Skipping the first %d records of %s.", samples[i],
+				c.state.reports[i].pos.Record, gsReportFiles[i])
+		}
+		curr.pos = c.state.reports[i].pos
+		c.state.reports[i] = curr
+		chans[i] = illumina.GoReadGsReportResume(gsReportFiles[i], reportBuffer, curr.pos, seek)
+	}
+	if c.w == nil {
+		c.w = newCheckpointWriter(output, c.state.output)
+	}
+	c.state.output = c.w.flush()
+	c.state.write(output)
+	log.Printf("Resuming conversion of %s after %d markers", output, c.state.markers)
+	return c, chans, true
+}
+
+// keptSamples returns the index in the checkpoint of each sample. Samples may be excluded since the
+// checkpoint but not added or reordered.
+func keptSamples(checkpointed, samples []string, filename string) []int {
+	idx := make(map[string]int, len(checkpointed))
+	for i := range checkpointed {
+		idx[checkpointed[i]] = i
+	}
+	ans := make([]int, len(samples))
+	var found bool
+	for i := range samples {
+		if ans[i], found = idx[samples[i]]; !found {
+			log.Fatalf("ERROR: sample %s is not in %s. Samples cannot be added when resuming; convert them separately and use appendSamples", samples[i], filename)
+		}
+		if i > 0 && ans[i] < ans[i-1] {
+			log.Fatalf("ERROR: samples are not in the order of %s", filename)
+		}
+	}
+	if len(ans) < len(checkpointed) {
+		log.Printf("Removing %d samples excluded since the checkpoint", len(checkpointed)-len(ans))
+	}
+	return ans
+}
+
+// dropSamples rewrites the first size bytes of output with header and only the sample columns in keep,
+// and returns the writer of the rewritten output.
+func dropSamples(output string, size int64, header vcf.Header, keep []int) *checkpointWriter {
+	tmp := strings.TrimSuffix(output, ".gz") + ".tmp"
+	if strings.HasSuffix(output, ".gz") {
+		tmp += ".gz"
+	}
+	err := os.Rename(output, tmp)
+	exception.PanicOnErr(err)
+	err = os.Truncate(tmp, size)
+	exception.PanicOnErr(err)
+	in := fileio.EasyOpen(tmp)
+	w := newCheckpointWriter(output, 0)
+	vcf.NewWriteHeader(w, header)
+	var words []string
+	var sb strings.Builder
+	for line, done := fileio.EasyNextLine(in); !done; line, done = fileio.EasyNextLine(in) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = strings.Split(line, "\t")
+		sb.Reset()
+		sb.WriteString(strings.Join(words[:9], "\t"))
+		for _, k := range keep {
+			sb.WriteString("\t" + words[9+k])
+		}
+		sb.WriteString("\n")
+		_, err = w.Write([]byte(sb.String()))
+		exception.PanicOnErr(err)
+	}
+	err = in.Close()
+	exception.PanicOnErr(err)
+	err = os.Remove(tmp)
+	exception.PanicOnErr(err)
+	return w
+}
+
+// Write writes to the output.
+func (c *checkpointer) Write(p []byte) (int, error) {
+	if c.plain != nil {
+		return c.plain.Write(p)
+	}
+	return c.w.Write(p)
+}
+
+// markersDone returns the number of markers converted before the conversion was resumed.
+func (c *checkpointer) markersDone() int {
+	return c.state.markers
+}
+
+// positions returns the position reached in each report at the checkpoint.
+func (c *checkpointer) positions() []illumina.ResumePoint {
+	ans := make([]illumina.ResumePoint, len(c.state.reports))
+	for i := range c.state.reports {
+		ans[i] = c.state.reports[i].pos
+	}
+	return ans
+}
+
+// tick saves a checkpoint every opt.every markers. pos is the position after the last record of each
+// report that was fully used by the markers converted.
+func (c *checkpointer) tick(markers int, pos []illumina.ResumePoint) {
+	if c.w == nil || markers == 0 || markers%c.opt.every != 0 {
+		return
+	}
+	c.save(markers, pos)
+}
+
+func (c *checkpointer) save(markers int, pos []illumina.ResumePoint) {
+	c.state.markers = markers
+	c.state.output = c.w.flush()
+	for i := range pos {
+		c.state.reports[i].pos = pos[i]
+	}
+	c.state.setPalindromic(c.pal, false)
+	c.state.write(c.output)
+}
+
+// close closes the output and marks the checkpoint finished. The checkpoint is kept until removed by
+// removeCheckpoint, so that the finished output is not converted again on resume.
+func (c *checkpointer) close(markers int, pos []illumina.ResumePoint) {
+	var err error
+	if c.plain != nil {
+		err = c.plain.Close()
+		exception.PanicOnErr(err)
+		return
+	}
+	c.save(markers, pos)
+	c.state.done = true
+	c.state.output, err = c.w.Close()
+	exception.PanicOnErr(err)
+	c.state.write(c.output)
+}
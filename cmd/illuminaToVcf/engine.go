@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/illumina"
+	"github.com/dasnellings/PGC_mCNV/sexchrom"
+	"github.com/dasnellings/PGC_mCNV/vcfmerge"
+	"github.com/vertgenlab/gonomics/dna"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fasta"
+	"github.com/vertgenlab/gonomics/vcf"
+	"golang.org/x/exp/slices"
+	"log"
+	"math"
+	"strings"
+)
+
+// joinConverter returns the converter joining reports to the manifest by a join strategy.
+func joinConverter(join string) converter {
+	return func(gsReportFiles, samples, meta []string, manifestFile, fastaFile, output string, pal *palindromicPolicy,
+		sexes map[string]sexchrom.Sex, buildName string, silent bool, cp checkpointOptions) {
+		convertReports(join, gsReportFiles, samples, meta, manifestFile, fastaFile, output, pal, sexes, buildName, silent, cp)
+	}
+}
+
+// convertReports writes the VCF of a set of reports with the rows of a join strategy. Samples without a
+// marker are written with missing values, and markers without any sample are not written.
+func convertReports(join string, gsReportFiles, samples, meta []string, manifestFile, fastaFile, output string, pal *palindromicPolicy,
+	sexes map[string]sexchrom.Sex, buildName string, silent bool, cp checkpointOptions) {
+	out, gsReportChans, started := startConversion(output, join, gsReportFiles, samples, makeHeader(samples, meta), pal, cp)
+	if !started {
+		return
+	}
+	ref := fasta.NewSeeker(fastaFile, fastaFile+".fai")
+	mc := &markerConverter{ref: ref, ploidy: newPloidyModel(buildName, sexes, samples, silent), pal: pal, silent: silent}
+	rows := newJoiner(join, gsReportChans, gsReportFiles, manifestFile, out.markersDone(), silent)
+
+	r := row{gs: make([]illumina.GsReport, len(samples)), has: make([]bool, len(samples))}
+	var curr vcf.Vcf
+	var write bool
+	markers := out.markersDone()
+	for {
+		out.tick(markers, rows.positions())
+		if !rows.next(&r) {
+			break
+		}
+		markers++
+		if !slices.Contains(r.has, true) {
+			rows.stats().empty++
+			continue
+		}
+		if curr, write = mc.convert(r, gsReportFiles); write {
+			vcf.WriteVcf(out, curr)
+		}
+	}
+	out.close(markers, rows.positions())
+	if !silent {
+		rows.stats().report(samples, join)
+	}
+	err := ref.Close()
+	exception.PanicOnErr(err)
+}
+
+// markerConverter converts a row of report records to a VCF record.
+type markerConverter struct {
+	ref    *fasta.Seeker
+	ploidy *ploidyModel
+	pal    *palindromicPolicy
+	silent bool
+}
+
+var format = []string{"GT", "BAF", "LRR"}
+
+// convert returns the VCF record of a row and whether it should be written.
+func (c *markerConverter) convert(r row, gsReportFiles []string) (vcf.Vcf, bool) {
+	var err error
+	var curr vcf.Vcf
+	var alleleAint, alleleBint int16
+	var alleleA, alleleB, gsAllele1, gsAllele2 string
+	var seqBefore, seqAfter []dna.Base
+	var stringBefore, stringAfter string
+	var refBase []dna.Base
+	var altNeedsRevComp, palindromic bool
+	var strandRes string
+	var gs illumina.GsReport
+	curr.Filter = "."
+	curr.Format = format
+
+	m := r.m
+	c.ploidy.setBuild(m.GenomeBuild)
+	reported := reportedAs(m)
+	if m.Chr == "XY" || m.Chr == "chrXY" { // SERIOUSLY ILLUMINA... SERIOUSLY
+		m.Chr = "X"
+		m.Pos = c.ploidy.placeXY(m.Name, m.Pos)
+	}
+	curr.Chr = "chr" + strings.TrimLeft(m.Chr, "chr")
+	curr.Pos = m.Pos
+	curr.Id = m.Name
+	refBase, err = fasta.SeekByName(c.ref, "chr"+strings.TrimLeft(m.Chr, "chr"), m.Pos-1, m.Pos)
+	exception.PanicOnErr(err)
+	curr.Ref = strings.ToUpper(dna.BaseToString(refBase[0]))
+
+	seqBefore, err = fasta.SeekByName(c.ref, "chr"+strings.TrimLeft(m.Chr, "chr"), (m.Pos-1)-len(m.SeqBefore), m.Pos-1)
+	exception.PanicOnErr(err)
+	stringBefore = strings.ToUpper(dna.BasesToString(seqBefore))
+	seqAfter, err = fasta.SeekByName(c.ref, "chr"+strings.TrimLeft(m.Chr, "chr"), m.Pos, m.Pos+len(m.SeqAfter))
+	if err != nil && !c.silent {
+		log.Printf("WARNING: %v", err)
+	}
+	stringAfter = strings.ToUpper(dna.BasesToString(seqAfter))
+
+	// check one of the alleles matches ref
+	switch {
+	case levenshtein(stringBefore, m.SeqBefore) <= 5 ||
+		levenshtein(stringAfter, m.SeqAfter) <= 5: // this is a really weak match, but you would not believe the things I have seen...
+		if !m.TopStrand {
+			altNeedsRevComp = true
+		}
+
+		// only do partial check on rev comps since if snp is not directly in middle of probe then before/after lengths differ
+	case levenshtein(illumina.RevComp(stringBefore)[:5], m.SeqAfter[:5]) <= 1 ||
+		levenshtein(illumina.RevComp(stringAfter)[len(stringAfter)-5:], m.SeqBefore[len(m.SeqBefore)-5:]) <= 1:
+		if m.TopStrand {
+			altNeedsRevComp = true
+		}
+
+	default:
+		if !c.silent {
+			log.Printf("WARNING: Context sequences did not match reference:\n%s+%s\n%s+%s\n", stringBefore, stringAfter, m.SeqBefore, m.SeqAfter)
+			log.Println(m.Name, m.Chr, m.Pos)
+		}
+	}
+
+	palindromic = isPalindromic(m.AlleleA, m.AlleleB)
+	if palindromic {
+		strandRes = resUnresolved
+		if c.pal.mode == palContext {
+			if fwd, strong := strongContextMatch(c.ref, curr.Chr, m); strong {
+				altNeedsRevComp = fwd != m.TopStrand
+				strandRes = resContext
+			}
+		}
+	}
+
+	if altNeedsRevComp {
+		alleleA = illumina.RevComp(m.AlleleA)
+		alleleB = illumina.RevComp(m.AlleleB)
+	} else {
+		alleleA = m.AlleleA
+		alleleB = m.AlleleB
+	}
+
+	alleleAint, alleleBint, curr.Alt = assignAlleles(curr.Ref, alleleA, alleleB)
+	curr.Samples = make([]vcf.Sample, len(r.gs))
+	for i := range curr.Samples {
+		if !r.has[i] {
+			curr.Samples[i] = vcfmerge.Missing(curr.Format)
+			continue
+		}
+		gs = r.gs[i]
+		if !matchesManifest(gs, reported) && !c.silent {
+			log.Printf("WARNING: Manifest mismatch in %s. See report and manifest data below\n%v\n%v\n", gsReportFiles[i], gs, m)
+		}
+		gsAllele1 = gs.Allele1
+		gsAllele2 = gs.Allele2
+		if (gs.ReportedAsFwd && m.TopStrand != m.SrcTopStrand) || (!gs.ReportedAsFwd && !m.TopStrand) {
+			gsAllele1 = illumina.RevComp(gsAllele1)
+			gsAllele2 = illumina.RevComp(gsAllele2)
+		}
+
+		curr.Samples[i].FormatData = []string{"", fmt.Sprintf("%.4g", gs.BAlleleFreq), fmt.Sprintf("%.4g", gs.LogRRatio)}
+		switch gsAllele1 {
+		case m.AlleleA:
+			curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleAint)
+		case m.AlleleB:
+			curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleBint)
+		}
+		switch gsAllele2 {
+		case m.AlleleA:
+			curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleAint)
+		case m.AlleleB:
+			curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleBint)
+		}
+		curr.Samples[i].Phase = make([]bool, len(curr.Samples[i].Alleles)) // leave as false for unphased
+	}
+	c.ploidy.apply(&curr)
+
+	if palindromic && c.pal.mode == palAf {
+		if flip, resolved := c.pal.resolveByAf(curr.Chr, curr.Pos, alleleB, curr.Samples, alleleAint, alleleBint); resolved {
+			if flip {
+				alleleAint, alleleBint = flipStrand(&curr, alleleA, alleleB, alleleAint, alleleBint)
+			}
+			strandRes = resAf
+		}
+	}
+
+	curr.Info = fmt.Sprintf("ALLELE_A=%d;ALLELE_B=%d", alleleAint, alleleBint)
+	if !math.IsNaN(m.GC) { // no unambiguous context bases
+		curr.Info += fmt.Sprintf(";GC=%.4g", m.GC)
+	}
+	if palindromic {
+		curr.Info += ";PALINDROMIC;STRAND_RES=" + strandRes
+	}
+
+	if curr.Chr == "chrM" { // exclude chrM
+		return curr, false
+	}
+	if palindromic && !c.pal.keep(strandRes) {
+		return curr, false
+	}
+	return curr, true
+}
@@ -4,24 +4,30 @@ import (
 	"flag"
 	"fmt"
 	"github.com/dasnellings/PGC_mCNV/illumina"
-	"github.com/vertgenlab/gonomics/dna"
-	"github.com/vertgenlab/gonomics/exception"
-	"github.com/vertgenlab/gonomics/fasta"
-	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/dasnellings/PGC_mCNV/samplesheet"
+	"github.com/dasnellings/PGC_mCNV/sexchrom"
 	"github.com/vertgenlab/gonomics/numbers"
 	"github.com/vertgenlab/gonomics/vcf"
 	"golang.org/x/exp/slices"
 	"log"
+	"os"
 	"path"
 	"strings"
 )
 
-const debug int = 0
+// reservedFiles is the number of files other than reports that may be open during conversion
+// (manifest, reference, panel, and output).
+const reservedFiles int = 4
+
+// reportBuffer is the number of records read ahead from each open report.
+var reportBuffer int = 100
 
 const headerInfo string = "##fileformat=VCFv4.2\n" +
 	"##INFO=<ID=ALLELE_A,Number=1,Type=Integer,Description=\"A allele\">\n" +
 	"##INFO=<ID=ALLELE_B,Number=1,Type=Integer,Description=\"B allele\">\n" +
-	"##INFO=<ID=GC,Number=1,Type=Float,Description=\"GC ratio content around the variant\">\n" +
+	"##INFO=<ID=GC,Number=1,Type=Float,Description=\"GC ratio content around the variant. Missing if the context has no unambiguous bases\">\n" +
+	"##INFO=<ID=PALINDROMIC,Number=0,Type=Flag,Description=\"A/T or C/G SNP where strand cannot be determined from the alleles\">\n" +
+	"##INFO=<ID=STRAND_RES,Number=1,Type=String,Description=\"Strand resolution of palindromic SNPs (context, af, unresolved)\">\n" +
 	"##FORMAT=<ID=GT,Number=1,Type=String,Description=\"Genotype\">\n" +
 	"##FORMAT=<ID=BAF,Number=1,Type=Float,Description=\"B Allele Frequency\">\n" +
 	"##FORMAT=<ID=LRR,Number=1,Type=Float,Description=\"Log R Ratio\">\n" +
@@ -31,420 +37,192 @@ func usage() {
 	fmt.Print(
 		"illuminaToVcf - Convert SNP array data from GenomeStudio report format to VCF format.\n" +
 			"Usage:\n" +
-			"./illuminaToVcf [options] -gsReport sample1,sample2 -manifest arrayManifest.csv -ref reference.fasta\n\n")
+			"./illuminaToVcf [options] -gsReport sample1,sample2 -manifest arrayManifest.csv -ref reference.fasta\n" +
+			"./illuminaToVcf [options] -samples sheet.tsv -manifest arrayManifest.csv -ref reference.fasta\n\n" +
+			"Every report of a batch is open at once with -reportBuffer records read ahead, so memory use grows with\n" +
+			"-batchSize times -reportBuffer. With more reports than -batchSize (or -maxOpenFiles), samples are converted\n" +
+			"in batches to temporary VCFs in -tmpDir that are then merged into the output.\n\n" +
+			"Progress is saved to <output>.ckpt every -checkpoint markers. A conversion that failed (e.g. on a truncated report)\n" +
+			"continues from its last checkpoint when run again with -resume after the report is repaired or removed.\n\n")
 	flag.PrintDefaults()
 }
 
 func main() {
 	gsReportFilename := flag.String("gsReport", "", "GenomeStudio summary report file. The file "+
 		"should be named by sample and have tab seperated fields. May be a comma-seperated list of files.")
+	sheetFile := flag.String("samples", "", "Tab separated sample sheet with a header line and one row per sample, used in place of -gsReport. "+
+		"Requires a 'file' column with the GenomeStudio report of each sample (relative paths not found from the working directory are "+
+		"read relative to the sheet). Sample IDs are taken from the 'sample' (or 'sample_id' or 'id') column, or the first column. "+
+		"A 'sex' column is used as with -sex, and the sex, batch, and plate columns are written to the VCF header as ##SAMPLE lines.")
 	manifestFilename := flag.String("manifest", "", "Manifest file for the array used (.csv)")
 	fastaFilename := flag.String("ref", "", "Reference fasta file for the assembly used for the GenomeStudio report.")
 	output := flag.String("o", "stdout", "Output VCF file")
-	mapmode := flag.Bool("hash", false, "Hash map lookup for snp IDs. Use for out of order data.")
+	join := flag.String("join", joinManifest, "How report records are matched to markers. Options: 'manifest' writes markers in manifest "+
+		"order and reads each report in that order, 'lockstep' writes markers in the order of the first report and reads the other "+
+		"reports in step with it, 'hash' writes markers in manifest order and reads reports into memory so they may be in any order "+
+		"(about 20 bytes per marker per sample), 'coordinate' writes markers in coordinate order by merging reports sorted by "+
+		"chromosome and position. Markers a report lacks, or has out of order, are written as missing for that sample.")
+	mapmode := flag.Bool("hash", false, "Deprecated. Equivalent to -join lockstep, not -join hash. Kept for existing scripts.")
 	silent := flag.Bool("suppress", false, "Prevent warning messages.")
+	palindromic := flag.String("palindromic", palFlag, "Policy for A/T and C/G SNPs whose strand cannot be determined from the alleles. "+
+		"Options: 'drop' removes them, 'flag' keeps the default context-based orientation, 'context' orients only on a strong "+
+		"flanking sequence match, 'af' orients by comparing cohort allele frequency to a reference panel (-panel). "+
+		"Markers that cannot be resolved under 'context' or 'af' are dropped. All palindromic markers are tagged in INFO.")
+	panelFile := flag.String("panel", "", "Reference panel sites VCF with allele frequencies in INFO (e.g. 1000G or gnomAD). Required for -palindromic af.")
+	panelAfKey := flag.String("panelAf", "AF", "INFO field in -panel holding the ALT allele frequency.")
+	panelMaxMaf := flag.Float64("panelMaxMaf", 0.4, "Maximum panel minor allele frequency for resolving palindromic markers by allele frequency.")
+	sexFile := flag.String("sex", "", "Tab separated file of sample names and sex (sample<TAB>sex; XX/XY/X0/XXY/XXX, M/F, or 1/2). "+
+		"When given, genotypes are haploid for males on non-PAR X and on Y, and missing for samples without a Y on chrY. "+
+		"Entries take precedence over the sex column of -samples.")
+	inferSex := flag.Bool("inferSex", false, "Infer sex from chrX heterozygosity and chrX/chrY LRR before conversion. "+
+		"Confident inferred calls are used for ploidy-aware genotypes in place of -sex, which is used for ambiguous samples and to flag disagreements.")
+	sexOut := flag.String("sexOut", "", "Output per-sample inferred sex table (.tsv) when using -inferSex.")
+	batchSize := flag.Int("batchSize", 0, "Maximum number of samples converted at once. Larger cohorts are converted in batches "+
+		"that are merged into the output. 0 converts all samples at once unless there are more reports than -maxOpenFiles allows.")
+	maxOpenFiles := flag.Int("maxOpenFiles", 1000, "Maximum number of files open at once during conversion and merging.")
+	tmpDir := flag.String("tmpDir", "", "Directory for temporary batch VCFs. Defaults to the directory of -o, or the system temporary directory for stdout.")
+	cohort := flag.String("append", "", "Existing cohort VCF (output of illuminaToVcf). The converted samples are added to a copy of the "+
+		"cohort written to -o, with missing values where the marker sets differ. Sample IDs already in the cohort are refused.")
+	checkpoint := flag.Int("checkpoint", 100000, "Save a checkpoint to <output>.ckpt every this many markers, so that an interrupted "+
+		"conversion can be continued with -resume. Output ending in .gz is written in BGZF blocks that end at each checkpoint. "+
+		"0 disables checkpoints. Checkpoints are not written for stdout.")
+	resume := flag.Bool("resume", false, "Continue an interrupted conversion from its last checkpoint, given the same options. Reports may "+
+		"be repaired (with the same markers up to the checkpoint) or excluded, which removes their samples from the output.")
+	flag.IntVar(&reportBuffer, "reportBuffer", reportBuffer, "Number of records read ahead from each open report.")
+	build := flag.String("build", "", "Genome build for PAR coordinates (hg19/GRCh37 or hg38/GRCh38). Defaults to the manifest GenomeBuild.")
 	flag.Parse()
 
-	if *gsReportFilename == "" || *manifestFilename == "" || *fastaFilename == "" {
+	if (*gsReportFilename == "") == (*sheetFile == "") || *manifestFilename == "" || *fastaFilename == "" {
 		usage()
-		log.Fatal("ERROR: GenomeStudio report, manifest, and reference fasta files are required (-gsReport, -manifest, -ref)")
-	}
-
-	if *mapmode {
-		illuminaToVcfMap(strings.Split(*gsReportFilename, ","), *manifestFilename, *fastaFilename, *output, *silent)
-	} else {
-		illuminaToVcf(strings.Split(*gsReportFilename, ","), *manifestFilename, *fastaFilename, *output, *silent)
+		log.Fatal("ERROR: one of GenomeStudio reports (-gsReport) or a sample sheet (-samples), and manifest and reference fasta files are required (-manifest, -ref)")
 	}
-}
-
-func illuminaToVcf(gsReportFiles []string, manifestFile, fastaFile, output string, silent bool) {
-	out := fileio.EasyCreate(output)
-	ref := fasta.NewSeeker(fastaFile, fastaFile+".fai")
-	var header vcf.Header
-	header.Text = strings.Split(headerInfo, "\n")
-
-	trimSamples := slices.Clone(gsReportFiles)
-	for i := range trimSamples {
-		trimSamples[i] = strings.TrimRight(path.Base(trimSamples[i]), ".gz")
+	if reportBuffer < 0 {
+		log.Fatal("ERROR: -reportBuffer must not be negative")
 	}
-	header.Text[len(header.Text)-1] += "\t" + strings.Join(trimSamples, "\t")
-	vcf.NewWriteHeader(out, header)
-
-	gsReportChans := make([]<-chan illumina.GsReport, len(gsReportFiles))
-	for i := range gsReportFiles {
-		gsReportChans[i] = illumina.GoReadGsReportToChan(gsReportFiles[i])
+	pal := newPalindromicPolicy(*palindromic, *panelFile, *panelAfKey, *panelMaxMaf)
+	var gsReportFiles, samples, meta []string
+	var sexes map[string]sexchrom.Sex
+	if *sheetFile != "" {
+		sheet := samplesheet.Read(*sheetFile)
+		gsReportFiles, samples = sheetReports(sheet, *sheetFile)
+		sexes = sheetSexes(sheet)
+		meta = samplesheet.MetaLines(sheet, samples, []string{samplesheet.Sex, samplesheet.Batch, samplesheet.Plate})
+	} else {
+		gsReportFiles = strings.Split(*gsReportFilename, ",")
+		samples = sampleNames(gsReportFiles)
 	}
-	manifestData := illumina.GoReadManifestToChan(manifestFile)
-
-	var err error
-	var curr vcf.Vcf
-	var gs illumina.GsReport
-	curr.Filter = "."
-	curr.Format = []string{"GT", "BAF", "LRR"}
-	sb := new(strings.Builder)
-	var alleleAint, alleleBint int16
-	var alleleA, alleleB, gsAllele1, gsAllele2 string
-	var seqBefore, seqAfter []dna.Base
-	var stringBefore, stringAfter string
-	var refBase []dna.Base
-	var altNeedsRevComp bool
-	var samplesWritten int
-
-	for m := range manifestData {
-		if m.Chr == "XY" || m.Chr == "chrXY" { // SERIOUSLY ILLUMINA... SERIOUSLY
-			m.Chr = "X"
+	if *sexFile != "" {
+		if sexes == nil {
+			sexes = make(map[string]sexchrom.Sex)
 		}
-		curr.Chr = "chr" + strings.TrimLeft(m.Chr, "chr")
-		curr.Pos = m.Pos
-		curr.Id = m.Name
-		refBase, err = fasta.SeekByName(ref, "chr"+strings.TrimLeft(m.Chr, "chr"), m.Pos-1, m.Pos)
-		exception.PanicOnErr(err)
-		curr.Ref = strings.ToUpper(dna.BaseToString(refBase[0]))
-
-		seqBefore, err = fasta.SeekByName(ref, "chr"+strings.TrimLeft(m.Chr, "chr"), (m.Pos-1)-len(m.SeqBefore), m.Pos-1)
-		exception.PanicOnErr(err)
-		stringBefore = strings.ToUpper(dna.BasesToString(seqBefore))
-		seqAfter, err = fasta.SeekByName(ref, "chr"+strings.TrimLeft(m.Chr, "chr"), m.Pos, m.Pos+len(m.SeqAfter))
-		if err != nil && !silent {
-			fmt.Println("WARNING", err)
+		for sample, sex := range sexchrom.ReadSexFile(*sexFile) {
+			sexes[sample] = sex
 		}
-		stringAfter = strings.ToUpper(dna.BasesToString(seqAfter))
-
-		// check one of the alleles matches ref
-		altNeedsRevComp = false
-		switch {
-		case levenshtein(stringBefore, m.SeqBefore) <= 5 ||
-			levenshtein(stringAfter, m.SeqAfter) <= 5: // this is a really weak match, but you would not believe the things I have seen...
-			if !m.TopStrand {
-				altNeedsRevComp = true
-			}
-
-			// only do partial check on rev comps since if snp is not directly in middle of probe then before/after lengths differ
-		case levenshtein(revComp(stringBefore)[:5], m.SeqAfter[:5]) <= 1 ||
-			levenshtein(revComp(stringAfter)[len(stringAfter)-5:], m.SeqBefore[len(m.SeqBefore)-5:]) <= 1:
-			if m.TopStrand {
-				altNeedsRevComp = true
-			}
+	}
+	if *inferSex {
+		sexes = inferSexFromReports(gsReportFiles, samples, *manifestFilename, *build, sexes, *sexOut)
+	}
 
-		default:
-			if !silent {
-				log.Printf("WARNING: Context sequences did not match reference:\n%s+%s\n%s+%s\n", stringBefore, stringAfter, m.SeqBefore, m.SeqAfter)
-				log.Println(m.Name, m.Chr, m.Pos)
-			}
+	if *maxOpenFiles < reservedFiles+2 {
+		log.Fatalf("ERROR: -maxOpenFiles must be at least %d", reservedFiles+2)
+	}
+	if *batchSize == 0 && len(gsReportFiles) > *maxOpenFiles-reservedFiles {
+		*batchSize = *maxOpenFiles - reservedFiles
+	}
+	if *mapmode {
+		log.Printf("WARNING: -hash is deprecated and equivalent to -join %s, not -join %s. Using -join %s.", joinLockstep, joinHash, joinLockstep)
+		*join = joinLockstep
+	}
+	convert := joinConverter(*join)
+	if *batchSize > 0 && len(gsReportFiles) > *batchSize && pal.mode == palAf {
+		log.Fatal("ERROR: -palindromic af uses cohort allele frequencies and cannot be used when converting in batches")
+	}
+	cp := checkpointOptions{every: *checkpoint, resume: *resume}
+	if *output == "stdout" {
+		if cp.resume {
+			log.Fatal("ERROR: -resume requires an output file (-o)")
 		}
-
-		if altNeedsRevComp {
-			alleleA = revComp(m.AlleleA)
-			alleleB = revComp(m.AlleleB)
+		cp.every = 0
+	}
+	if cp.resume && cp.every == 0 {
+		log.Fatal("ERROR: -resume requires checkpoints (-checkpoint)")
+	}
+	run := func(output string) {
+		if *batchSize > 0 && len(gsReportFiles) > *batchSize {
+			convertBatched(convert, gsReportFiles, samples, meta, *manifestFilename, *fastaFilename, output, pal, sexes, *build, *silent,
+				cp, *join, *batchSize, *maxOpenFiles, *tmpDir)
 		} else {
-			alleleA = m.AlleleA
-			alleleB = m.AlleleB
-		}
-
-		switch curr.Ref {
-		case alleleA:
-			alleleAint = 0
-			alleleBint = 1
-			curr.Alt = []string{alleleB}
-		case alleleB:
-			alleleAint = 1
-			alleleBint = 0
-			curr.Alt = []string{alleleA}
-		default:
-			if alleleA == alleleB {
-				alleleAint = 1
-				alleleBint = 1
-				curr.Alt = []string{alleleA}
-			} else {
-				alleleAint = 1
-				alleleBint = 2
-				curr.Alt = []string{alleleA, alleleB}
-			}
-		}
-
-		curr.Info = fmt.Sprintf("ALLELE_A=%d;ALLELE_B=%d;GC=%.4g", alleleAint, alleleBint, m.GC)
-		curr.Samples = make([]vcf.Sample, len(gsReportChans))
-		sb.Reset()
-		samplesWritten = 0
-		for i := range curr.Samples {
-			for gs.Chrom == "" || gs.Chrom == "0" {
-				gs = <-gsReportChans[i]
-				switch gs.Chrom {
-				case "xy":
-					gs.Chrom = "x"
-				case "XY":
-					gs.Chrom = "X"
-				case "MT":
-					gs.Chrom = "M"
-				}
-			}
-
-			if !matchesManifest(gs, m) {
-				if i != 0 {
-					log.Panicf("something went horibly wrong with sample %s\n%v", gsReportFiles[i], gs)
-				}
-				if !silent {
-					log.Printf("WARNING: Manifest mismatch. See report and manifest data below\n%v\n%v\n", gs, m)
-					log.Printf("waiting for %v", gs)
-					log.Println("moving to next manifest record")
-				}
-				break
-			}
-			samplesWritten++
-			gsAllele1 = gs.Allele1
-			gsAllele2 = gs.Allele2
-			if (gs.ReportedAsFwd && m.TopStrand != m.SrcTopStrand) || (!gs.ReportedAsFwd && !m.TopStrand) {
-				gsAllele1 = revComp(gsAllele1)
-				gsAllele2 = revComp(gsAllele2)
-			}
-
-			curr.Samples[i].FormatData = []string{"", fmt.Sprintf("%.4g", gs.BAlleleFreq), fmt.Sprintf("%.4g", gs.LogRRatio)}
-			switch gsAllele1 {
-			case m.AlleleA:
-				curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleAint)
-			case m.AlleleB:
-				curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleBint)
-			}
-			switch gsAllele2 {
-			case m.AlleleA:
-				curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleAint)
-			case m.AlleleB:
-				curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleBint)
-			}
-			curr.Samples[i].Phase = make([]bool, len(curr.Samples[i].Alleles)) // leave as false for unphased
-			gs.Chrom = ""
+			convert(gsReportFiles, samples, meta, *manifestFilename, *fastaFilename, output, pal, sexes, *build, *silent, cp)
 		}
-		if samplesWritten > 0 && curr.Chr != "chrM" { // exclude chrM
-			vcf.WriteVcf(out, curr)
+	}
+	if *cohort != "" {
+		appendTo(*cohort, run, gsReportFiles, samples, *output, *maxOpenFiles, tmpPrefix(*tmpDir, *output, cp))
+	} else {
+		run(*output)
+		if cp.every > 0 {
+			removeCheckpoint(*output)
 		}
 	}
-
-	err = out.Close()
-	exception.PanicOnErr(err)
-	err = ref.Close()
-	exception.PanicOnErr(err)
+	log.Println(pal.summary())
 }
 
-func illuminaToVcfMap(gsReportFiles []string, manifestFile, fastaFile, output string, silent bool) {
-	out := fileio.EasyCreate(output)
-	ref := fasta.NewSeeker(fastaFile, fastaFile+".fai")
+// makeHeader returns the VCF header with the ##SAMPLE lines in meta and the sample names.
+func makeHeader(samples, meta []string) vcf.Header {
 	var header vcf.Header
 	header.Text = strings.Split(headerInfo, "\n")
+	last := header.Text[len(header.Text)-1] + "\t" + strings.Join(samples, "\t")
+	header.Text = append(append(header.Text[:len(header.Text)-1], meta...), last)
+	return header
+}
 
+// sampleNames names samples by the base name of their report file without a .gz extension.
+func sampleNames(gsReportFiles []string) []string {
 	trimSamples := slices.Clone(gsReportFiles)
 	for i := range trimSamples {
-		trimSamples[i] = strings.TrimRight(path.Base(trimSamples[i]), ".gz")
+		trimSamples[i] = strings.TrimSuffix(path.Base(trimSamples[i]), ".gz")
 	}
-	header.Text[len(header.Text)-1] += "\t" + strings.Join(trimSamples, "\t")
-	vcf.NewWriteHeader(out, header)
+	return trimSamples
+}
 
-	gsReportChans := make([]<-chan illumina.GsReport, len(gsReportFiles))
-	for i := range gsReportFiles {
-		gsReportChans[i] = illumina.GoReadGsReportToChan(gsReportFiles[i])
+// sheetReports returns the report file and ID of each sample in a sample sheet.
+func sheetReports(sheet samplesheet.Sheet, sheetFile string) (gsReportFiles, samples []string) {
+	if !sheet.Has(samplesheet.File) {
+		log.Fatalf("ERROR: sample sheet %s does not have a '%s' column", sheetFile, samplesheet.File)
 	}
-	mm := makeManifestMap(manifestFile)
-
+	if len(sheet.Samples) == 0 {
+		log.Fatalf("ERROR: sample sheet %s has no samples", sheetFile)
+	}
+	samples = sheet.Samples
+	gsReportFiles = sheet.Column(samples, samplesheet.File)
 	var err error
-	var curr vcf.Vcf
-	var gs illumina.GsReport
-	curr.Filter = "."
-	curr.Format = []string{"GT", "BAF", "LRR"}
-	var alleleAint, alleleBint int16
-	var alleleA, alleleB, gsAllele1, gsAllele2 string
-	var seqBefore, seqAfter []dna.Base
-	var stringBefore, stringAfter string
-	var refBase []dna.Base
-	var altNeedsRevComp, found bool
-	var samplesWritten int
-	var m illumina.Manifest
-
-	for gs = range gsReportChans[0] {
-		if debug > 0 {
-			fmt.Println("debug: started -", gs, gsReportFiles[0])
-		}
-		for gs.Chrom == "" || gs.Chrom == "0" {
-			if debug > 0 {
-				fmt.Println("debug: no chrom for -", gs, gsReportFiles[0])
-			}
-			for i := 1; i < len(gsReportChans); i++ {
-				if debug > 0 {
-					fmt.Println("debug: burning -", <-gsReportChans[i], gsReportFiles[i])
-				} else {
-					<-gsReportChans[i] // burn
-				}
-			}
-			gs = <-gsReportChans[0]
-			if gs.Chrom == "" {
-				err = out.Close()
-				exception.PanicOnErr(err)
-				err = ref.Close()
-				exception.PanicOnErr(err)
-				return
-			}
-		}
-		switch gs.Chrom {
-		case "xy":
-			gs.Chrom = "x"
-		case "XY":
-			gs.Chrom = "X"
-		case "MT":
-			gs.Chrom = "M"
+	for i := range gsReportFiles {
+		if gsReportFiles[i] == "" {
+			log.Fatalf("ERROR: no report file for sample %s in %s", samples[i], sheetFile)
 		}
-
-		samplesWritten = 0
-		m, found = mm[strings.ToLower(gs.Marker)]
-		if !found {
-			m.Chr = "NOT_FOUND"
-			for i := 1; i < len(gsReportChans); i++ {
-				<-gsReportChans[i] // burn
-			}
+		if path.IsAbs(gsReportFiles[i]) {
 			continue
 		}
-		if m.Chr == "XY" || m.Chr == "chrXY" { // SERIOUSLY ILLUMINA... SERIOUSLY
-			m.Chr = "X"
-		}
-		curr.Chr = "chr" + strings.TrimLeft(m.Chr, "chr")
-		curr.Pos = m.Pos
-		curr.Id = m.Name
-		refBase, err = fasta.SeekByName(ref, "chr"+strings.TrimLeft(m.Chr, "chr"), m.Pos-1, m.Pos)
-		exception.PanicOnErr(err)
-		curr.Ref = strings.ToUpper(dna.BaseToString(refBase[0]))
-
-		seqBefore, err = fasta.SeekByName(ref, "chr"+strings.TrimLeft(m.Chr, "chr"), (m.Pos-1)-len(m.SeqBefore), m.Pos-1)
-		exception.PanicOnErr(err)
-		stringBefore = strings.ToUpper(dna.BasesToString(seqBefore))
-		seqAfter, err = fasta.SeekByName(ref, "chr"+strings.TrimLeft(m.Chr, "chr"), m.Pos, m.Pos+len(m.SeqAfter))
-		if err != nil && !silent {
-			fmt.Println("WARNING", err)
-		}
-		stringAfter = strings.ToUpper(dna.BasesToString(seqAfter))
-
-		// check one of the alleles matches ref
-		altNeedsRevComp = false
-		switch {
-		case levenshtein(stringBefore, m.SeqBefore) <= 5 ||
-			levenshtein(stringAfter, m.SeqAfter) <= 5: // this is a really weak match, but you would not believe the things I have seen...
-			if !m.TopStrand {
-				altNeedsRevComp = true
-			}
-
-			// only do partial check on rev comps since if snp is not directly in middle of probe then before/after lengths differ
-		case levenshtein(revComp(stringBefore)[:5], m.SeqAfter[:5]) <= 1 ||
-			levenshtein(revComp(stringAfter)[len(stringAfter)-5:], m.SeqBefore[len(m.SeqBefore)-5:]) <= 1:
-			if m.TopStrand {
-				altNeedsRevComp = true
-			}
-
-		default:
-			log.Printf("WARNING: Context sequences did not match reference:\n%s+%s\n%s+%s\n", stringBefore, stringAfter, m.SeqBefore, m.SeqAfter)
-			log.Println(m.Name, m.Chr, m.Pos)
-		}
-
-		if altNeedsRevComp {
-			alleleA = revComp(m.AlleleA)
-			alleleB = revComp(m.AlleleB)
-		} else {
-			alleleA = m.AlleleA
-			alleleB = m.AlleleB
-		}
-
-		switch curr.Ref {
-		case alleleA:
-			alleleAint = 0
-			alleleBint = 1
-			curr.Alt = []string{alleleB}
-		case alleleB:
-			alleleAint = 1
-			alleleBint = 0
-			curr.Alt = []string{alleleA}
-		default:
-			if alleleA == alleleB {
-				alleleAint = 1
-				alleleBint = 1
-				curr.Alt = []string{alleleA}
-			} else {
-				alleleAint = 1
-				alleleBint = 2
-				curr.Alt = []string{alleleA, alleleB}
-			}
-		}
-
-		curr.Info = fmt.Sprintf("ALLELE_A=%d;ALLELE_B=%d;GC=%.4g", alleleAint, alleleBint, m.GC)
-		curr.Samples = make([]vcf.Sample, len(gsReportChans))
-
-		for i := 0; i < len(curr.Samples); i++ {
-			if i > 0 {
-				gs = <-gsReportChans[i]
-				for gs.Chrom == "" || gs.Chrom == "0" {
-					gs = <-gsReportChans[0]
-					log.Println("skipped", gs)
-				}
-				switch gs.Chrom {
-				case "xy":
-					gs.Chrom = "x"
-				case "XY":
-					gs.Chrom = "X"
-				case "MT":
-					gs.Chrom = "M"
-				}
-			}
-			if m.Chr == "NOT_FOUND" {
-				continue
-			}
-			if strings.ToLower(m.Name) != strings.ToLower(gs.Marker) {
-				log.Print(m)
-				log.Print(gsReportFiles[i], gs)
-				log.Panic("PANIC!!! DATA OUT OF ORDER")
-			}
-
-			if !matchesManifest(gs, m) && !silent {
-				log.Printf("WARNING: Manifest mismatch. See report and manifest data below\n%v\n%v\n", gs, m)
-			}
-			samplesWritten++
-			gsAllele1 = gs.Allele1
-			gsAllele2 = gs.Allele2
-			if (gs.ReportedAsFwd && m.TopStrand != m.SrcTopStrand) || (!gs.ReportedAsFwd && !m.TopStrand) {
-				gsAllele1 = revComp(gsAllele1)
-				gsAllele2 = revComp(gsAllele2)
-			}
-
-			curr.Samples[i].FormatData = []string{"", fmt.Sprintf("%.4g", gs.BAlleleFreq), fmt.Sprintf("%.4g", gs.LogRRatio)}
-			switch gsAllele1 {
-			case m.AlleleA:
-				curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleAint)
-			case m.AlleleB:
-				curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleBint)
-			}
-			switch gsAllele2 {
-			case m.AlleleA:
-				curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleAint)
-			case m.AlleleB:
-				curr.Samples[i].Alleles = append(curr.Samples[i].Alleles, alleleBint)
-			}
-			curr.Samples[i].Phase = make([]bool, len(curr.Samples[i].Alleles)) // leave as false for unphased
-			gs.Chrom = ""
-		}
-		if samplesWritten > 0 && curr.Chr != "chrM" { // exclude chrM
-			vcf.WriteVcf(out, curr)
+		if _, err = os.Stat(gsReportFiles[i]); err != nil {
+			gsReportFiles[i] = path.Join(path.Dir(sheetFile), gsReportFiles[i])
 		}
 	}
-
-	err = out.Close()
-	exception.PanicOnErr(err)
-	err = ref.Close()
-	exception.PanicOnErr(err)
+	return gsReportFiles, samples
 }
 
-func makeManifestMap(manifest string) map[string]illumina.Manifest {
-	var found bool
-	m := make(map[string]illumina.Manifest)
-	c := illumina.GoReadManifestToChan(manifest)
-	for v := range c {
-		if _, found = m[strings.ToLower(v.Name)]; !found {
-			m[strings.ToLower(v.Name)] = v
+// sheetSexes returns the sex of each sample with a value in the sex column of a sample sheet, or nil if
+// there is no sex column.
+func sheetSexes(sheet samplesheet.Sheet) map[string]sexchrom.Sex {
+	if !sheet.Has(samplesheet.Sex) {
+		return nil
+	}
+	ans := make(map[string]sexchrom.Sex)
+	var value string
+	for _, sample := range sheet.Samples {
+		if value, _ = sheet.Get(sample, samplesheet.Sex); value != "" {
+			ans[sample] = sexchrom.Parse(value)
 		}
 	}
-	return m
+	return ans
 }
 
 func matchesManifest(gs illumina.GsReport, m illumina.Manifest) bool {
@@ -460,28 +238,6 @@ func matchesManifest(gs illumina.GsReport, m illumina.Manifest) bool {
 	return true
 }
 
-func revComp(base string) string {
-	ans := make([]byte, len(base))
-	var j int
-	for i := len(base) - 1; i >= 0; i-- {
-		switch base[i] {
-		case 'A', 'a':
-			ans[j] = 'T'
-		case 'C', 'c':
-			ans[j] = 'G'
-		case 'G', 'g':
-			ans[j] = 'C'
-		case 'T', 't':
-			ans[j] = 'A'
-		default:
-			//log.Panicf("ERROR: unrecognized base '%s'", base) // they throw Y's and shit in there
-			ans[j] = base[i]
-		}
-		j++
-	}
-	return string(ans)
-}
-
 func levenshtein(s1, s2 string) int {
 	if s1 == "" || s2 == "" {
 		return numbers.Max(len(s1), len(s2))
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/illumina"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// strategies for joining the records of the reports to the manifest
+const (
+	joinManifest   string = "manifest"   // rows in manifest order, each report streamed in manifest order
+	joinLockstep   string = "lockstep"   // rows in the order of the first report, reports read together
+	joinHash       string = "hash"       // rows in manifest order, reports loaded and looked up by marker name
+	joinCoordinate string = "coordinate" // rows in coordinate order by a k-way merge of coordinate sorted reports
+)
+
+// row is one marker of the output: its manifest record and the record of each sample, with has false for
+// samples without the marker.
+type row struct {
+	m   illumina.Manifest
+	gs  []illumina.GsReport
+	has []bool
+}
+
+// joiner produces the rows of a conversion.
+type joiner interface {
+	// next fills r with the next row and returns false when there are no more rows.
+	next(r *row) bool
+	// positions returns the position after the last record of each report used for the rows so far.
+	positions() []illumina.ResumePoint
+	// stats returns the counts of markers missing from each sample.
+	stats() *joinStats
+}
+
+// joinStats counts the markers missing from each sample and the report records that could not be used.
+type joinStats struct {
+	missing []int // rows without the sample
+	dropped []int // report records skipped as out of order or not in the other reports
+	empty   int   // rows without any sample, which are not written
+	files   []string
+	silent  bool
+}
+
+func newJoinStats(files []string, silent bool) joinStats {
+	return joinStats{missing: make([]int, len(files)), dropped: make([]int, len(files)), files: files, silent: silent}
+}
+
+// drop counts a record of report i that is not used and logs why unless silent.
+func (s *joinStats) drop(i int, gs illumina.GsReport, why string) {
+	s.dropped[i]++
+	if !s.silent {
+		log.Printf("WARNING: skipped record of %s at %s:%d in %s: %s", gs.Marker, gs.Chrom, gs.Pos, s.files[i], why)
+	}
+}
+
+// dropMismatch drops a record with the name of manifest record m at another position.
+func (s *joinStats) dropMismatch(i int, gs illumina.GsReport, m illumina.Manifest) {
+	s.drop(i, gs, fmt.Sprintf("manifest mismatch, the manifest has %s at %s:%d", m.Name, m.Chr, m.Pos))
+}
+
+func (s *joinStats) stats() *joinStats {
+	return s
+}
+
+// report logs a warning for each sample with missing markers or unused records.
+func (s *joinStats) report(samples []string, join string) {
+	for i := range samples {
+		if s.missing[i] == 0 && s.dropped[i] == 0 {
+			continue
+		}
+		log.Printf("WARNING: sample %s is missing %d markers and %d of its report records were skipped "+
+			"(-join %s). Missing markers are written as missing values.", samples[i], s.missing[i], s.dropped[i], join)
+	}
+	if s.empty > 0 {
+		log.Printf("%d markers were not found in any report", s.empty)
+	}
+}
+
+// newJoiner returns the joiner of a strategy for the reports. done is the number of rows converted before
+// resuming, which were counted from the same manifest. Unused report records are logged unless silent.
+func newJoiner(join string, records []<-chan illumina.GsReport, gsReportFiles []string, manifestFile string, done int, silent bool) joiner {
+	s := newJoinStats(gsReportFiles, silent)
+	switch join {
+	case joinManifest:
+		return newManifestJoiner(s, records, manifestFile, done)
+	case joinLockstep:
+		return newLockstepJoiner(s, records, readManifestIndex(manifestFile))
+	case joinHash:
+		return newHashJoiner(s, records, readManifestIndex(manifestFile), done)
+	case joinCoordinate:
+		return newCoordinateJoiner(s, records, readManifestIndex(manifestFile))
+	default:
+		log.Fatalf("ERROR: unrecognized join '%s'. Options: %s, %s, %s, %s", join, joinManifest, joinLockstep, joinHash, joinCoordinate)
+	}
+	return nil
+}
+
+// placed returns false for report records without a chromosome, which are not written.
+func placed(gs illumina.GsReport) bool {
+	return gs.Chrom != "" && gs.Chrom != "0"
+}
+
+// normalizeChrom names chromosomes as in the manifest.
+func normalizeChrom(gs *illumina.GsReport) {
+	switch gs.Chrom {
+	case "xy":
+		gs.Chrom = "x"
+	case "XY":
+		gs.Chrom = "X"
+	case "MT":
+		gs.Chrom = "M"
+	}
+}
+
+// reportedAs returns the manifest record with the chromosome used in reports.
+func reportedAs(m illumina.Manifest) illumina.Manifest {
+	if m.Chr == "XY" || m.Chr == "chrXY" {
+		m.Chr = "X"
+	}
+	return m
+}
+
+// cursor reads the placed records of a report that pass keep, with lookahead.
+type cursor struct {
+	records <-chan illumina.GsReport
+	keep    func(illumina.GsReport) bool
+	buf     []illumina.GsReport // records read and not yet used, including skipped records
+	valid   int                 // records in buf that are placed and kept
+	pos     illumina.ResumePoint
+}
+
+func newCursor(records <-chan illumina.GsReport, keep func(illumina.GsReport) bool) *cursor {
+	return &cursor{records: records, keep: keep}
+}
+
+func (c *cursor) usable(gs illumina.GsReport) bool {
+	return placed(gs) && c.keep(gs)
+}
+
+// peek returns the k-th unused record (from 0), or false if the report has fewer.
+func (c *cursor) peek(k int) (illumina.GsReport, bool) {
+	var gs illumina.GsReport
+	var ok bool
+	for c.valid <= k {
+		if gs, ok = <-c.records; !ok {
+			return gs, false
+		}
+		normalizeChrom(&gs)
+		c.buf = append(c.buf, gs)
+		if c.usable(gs) {
+			c.valid++
+		}
+	}
+	var n int
+	for _, gs = range c.buf {
+		if !c.usable(gs) {
+			continue
+		}
+		if n == k {
+			break
+		}
+		n++
+	}
+	return gs, true
+}
+
+// next uses the next record, which must have been peeked, along with the skipped records before it.
+func (c *cursor) next() illumina.GsReport {
+	var gs illumina.GsReport
+	for {
+		gs = c.buf[0]
+		c.buf = c.buf[1:]
+		c.pos = gs.ResumePoint()
+		if c.usable(gs) {
+			c.valid--
+			return gs
+		}
+	}
+}
+
+func cursorPositions(cursors []*cursor, pos []illumina.ResumePoint) []illumina.ResumePoint {
+	for i := range cursors {
+		pos[i] = cursors[i].pos
+	}
+	return pos
+}
+
+// manifestJoiner makes a row of each manifest record. Each report must list its markers in manifest order.
+// Markers absent from a report are missing for that sample, and records of markers the manifest lists
+// earlier or not at all are skipped.
+type manifestJoiner struct {
+	joinStats
+	manifest <-chan illumina.Manifest
+	last     map[string]int // last manifest index of each marker name
+	k        int            // manifest index of the next row
+	cursors  []*cursor
+	pos      []illumina.ResumePoint
+}
+
+func newManifestJoiner(s joinStats, records []<-chan illumina.GsReport, manifestFile string, done int) *manifestJoiner {
+	j := &manifestJoiner{joinStats: s, last: make(map[string]int), pos: make([]illumina.ResumePoint, len(records))}
+	var i int
+	for m := range illumina.GoReadManifestToChan(manifestFile) {
+		j.last[strings.ToLower(m.Name)] = i
+		i++
+	}
+	keep := func(gs illumina.GsReport) bool {
+		_, found := j.last[strings.ToLower(gs.Marker)]
+		return found
+	}
+	j.cursors = make([]*cursor, len(records))
+	for i = range records {
+		j.cursors[i] = newCursor(records[i], keep)
+	}
+	j.manifest = illumina.GoReadManifestToChan(manifestFile)
+	for ; j.k < done; j.k++ { // converted before resuming
+		<-j.manifest
+	}
+	return j
+}
+
+func (j *manifestJoiner) next(r *row) bool {
+	var ok bool
+	if r.m, ok = <-j.manifest; !ok {
+		return false
+	}
+	reported := reportedAs(r.m)
+	var gs illumina.GsReport
+	for i, c := range j.cursors {
+		r.has[i] = false
+		for {
+			if gs, ok = c.peek(0); !ok {
+				break
+			}
+			if matchesManifest(gs, reported) {
+				r.gs[i], r.has[i] = c.next(), true
+				break
+			}
+			if j.last[strings.ToLower(gs.Marker)] > j.k {
+				break // the report lacks this marker
+			}
+			if sameName(gs, r.m) {
+				j.dropMismatch(i, c.next(), reported)
+			} else {
+				j.drop(i, c.next(), "out of manifest order")
+			}
+		}
+		if !r.has[i] {
+			j.missing[i]++
+		}
+	}
+	j.k++
+	return true
+}
+
+func (j *manifestJoiner) positions() []illumina.ResumePoint {
+	return cursorPositions(j.cursors, j.pos)
+}
+
+// manifestIndex is the manifest in memory, indexed by marker name.
+type manifestIndex struct {
+	records []illumina.Manifest
+	byName  map[string][]int
+}
+
+func readManifestIndex(manifestFile string) manifestIndex {
+	idx := manifestIndex{byName: make(map[string][]int)}
+	var name string
+	for m := range illumina.GoReadManifestToChan(manifestFile) {
+		name = strings.ToLower(m.Name)
+		idx.byName[name] = append(idx.byName[name], len(idx.records))
+		idx.records = append(idx.records, m)
+	}
+	return idx
+}
+
+// lookup returns the index of the manifest record of a report record. Of records with the same name, the
+// one at the reported position is preferred, else the first.
+func (idx manifestIndex) lookup(gs illumina.GsReport) (int, bool) {
+	found := idx.byName[strings.ToLower(gs.Marker)]
+	if len(found) == 0 {
+		return 0, false
+	}
+	for _, k := range found {
+		if matchesManifest(gs, reportedAs(idx.records[k])) {
+			return k, true
+		}
+	}
+	return found[0], true
+}
+
+func (idx manifestIndex) has(gs illumina.GsReport) bool {
+	_, found := idx.byName[strings.ToLower(gs.Marker)]
+	return found
+}
+
+func sameMarker(a, b illumina.GsReport) bool {
+	return strings.EqualFold(a.Marker, b.Marker)
+}
+
+func sameName(gs illumina.GsReport, m illumina.Manifest) bool {
+	return strings.EqualFold(gs.Marker, m.Name)
+}
+
+// lockstepJoiner makes a row of each record of the first report. The other reports must list the same
+// markers in the same order. A marker absent from a report is missing for that sample, and a record
+// absent from the first report is skipped when the record after it continues in step.
+type lockstepJoiner struct {
+	joinStats
+	idx     manifestIndex
+	cursors []*cursor
+	pos     []illumina.ResumePoint
+}
+
+func newLockstepJoiner(s joinStats, records []<-chan illumina.GsReport, idx manifestIndex) *lockstepJoiner {
+	j := &lockstepJoiner{joinStats: s, idx: idx, pos: make([]illumina.ResumePoint, len(records))}
+	j.cursors = make([]*cursor, len(records))
+	for i := range records {
+		j.cursors[i] = newCursor(records[i], idx.has)
+	}
+	return j
+}
+
+func (j *lockstepJoiner) next(r *row) bool {
+	lead, ok := j.cursors[0].peek(0)
+	if !ok {
+		for i := 1; i < len(j.cursors); i++ {
+			for _, ok = j.cursors[i].peek(0); ok; _, ok = j.cursors[i].peek(0) {
+				j.drop(i, j.cursors[i].next(), "after the last record of the first report")
+			}
+		}
+		return false
+	}
+	k, _ := j.idx.lookup(lead)
+	r.m = j.idx.records[k]
+	r.gs[0], r.has[0] = j.cursors[0].next(), true
+	var gs illumina.GsReport
+	for i := 1; i < len(j.cursors); i++ {
+		r.has[i] = false
+		if gs, ok = j.cursors[i].peek(0); ok && !sameMarker(gs, lead) {
+			if gs, ok = j.cursors[i].peek(1); ok && sameMarker(gs, lead) {
+				j.drop(i, j.cursors[i].next(), "not in the first report")
+			}
+		}
+		if ok && sameMarker(gs, lead) {
+			r.gs[i], r.has[i] = j.cursors[i].next(), true
+		} else {
+			j.missing[i]++
+		}
+	}
+	return true
+}
+
+func (j *lockstepJoiner) positions() []illumina.ResumePoint {
+	return cursorPositions(j.cursors, j.pos)
+}
+
+// call is a report record stored by the hash join.
+type call struct {
+	baf, lrr         float64
+	allele1, allele2 uint8 // index in hashJoiner.alleles
+	fwd, has         bool
+}
+
+// hashJoiner makes a row of each manifest record from reports read into memory, so reports may list
+// markers in any order. Memory use is about 20 bytes per marker per sample.
+type hashJoiner struct {
+	joinStats
+	idx      manifestIndex
+	calls    [][]call
+	alleles  []string
+	k        int
+	pos      []illumina.ResumePoint
+	reported []illumina.Manifest
+}
+
+func newHashJoiner(s joinStats, records []<-chan illumina.GsReport, idx manifestIndex, done int) *hashJoiner {
+	j := &hashJoiner{joinStats: s, idx: idx, k: done, pos: make([]illumina.ResumePoint, len(records))}
+	j.calls = make([][]call, len(records))
+	codes := make(map[string]uint8)
+	code := func(allele string) uint8 {
+		c, found := codes[allele]
+		if !found {
+			if len(j.alleles) > 255 {
+				log.Fatalf("ERROR: too many distinct alleles in reports, including %s", allele)
+			}
+			c = uint8(len(j.alleles))
+			codes[allele] = c
+			j.alleles = append(j.alleles, allele)
+		}
+		return c
+	}
+	var k int
+	var found bool
+	for i := range records {
+		j.calls[i] = make([]call, len(idx.records))
+		for gs := range records[i] {
+			normalizeChrom(&gs)
+			if !placed(gs) {
+				continue
+			}
+			if k, found = idx.lookup(gs); !found {
+				continue
+			}
+			switch {
+			case !matchesManifest(gs, reportedAs(idx.records[k])):
+				j.dropMismatch(i, gs, reportedAs(idx.records[k]))
+				continue
+			case j.calls[i][k].has:
+				j.drop(i, gs, "duplicate record")
+				continue
+			}
+			j.calls[i][k] = call{baf: gs.BAlleleFreq, lrr: gs.LogRRatio, allele1: code(gs.Allele1),
+				allele2: code(gs.Allele2), fwd: gs.ReportedAsFwd, has: true}
+		}
+	}
+	return j
+}
+
+func (j *hashJoiner) next(r *row) bool {
+	if j.k >= len(j.idx.records) {
+		return false
+	}
+	r.m = j.idx.records[j.k]
+	reported := reportedAs(r.m)
+	var c call
+	for i := range j.calls {
+		c = j.calls[i][j.k]
+		if r.has[i] = c.has; !c.has {
+			j.missing[i]++
+			continue
+		}
+		r.gs[i] = illumina.GsReport{Marker: r.m.Name, Chrom: reported.Chr, Pos: reported.Pos, Allele1: j.alleles[c.allele1],
+			Allele2: j.alleles[c.allele2], BAlleleFreq: c.baf, LogRRatio: c.lrr, ReportedAsFwd: c.fwd}
+	}
+	j.k++
+	return true
+}
+
+// positions returns the start of each report, since reports are read again when resuming.
+func (j *hashJoiner) positions() []illumina.ResumePoint {
+	return j.pos
+}
+
+// chromRank orders chromosomes 1-22, X, Y, XY, M, then others by name.
+func chromRank(chr string) int {
+	chr = strings.TrimPrefix(strings.ToUpper(chr), "CHR")
+	if n, err := strconv.Atoi(chr); err == nil {
+		return n
+	}
+	switch chr {
+	case "X":
+		return 23
+	case "Y":
+		return 24
+	case "XY":
+		return 25
+	case "M", "MT":
+		return 26
+	}
+	return 1000
+}
+
+// coordLess orders report records by chromosome, position, and marker name.
+func coordLess(a, b illumina.GsReport) bool {
+	ra, rb := chromRank(a.Chrom), chromRank(b.Chrom)
+	switch {
+	case ra != rb:
+		return ra < rb
+	case ra == 1000 && !strings.EqualFold(a.Chrom, b.Chrom):
+		return strings.ToUpper(a.Chrom) < strings.ToUpper(b.Chrom)
+	case a.Pos != b.Pos:
+		return a.Pos < b.Pos
+	}
+	return strings.ToLower(a.Marker) < strings.ToLower(b.Marker)
+}
+
+func sameCoord(a, b illumina.GsReport) bool {
+	return !coordLess(a, b) && !coordLess(b, a)
+}
+
+// cursorHeap orders the reports of a coordinate join by their next record.
+type cursorHeap struct {
+	c    []*cursor
+	head []illumina.GsReport
+	i    []int // report index of each cursor
+}
+
+func (h *cursorHeap) Len() int           { return len(h.c) }
+func (h *cursorHeap) Less(a, b int) bool { return coordLess(h.head[a], h.head[b]) }
+func (h *cursorHeap) Swap(a, b int) {
+	h.c[a], h.c[b] = h.c[b], h.c[a]
+	h.head[a], h.head[b] = h.head[b], h.head[a]
+	h.i[a], h.i[b] = h.i[b], h.i[a]
+}
+func (h *cursorHeap) Push(x interface{}) {}
+func (h *cursorHeap) Pop() interface{} {
+	n := len(h.c) - 1
+	h.c, h.head, h.i = h.c[:n], h.head[:n], h.i[:n]
+	return nil
+}
+
+// coordinateJoiner makes a row of each marker of the reports in coordinate order (chromosomes 1-22, X, Y,
+// XY, M, then by position) by a k-way merge. Each report must be sorted by coordinate; records out of order
+// are skipped. Markers absent from a report are missing for that sample.
+type coordinateJoiner struct {
+	joinStats
+	idx     manifestIndex
+	cursors []*cursor
+	h       cursorHeap
+	pos     []illumina.ResumePoint
+}
+
+func newCoordinateJoiner(s joinStats, records []<-chan illumina.GsReport, idx manifestIndex) *coordinateJoiner {
+	j := &coordinateJoiner{joinStats: s, idx: idx, pos: make([]illumina.ResumePoint, len(records))}
+	j.cursors = make([]*cursor, len(records))
+	var gs illumina.GsReport
+	var ok bool
+	for i := range records {
+		j.cursors[i] = newCursor(records[i], idx.has)
+		if gs, ok = j.cursors[i].peek(0); ok {
+			j.h.c = append(j.h.c, j.cursors[i])
+			j.h.head = append(j.h.head, gs)
+			j.h.i = append(j.h.i, i)
+		}
+	}
+	heap.Init(&j.h)
+	return j
+}
+
+func (j *coordinateJoiner) next(r *row) bool {
+	if j.h.Len() == 0 {
+		return false
+	}
+	lead := j.h.head[0]
+	k, _ := j.idx.lookup(lead)
+	r.m = j.idx.records[k]
+	for i := range r.has {
+		r.has[i] = false
+	}
+	var gs illumina.GsReport
+	var ok bool
+	var c *cursor
+	var i int
+	for j.h.Len() > 0 && sameCoord(j.h.head[0], lead) {
+		c, i = j.h.c[0], j.h.i[0]
+		r.gs[i], r.has[i] = c.next(), true
+		for gs, ok = c.peek(0); ok && !coordLess(lead, gs); gs, ok = c.peek(0) {
+			j.drop(i, c.next(), "out of coordinate order") // at or before a marker already written
+		}
+		if ok {
+			j.h.head[0] = gs
+			heap.Fix(&j.h, 0)
+		} else {
+			heap.Pop(&j.h)
+		}
+	}
+	for i = range r.has {
+		if !r.has[i] {
+			j.missing[i]++
+		}
+	}
+	return true
+}
+
+func (j *coordinateJoiner) positions() []illumina.ResumePoint {
+	return cursorPositions(j.cursors, j.pos)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/illumina"
+	"github.com/dasnellings/PGC_mCNV/refpanel"
+	"github.com/vertgenlab/gonomics/dna"
+	"github.com/vertgenlab/gonomics/fasta"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+	"strings"
+)
+
+// policies for handling A/T and C/G SNPs where strand cannot be determined from the alleles
+const (
+	palDrop    string = "drop"    // remove all palindromic markers
+	palFlag    string = "flag"    // keep with the default context-based orientation and tag as unresolved
+	palContext string = "context" // orient by flanking sequence only when the match is strong, else drop
+	palAf      string = "af"      // orient by comparing cohort allele frequency to a reference panel, else drop
+)
+
+// strand resolution values written to INFO/STRAND_RES
+const (
+	resContext    string = "context"
+	resAf         string = "af"
+	resUnresolved string = "unresolved"
+)
+
+const (
+	strongContextDist   int = 2  // max summed edit distance of both flanks for a strong context match
+	minContextMargin    int = 10 // min difference in edit distance between the best and opposite strand
+	minAfResolveAlleles int = 20 // min number of called alleles in cohort to resolve by allele frequency
+)
+
+type palindromicPolicy struct {
+	mode   string
+	panel  map[string]refpanel.Site
+	afKey  string
+	maxMaf float64
+
+	// run summary
+	total      int
+	byContext  int
+	byAf       int
+	unresolved int
+	dropped    int
+}
+
+func newPalindromicPolicy(mode, panelFile, afKey string, maxMaf float64) *palindromicPolicy {
+	p := &palindromicPolicy{mode: mode, afKey: afKey, maxMaf: maxMaf}
+	switch mode {
+	case palDrop, palFlag, palContext:
+	case palAf:
+		if panelFile == "" {
+			log.Fatal("ERROR: -palindromic af requires a reference panel VCF (-panel)")
+		}
+		p.panel = refpanel.Read(panelFile, []string{afKey})
+	default:
+		log.Fatalf("ERROR: unrecognized palindromic policy '%s'. Options: %s, %s, %s, %s", mode, palDrop, palFlag, palContext, palAf)
+	}
+	return p
+}
+
+func (p *palindromicPolicy) summary() string {
+	return fmt.Sprintf("Palindromic (A/T, C/G) markers: %d total, %d resolved by context, %d resolved by allele frequency, "+
+		"%d kept unresolved, %d dropped (policy: %s)", p.total, p.byContext, p.byAf, p.unresolved, p.dropped, p.mode)
+}
+
+// keep tallies a palindromic marker for the run summary and reports whether it should be written.
+func (p *palindromicPolicy) keep(strandRes string) bool {
+	p.total++
+	if p.mode == palDrop || (p.mode != palFlag && strandRes == resUnresolved) {
+		p.dropped++
+		return false
+	}
+	switch strandRes {
+	case resContext:
+		p.byContext++
+	case resAf:
+		p.byAf++
+	default:
+		p.unresolved++
+	}
+	return true
+}
+
+func isPalindromic(alleleA, alleleB string) bool {
+	return alleleA != alleleB && alleleA == illumina.RevComp(alleleB)
+}
+
+// strongContextMatch compares the full manifest flanks to the reference in both orientations.
+// Returns whether the forward orientation matched and whether the match was strong enough to trust.
+func strongContextMatch(ref *fasta.Seeker, chr string, m illumina.Manifest) (forward bool, strong bool) {
+	fwdDist := levenshtein(seekString(ref, chr, (m.Pos-1)-len(m.SeqBefore), m.Pos-1), m.SeqBefore) +
+		levenshtein(seekString(ref, chr, m.Pos, m.Pos+len(m.SeqAfter)), m.SeqAfter)
+	// in reverse orientation the manifest flanks are the rev comp of the opposite reference flanks
+	revDist := levenshtein(illumina.RevComp(seekString(ref, chr, m.Pos, m.Pos+len(m.SeqBefore))), m.SeqBefore) +
+		levenshtein(illumina.RevComp(seekString(ref, chr, (m.Pos-1)-len(m.SeqAfter), m.Pos-1)), m.SeqAfter)
+
+	switch {
+	case fwdDist <= strongContextDist && revDist-fwdDist >= minContextMargin:
+		return true, true
+	case revDist <= strongContextDist && fwdDist-revDist >= minContextMargin:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func seekString(ref *fasta.Seeker, chr string, start, end int) string {
+	if start < 0 {
+		start = 0
+	}
+	seq, _ := fasta.SeekByName(ref, chr, start, end) // truncated sequence at chrom ends is fine for edit distance
+	return strings.ToUpper(dna.BasesToString(seq))
+}
+
+// resolveByAf decides if the B allele should be flipped to the opposite strand by comparing the
+// cohort B allele frequency to the panel frequency of the candidate B allele on each strand.
+func (p *palindromicPolicy) resolveByAf(chr string, pos int, alleleB string, samples []vcf.Sample, alleleAint, alleleBint int16) (flip bool, resolved bool) {
+	site, found := p.panel[refpanel.Key(chr, pos)]
+	if !found {
+		return false, false
+	}
+	keepFreq, keepOk := site.Freq(alleleB, p.afKey)
+	flipFreq, flipOk := site.Freq(illumina.RevComp(alleleB), p.afKey)
+	if !keepOk || !flipOk || math.Min(keepFreq, flipFreq) > p.maxMaf {
+		return false, false
+	}
+
+	var bCount, total int
+	for i := range samples {
+		for _, a := range samples[i].Alleles {
+			switch a {
+			case alleleBint:
+				bCount++
+				total++
+			case alleleAint:
+				total++
+			}
+		}
+	}
+	if total < minAfResolveAlleles {
+		return false, false
+	}
+	cohortFreq := float64(bCount) / float64(total)
+	return math.Abs(cohortFreq-flipFreq) < math.Abs(cohortFreq-keepFreq), true
+}
+
+// assignAlleles determines the REF/ALT encoding of the A and B alleles given the reference base.
+func assignAlleles(refBase, alleleA, alleleB string) (alleleAint, alleleBint int16, alt []string) {
+	switch refBase {
+	case alleleA:
+		return 0, 1, []string{alleleB}
+	case alleleB:
+		return 1, 0, []string{alleleA}
+	default:
+		if alleleA == alleleB {
+			return 1, 1, []string{alleleA}
+		}
+		return 1, 2, []string{alleleA, alleleB}
+	}
+}
+
+// flipStrand re-encodes a record after moving the A and B alleles to the opposite strand.
+func flipStrand(curr *vcf.Vcf, alleleA, alleleB string, oldAint, oldBint int16) (alleleAint, alleleBint int16) {
+	alleleAint, alleleBint, curr.Alt = assignAlleles(curr.Ref, illumina.RevComp(alleleA), illumina.RevComp(alleleB))
+	for i := range curr.Samples {
+		for j := range curr.Samples[i].Alleles {
+			switch curr.Samples[i].Alleles[j] {
+			case oldAint:
+				curr.Samples[i].Alleles[j] = alleleAint
+			case oldBint:
+				curr.Samples[i].Alleles[j] = alleleBint
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"github.com/dasnellings/PGC_mCNV/illumina"
+	"github.com/dasnellings/PGC_mCNV/sexchrom"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"strings"
+)
+
+// ploidyModel assigns haploid or absent genotypes on the sex chromosomes based on sample sex
+type ploidyModel struct {
+	build      sexchrom.Build
+	buildKnown bool
+	buildSet   bool
+	sexes      []sexchrom.Sex
+	silent     bool
+}
+
+func newPloidyModel(buildName string, sexes map[string]sexchrom.Sex, samples []string, silent bool) *ploidyModel {
+	p := &ploidyModel{sexes: make([]sexchrom.Sex, len(samples)), silent: silent}
+	if buildName != "" {
+		p.build, p.buildKnown = sexchrom.GetBuild(buildName)
+		if !p.buildKnown {
+			log.Fatalf("ERROR: unrecognized genome build '%s'. Options: hg19/GRCh37, hg38/GRCh38", buildName)
+		}
+		p.buildSet = true
+	}
+	var found bool
+	for i := range samples {
+		if sexes == nil {
+			continue
+		}
+		if p.sexes[i], found = sexes[samples[i]]; !found && !silent {
+			log.Printf("WARNING: sample '%s' not found in sex file. Sex chromosome genotypes will be written as diploid.", samples[i])
+		}
+	}
+	return p
+}
+
+// setBuild uses the manifest genome build if one was not given on the command line.
+func (p *ploidyModel) setBuild(manifestBuild string) {
+	if p.buildSet {
+		return
+	}
+	p.buildSet = true
+	p.build, p.buildKnown = sexchrom.GetBuild(manifestBuild)
+	if !p.buildKnown {
+		log.Printf("WARNING: unrecognized manifest genome build '%s'. PAR coordinates are unavailable so XY markers "+
+			"will be placed on X as reported and all sex chromosome genotypes will be written as diploid. Set -build to override.", manifestBuild)
+	}
+}
+
+// placeXY returns the chrX coordinate for a marker reported on Illumina's pseudoautosomal 'XY' chromosome.
+func (p *ploidyModel) placeXY(name string, pos int) int {
+	if !p.buildKnown {
+		return pos
+	}
+	xPos, inPar := p.build.ParToX(pos)
+	if !inPar && !p.silent {
+		log.Printf("WARNING: XY marker %s at %d is outside the %s PARs. Placing on X as reported.", name, pos, p.build.Name)
+	}
+	return xPos
+}
+
+// apply reduces the genotypes in curr to the expected ploidy of each sample. Heterozygous
+// calls at haploid positions are set to missing.
+func (p *ploidyModel) apply(curr *vcf.Vcf) {
+	if !p.buildKnown {
+		return
+	}
+	for i := range curr.Samples {
+		switch sexchrom.Ploidy(p.build, curr.Chr, curr.Pos, p.sexes[i]) {
+		case 0:
+			curr.Samples[i].Alleles = nil
+		case 1:
+			if len(curr.Samples[i].Alleles) == 2 && curr.Samples[i].Alleles[0] == curr.Samples[i].Alleles[1] {
+				curr.Samples[i].Alleles = curr.Samples[i].Alleles[:1]
+			} else {
+				curr.Samples[i].Alleles = nil
+			}
+		}
+		curr.Samples[i].Phase = make([]bool, len(curr.Samples[i].Alleles)) // leave as false for unphased
+	}
+}
+
+// inferSexFromReports reads the sex chromosome markers of each report, one file at a time, and infers sex.
+// Confident calls take precedence over declared sex, which is kept for ambiguous samples.
+func inferSexFromReports(gsReportFiles, samples []string, manifestFile, buildName string, declared map[string]sexchrom.Sex, sexOut string) map[string]sexchrom.Sex {
+	if buildName == "" {
+		buildName = illumina.ManifestGenomeBuild(manifestFile)
+	}
+	build, ok := sexchrom.GetBuild(buildName)
+	if !ok {
+		log.Fatalf("ERROR: unrecognized genome build '%s' for sex inference. Set -build to hg19/GRCh37 or hg38/GRCh38.", buildName)
+	}
+
+	calls := make([]sexchrom.Call, len(samples))
+	ans := make(map[string]sexchrom.Sex, len(samples))
+	var acc *sexchrom.Accumulator
+	for i := range gsReportFiles {
+		acc = sexchrom.NewAccumulator(build)
+		for gs := range illumina.GoReadGsReportToChan(gsReportFiles[i]) {
+			switch gs.Chrom {
+			case "X", "x", "Y", "y":
+				acc.Add(strings.ToUpper(gs.Chrom), gs.Pos, gs.BAlleleFreq, gs.LogRRatio, sexchrom.DefaultThresholds)
+			}
+		}
+		calls[i].Sample = samples[i]
+		calls[i].Summary = acc.Summary()
+		calls[i].Inferred, calls[i].Confidence = sexchrom.Infer(calls[i].Summary, sexchrom.DefaultThresholds)
+		calls[i].Declared = declared[samples[i]]
+
+		switch sexchrom.Compare(calls[i].Inferred, calls[i].Declared) {
+		case "sex_mismatch", "karyotype_mismatch":
+			log.Printf("WARNING: sample %s declared %s but inferred %s. Using inferred sex.", samples[i], calls[i].Declared, calls[i].Inferred)
+		case "ambiguous":
+			log.Printf("WARNING: sex of sample %s is ambiguous. Using declared sex %s.", samples[i], calls[i].Declared)
+		}
+		if calls[i].Inferred != sexchrom.Unknown {
+			ans[samples[i]] = calls[i].Inferred
+		} else {
+			ans[samples[i]] = calls[i].Declared
+		}
+	}
+
+	if sexOut != "" {
+		sexchrom.WriteTable(sexOut, calls)
+	}
+	return ans
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/sexchrom"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+)
+
+func usage() {
+	fmt.Print(
+		"inferSex - Infer sex chromosome karyotype (XX, XY, X0, XXY, XXX) per sample from chrX BAF heterozygosity,\n" +
+			"chrX median LRR, and chrY median LRR. The output table can be given to illuminaToVcf -sex.\n" +
+			"Usage:\n" +
+			"./inferSex [options] -i converted.vcf -build hg19 -o sex.tsv\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy).")
+	output := flag.String("o", "stdout", "Output per-sample sex table (.tsv).")
+	build := flag.String("build", "", "Genome build for PAR and X-transposed region coordinates (hg19/GRCh37 or hg38/GRCh38).")
+	declared := flag.String("declared", "", "Tab separated file of declared sex per sample (sample<TAB>sex). Disagreements are flagged in the output.")
+	t := sexchrom.DefaultThresholds
+	flag.Float64Var(&t.HetRate, "hetRate", t.HetRate, "Minimum chrX BAF heterozygosity rate for two or more X chromosomes.")
+	flag.Float64Var(&t.XLrrOneCopy, "xLrrOneCopy", t.XLrrOneCopy, "chrX median LRR below which a single X chromosome is present.")
+	flag.Float64Var(&t.XLrrThreeCopy, "xLrrThreeCopy", t.XLrrThreeCopy, "chrX median LRR above which three X chromosomes are present.")
+	flag.Float64Var(&t.YLrrPresent, "yLrrPresent", t.YLrrPresent, "chrY median LRR above which a Y chromosome is present.")
+	flag.Float64Var(&t.MinConfidence, "minConfidence", t.MinConfidence, "Calls with confidence below this value are reported as ambiguous.")
+	flag.Parse()
+
+	if *input == "" || *build == "" {
+		usage()
+		log.Fatal("ERROR: input VCF and genome build are required (-i, -build)")
+	}
+	b, ok := sexchrom.GetBuild(*build)
+	if !ok {
+		log.Fatalf("ERROR: unrecognized genome build '%s'. Options: hg19/GRCh37, hg38/GRCh38", *build)
+	}
+
+	var declaredSex map[string]sexchrom.Sex
+	if *declared != "" {
+		declaredSex = sexchrom.ReadSexFile(*declared)
+	}
+	sexchrom.WriteTable(*output, inferSex(*input, b, declaredSex, t))
+}
+
+func inferSex(input string, b sexchrom.Build, declared map[string]sexchrom.Sex, t sexchrom.Thresholds) []sexchrom.Call {
+	data, header := vcf.GoReadToChan(input)
+	samples := vcf.HeaderGetSampleList(header)
+	acc := make([]*sexchrom.Accumulator, len(samples))
+	for i := range acc {
+		acc[i] = sexchrom.NewAccumulator(b)
+	}
+
+	var bafIdx, lrrIdx, i int
+	for v := range data {
+		if v.Chr != "chrX" && v.Chr != "X" && v.Chr != "chrY" && v.Chr != "Y" {
+			continue
+		}
+		bafIdx, lrrIdx = signal.Index(v)
+		for i = range v.Samples {
+			acc[i].Add(v.Chr, v.Pos, signal.Value(v.Samples[i], bafIdx), signal.Value(v.Samples[i], lrrIdx), t)
+		}
+	}
+
+	ans := make([]sexchrom.Call, len(samples))
+	for i = range samples {
+		ans[i].Sample = samples[i]
+		ans[i].Summary = acc[i].Summary()
+		ans[i].Inferred, ans[i].Confidence = sexchrom.Infer(ans[i].Summary, t)
+		ans[i].Declared = declared[samples[i]]
+		if sexchrom.Compare(ans[i].Inferred, ans[i].Declared) == "sex_mismatch" {
+			log.Printf("WARNING: sample %s declared %s but inferred %s", samples[i], ans[i].Declared, ans[i].Inferred)
+		}
+	}
+	return ans
+}
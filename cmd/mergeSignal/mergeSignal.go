@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/phased"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"mergeSignal - Annotate a phased or imputed VCF with FORMAT/BAF and FORMAT/LRR from the original converted VCF.\n" +
+			"Records are matched by chromosome, position, and alleles. BAF is written as the fraction of the phased\n" +
+			"record's ALT allele: array B allele BAF is transformed to 1-BAF where the B allele is REF (INFO/ALLELE_B=0)\n" +
+			"and again where REF and ALT are swapped between the files. Samples are matched by name. Phased records or samples without signal are\n" +
+			"written with missing BAF/LRR. Both VCFs must be sorted with chromosomes in the same order.\n" +
+			"Usage:\n" +
+			"./mergeSignal [options] -i converted.vcf -phased phased.vcf -o phased.signal.vcf\n\n")
+	flag.PrintDefaults()
+}
+
+const (
+	bafHeader string = "##FORMAT=<ID=BAF,Number=1,Type=Float,Description=\"B Allele Frequency of the ALT allele\">"
+	lrrHeader string = "##FORMAT=<ID=LRR,Number=1,Type=Float,Description=\"Log R Ratio\">"
+)
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy).")
+	phasedFile := flag.String("phased", "", "Phased or imputed VCF to annotate.")
+	output := flag.String("o", "stdout", "Output VCF.")
+	unmatched := flag.String("unmatched", "", "Write markers and samples present in only one of the input files to this file (.tsv).")
+	dropUnmatched := flag.Bool("dropUnmatched", false, "Do not write phased records without a matching marker in the converted VCF.")
+	flag.Parse()
+
+	if *input == "" || *phasedFile == "" {
+		usage()
+		log.Fatal("ERROR: input and phased VCFs are required (-i, -phased)")
+	}
+
+	mergeSignal(*input, *phasedFile, *output, *unmatched, *dropUnmatched)
+}
+
+func mergeSignal(input, phasedFile, output, unmatched string, dropUnmatched bool) {
+	signalSamples := signal.SampleNames(input)
+	phasedHeader := readHeader(phasedFile)
+	phasedSamples := vcf.HeaderGetSampleList(phasedHeader)
+	idx, signalOnlySamples, phasedOnlySamples := phased.SampleIndex(signalSamples, phasedSamples)
+	if len(signalOnlySamples) > 0 {
+		log.Printf("WARNING: %d samples only in %s", len(signalOnlySamples), input)
+	}
+	if len(phasedOnlySamples) > 0 {
+		log.Printf("WARNING: %d samples only in %s. BAF/LRR will be missing for these samples.", len(phasedOnlySamples), phasedFile)
+	}
+
+	out := fileio.EasyCreate(output)
+	vcf.NewWriteHeader(out, addFormatHeader(phasedHeader))
+
+	var unmatchedOut *fileio.EasyWriter
+	var err error
+	if unmatched != "" {
+		unmatchedOut = fileio.EasyCreate(unmatched)
+		_, err = fmt.Fprintln(unmatchedOut, "#TYPE\tSOURCE\tCHROM\tPOS\tID\tREF\tALT")
+		exception.PanicOnErr(err)
+		for _, s := range signalOnlySamples {
+			_, err = fmt.Fprintf(unmatchedOut, "sample\t%s\t.\t.\t%s\t.\t.\n", input, s)
+			exception.PanicOnErr(err)
+		}
+		for _, s := range phasedOnlySamples {
+			_, err = fmt.Fprintf(unmatchedOut, "sample\t%s\t.\t.\t%s\t.\t.\n", phasedFile, s)
+			exception.PanicOnErr(err)
+		}
+	}
+	writeUnmatched := func(source string, v vcf.Vcf) {
+		if unmatchedOut == nil {
+			return
+		}
+		_, err = fmt.Fprintf(unmatchedOut, "marker\t%s\t%s\t%d\t%s\t%s\t%s\n", source, v.Chr, v.Pos, v.Id, v.Ref, strings.Join(v.Alt, ","))
+		exception.PanicOnErr(err)
+	}
+
+	var nMatched, nSwapped, nSignalOnly, nPhasedOnly int
+	var bafIdx, lrrIdx int
+	matched := func(sig, ph vcf.Vcf, m phased.Match) {
+		nMatched++
+		if m == phased.Swapped {
+			nSwapped++
+		}
+		bafIdx, lrrIdx = signal.Index(sig)
+		vcf.WriteVcf(out, annotate(ph, sig, idx, bafIdx, lrrIdx, m == phased.Swapped))
+	}
+	signalOnly := func(v vcf.Vcf) {
+		nSignalOnly++
+		writeUnmatched(input, v)
+	}
+	phasedOnly := func(v vcf.Vcf) {
+		nPhasedOnly++
+		writeUnmatched(phasedFile, v)
+		if !dropUnmatched {
+			vcf.WriteVcf(out, annotate(v, vcf.Vcf{}, nil, -1, -1, false))
+		}
+	}
+	phased.Join(input, phasedFile, matched, signalOnly, phasedOnly)
+
+	err = out.Close()
+	exception.PanicOnErr(err)
+	if unmatchedOut != nil {
+		err = unmatchedOut.Close()
+		exception.PanicOnErr(err)
+	}
+	log.Printf("Matched %d markers (%d with REF/ALT swapped). %d markers only in %s. %d markers only in %s.",
+		nMatched, nSwapped, nSignalOnly, input, nPhasedOnly, phasedFile)
+}
+
+func readHeader(filename string) vcf.Header {
+	file := fileio.EasyOpen(filename)
+	header := vcf.ReadHeader(file)
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return header
+}
+
+// addFormatHeader adds BAF and LRR FORMAT lines before #CHROM if not already present.
+func addFormatHeader(header vcf.Header) vcf.Header {
+	var hasBaf, hasLrr bool
+	for _, line := range header.Text {
+		hasBaf = hasBaf || strings.HasPrefix(line, "##FORMAT=<ID=BAF,")
+		hasLrr = hasLrr || strings.HasPrefix(line, "##FORMAT=<ID=LRR,")
+	}
+	last := header.Text[len(header.Text)-1]
+	header.Text = header.Text[:len(header.Text)-1]
+	if !hasBaf {
+		header.Text = append(header.Text, bafHeader)
+	}
+	if !hasLrr {
+		header.Text = append(header.Text, lrrHeader)
+	}
+	header.Text = append(header.Text, last)
+	return header
+}
+
+// annotate sets FORMAT/BAF and FORMAT/LRR of the phased record from the signal record. idx maps
+// phased samples to signal samples (-1 or nil idx for missing values). BAF is converted to the fraction
+// of the phased ALT allele. Existing BAF/LRR fields are replaced.
+func annotate(ph, sig vcf.Vcf, idx []int, bafIdx, lrrIdx int, swapped bool) vcf.Vcf {
+	phBaf, phLrr := -1, -1
+	for i := range ph.Format {
+		switch ph.Format[i] {
+		case "BAF":
+			phBaf = i
+		case "LRR":
+			phLrr = i
+		}
+	}
+	if phBaf == -1 {
+		phBaf = len(ph.Format)
+		ph.Format = append(ph.Format, "BAF")
+	}
+	if phLrr == -1 {
+		phLrr = len(ph.Format)
+		ph.Format = append(ph.Format, "LRR")
+	}
+
+	var baf, lrr float64
+	for i := range ph.Samples {
+		baf, lrr = math.NaN(), math.NaN()
+		if idx != nil && idx[i] != -1 {
+			baf = phased.AltBaf(sig, signal.Value(sig.Samples[idx[i]], bafIdx))
+			lrr = signal.Value(sig.Samples[idx[i]], lrrIdx)
+			if swapped {
+				baf = 1 - baf
+			}
+		}
+		for len(ph.Samples[i].FormatData) < len(ph.Format) {
+			ph.Samples[i].FormatData = append(ph.Samples[i].FormatData, ".")
+		}
+		ph.Samples[i].FormatData[phBaf] = formatValue(baf)
+		ph.Samples[i].FormatData[phLrr] = formatValue(lrr)
+	}
+	return ph
+}
+
+func formatValue(f float64) string {
+	if math.IsNaN(f) {
+		return "."
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
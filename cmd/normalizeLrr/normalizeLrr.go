@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/renorm"
+	"github.com/dasnellings/PGC_mCNV/samplesheet"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"strconv"
+)
+
+func usage() {
+	fmt.Print(
+		"normalizeLrr - Remove per-marker LRR offsets shared by the samples of a batch. For each marker and batch the\n" +
+			"median LRR (and with -scale the MAD) of the batch's reference samples is computed and the median is subtracted\n" +
+			"from the LRR of every sample in the batch. Batches are read from a sample sheet. The offsets are written as a\n" +
+			"table that can be applied to new samples with -applyTable. Only autosomal markers are normalized unless\n" +
+			"-allChrom is set. The input is read twice unless -applyTable is used.\n" +
+			"Usage:\n" +
+			"./normalizeLrr [options] -i converted.vcf -samples sheet.tsv -o normalized.vcf -table offsets.tsv\n" +
+			"./normalizeLrr [options] -i new.vcf -samples sheet.tsv -applyTable offsets.tsv -o normalized.vcf\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields. Must be sorted by position.")
+	sheetFile := flag.String("samples", "", "Tab separated sample sheet with a header line and a batch column.")
+	output := flag.String("o", "stdout", "Output VCF.")
+	tableOut := flag.String("table", "", "Output table of per-marker offsets (and scales) for each batch.")
+	tableIn := flag.String("applyTable", "", "Apply the offsets of a table written by -table instead of computing them.")
+	batchColumn := flag.String("batchColumn", samplesheet.Batch, "Sample sheet column with the batch of each sample.")
+	refColumn := flag.String("referenceColumn", "reference", "Sample sheet column marking reference samples (1/true/yes). "+
+		"All samples are used as reference if the sheet does not have this column.")
+	minRef := flag.Int("minReference", 10, "Minimum number of reference samples with LRR in a batch to normalize a marker.")
+	scale := flag.Bool("scale", false, "Also scale each marker's LRR so its spread in the reference samples matches the median marker of the batch.")
+	maxScale := flag.Float64("maxScale", 2, "Scale factors are limited to [1/maxScale, maxScale].")
+	allChrom := flag.Bool("allChrom", false, "Also normalize non-autosomal markers. Only appropriate if the reference samples of each batch are all one sex.")
+	field := flag.String("field", "LRR_NORM", "FORMAT field for the normalized LRR.")
+	replace := flag.Bool("replace", false, "Replace FORMAT/LRR with the normalized LRR instead of adding -field.")
+	flag.Parse()
+
+	if *input == "" || *sheetFile == "" {
+		usage()
+		log.Fatal("ERROR: input VCF (-i) and sample sheet (-samples) are required")
+	}
+	if *tableIn != "" && *tableOut != "" {
+		log.Fatal("ERROR: -table and -applyTable cannot be used together")
+	}
+	if *maxScale < 1 {
+		log.Fatal("ERROR: -maxScale must be at least 1")
+	}
+	if *replace {
+		*field = "LRR"
+	}
+
+	sheet := samplesheet.Read(*sheetFile)
+	if !sheet.Has(*batchColumn) {
+		log.Fatalf("ERROR: sample sheet %s does not have a '%s' column", *sheetFile, *batchColumn)
+	}
+	samples := signal.SampleNames(*input)
+	batchNames := sheet.Column(samples, *batchColumn)
+
+	var t *renorm.Table
+	var markerIdx []int
+	if *tableIn != "" {
+		t = renorm.Read(*tableIn)
+		markerIdx = matchMarkers(*input, t)
+	} else {
+		t = renorm.NewTable(uniqueBatches(samples, batchNames), *scale)
+	}
+	batch := batchIndex(t, samples, batchNames)
+	if *tableIn == "" {
+		isRef := referenceSamples(sheet, samples, *refColumn)
+		compute(*input, t, batch, isRef, *minRef, *allChrom)
+		t.Normalize(*maxScale)
+		if *tableOut != "" {
+			t.Write(*tableOut)
+		}
+	}
+	write(*input, *output, t, markerIdx, batch, *field)
+}
+
+// uniqueBatches returns the batches of the samples in order of first appearance, skipping samples without one.
+func uniqueBatches(samples, batchNames []string) []string {
+	var ans []string
+	seen := make(map[string]bool)
+	for i := range samples {
+		if batchNames[i] != "" && !seen[batchNames[i]] {
+			seen[batchNames[i]] = true
+			ans = append(ans, batchNames[i])
+		}
+	}
+	return ans
+}
+
+// batchIndex returns the index in t of the batch of each sample, or -1 for samples that are not normalized.
+func batchIndex(t *renorm.Table, samples, batchNames []string) []int {
+	ans := make([]int, len(samples))
+	var nMissing int
+	for i := range samples {
+		ans[i] = -1
+		if batchNames[i] != "" {
+			ans[i] = t.BatchIndex(batchNames[i])
+		}
+		if ans[i] == -1 {
+			nMissing++
+			log.Printf("WARNING: no batch offsets for sample %s (batch '%s'). LRR is not normalized.", samples[i], batchNames[i])
+		}
+	}
+	log.Printf("Normalizing %d of %d samples in %d batches", len(samples)-nMissing, len(samples), len(t.Batches))
+	return ans
+}
+
+// referenceSamples marks the samples flagged in the reference column, or all samples if there is no such column.
+func referenceSamples(sheet samplesheet.Sheet, samples []string, column string) []bool {
+	ans := make([]bool, len(samples))
+	if !sheet.Has(column) {
+		for i := range ans {
+			ans[i] = true
+		}
+		return ans
+	}
+	var value string
+	var n int
+	for i := range samples {
+		value, _ = sheet.Get(samples[i], column)
+		if ans[i] = samplesheet.IsTrue(value); ans[i] {
+			n++
+		}
+	}
+	log.Printf("Using %d of %d samples as reference", n, len(samples))
+	return ans
+}
+
+// compute adds the offsets of each marker to t from the reference samples of each batch.
+func compute(input string, t *renorm.Table, batch []int, isRef []bool, minRef int, allChrom bool) {
+	records, _ := vcf.GoReadToChan(input)
+	lrr := make([][]float64, len(t.Batches))
+	var lrrIdx int
+	for v := range records {
+		for b := range lrr {
+			lrr[b] = lrr[b][:0]
+		}
+		if allChrom || signal.IsAutosome(v.Chr) {
+			_, lrrIdx = signal.Index(v)
+			for s := range v.Samples {
+				if isRef[s] && batch[s] != -1 {
+					lrr[batch[s]] = append(lrr[batch[s]], signal.Value(v.Samples[s], lrrIdx))
+				}
+			}
+		}
+		t.Add(v.Chr, v.Pos, v.Id, lrr, minRef)
+	}
+	log.Printf("Computed offsets for %d markers", len(t.Offset))
+}
+
+// matchMarkers returns the row of t for each marker of the input, or -1 for markers not in the table.
+func matchMarkers(input string, t *renorm.Table) []int {
+	rows := make(map[string]int, len(t.Pos))
+	for m := range t.Pos {
+		rows[markerKey(t.Chr[m], t.Pos[m])] = m
+	}
+	markers := signal.Read(input, nil, []int{}).Markers
+	ans := make([]int, len(markers))
+	var found bool
+	var nMissing int
+	for i := range markers {
+		if ans[i], found = rows[markerKey(markers[i].Chr, markers[i].Pos)]; !found {
+			ans[i] = -1
+			nMissing++
+		}
+	}
+	if nMissing > 0 {
+		log.Printf("WARNING: %d of %d markers are not in the offset table and are not normalized", nMissing, len(markers))
+	}
+	return ans
+}
+
+func markerKey(chr string, pos int) string {
+	return chr + ":" + strconv.Itoa(pos)
+}
+
+// write normalizes the LRR of each sample. markerIdx maps input markers to rows of t, or is nil if the
+// rows of t are the input markers.
+func write(input, output string, t *renorm.Table, markerIdx []int, batch []int, field string) {
+	signal.WriteLrr(input, output, field, "Log R Ratio with per-marker batch offsets removed", func(m, s int, lrr float64) float64 {
+		if markerIdx != nil {
+			m = markerIdx[m]
+		}
+		if m == -1 || batch[s] == -1 {
+			return lrr
+		}
+		return t.Adjust(lrr, m, batch[s])
+	})
+}
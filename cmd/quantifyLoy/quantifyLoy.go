@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/sexchrom"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+	"strings"
+)
+
+const ciZ float64 = 1.96 // 95% confidence intervals
+
+func usage() {
+	fmt.Print(
+		"quantifyLoy - Quantify mosaic loss of chromosome Y (mLOY) in males from the median LRR of the male-specific\n" +
+			"region of Y (excluding PARs and the X-transposed region), normalized to the cohort.\n" +
+			"Usage:\n" +
+			"./quantifyLoy [options] -i converted.vcf -build hg19 -o mloy.tsv\n\n")
+	flag.PrintDefaults()
+}
+
+type loyResult struct {
+	sample   string
+	sex      sexchrom.Sex
+	n        int
+	mLrrY    float64
+	ciLow    float64
+	ciHigh   float64
+	norm     float64
+	frac     float64
+	fracLow  float64
+	fracHigh float64
+	isLoy    bool
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy).")
+	output := flag.String("o", "stdout", "Output per-sample mLOY table (.tsv).")
+	build := flag.String("build", "", "Genome build for PAR and X-transposed region coordinates (hg19/GRCh37 or hg38/GRCh38).")
+	sexFile := flag.String("sex", "", "Tab separated file of sample sex (sample<TAB>sex), e.g. the output of inferSex. "+
+		"XY, XXY, and X0 samples are quantified. If not given, males are samples with a single X by chrX heterozygosity "+
+		"and LRR, without testing for Y so that males with extensive Y loss are kept.")
+	compression := flag.Float64("compression", 0.5, "LRR compression of the array. Observed LRR is assumed to be compression*log2(copy ratio).")
+	minFraction := flag.Float64("minFraction", 0.1, "Minimum estimated fraction of cells with Y loss for a positive mLOY call. "+
+		"Calls also require the confidence interval of the normalized mLRR-Y to exclude 0.")
+	minMarkers := flag.Int("minMarkers", 20, "Minimum number of chrY markers with signal for a sample to be quantified.")
+	flag.Parse()
+
+	if *input == "" || *build == "" {
+		usage()
+		log.Fatal("ERROR: input VCF and genome build are required (-i, -build)")
+	}
+	b, ok := sexchrom.GetBuild(*build)
+	if !ok {
+		log.Fatalf("ERROR: unrecognized genome build '%s'. Options: hg19/GRCh37, hg38/GRCh38", *build)
+	}
+	var sexes map[string]sexchrom.Sex
+	if *sexFile != "" {
+		sexes = sexchrom.ReadSexFile(*sexFile)
+	}
+
+	results := quantifyLoy(*input, b, sexes, *compression, *minFraction, *minMarkers)
+	writeResults(*output, results)
+}
+
+func quantifyLoy(input string, b sexchrom.Build, sexes map[string]sexchrom.Sex, compression, minFraction float64, minMarkers int) []loyResult {
+	data, header := vcf.GoReadToChan(input)
+	samples := vcf.HeaderGetSampleList(header)
+	yLrr := make([][]float64, len(samples))
+	var acc []*sexchrom.Accumulator
+	if sexes == nil {
+		acc = make([]*sexchrom.Accumulator, len(samples))
+		for i := range acc {
+			acc[i] = sexchrom.NewAccumulator(b)
+		}
+	}
+
+	var bafIdx, lrrIdx, i int
+	var chr string
+	for v := range data {
+		chr = strings.TrimPrefix(v.Chr, "chr")
+		if chr != "X" && chr != "Y" {
+			continue
+		}
+		bafIdx, lrrIdx = signal.Index(v)
+		if acc != nil {
+			for i = range v.Samples {
+				acc[i].Add(v.Chr, v.Pos, signal.Value(v.Samples[i], bafIdx), signal.Value(v.Samples[i], lrrIdx), sexchrom.DefaultThresholds)
+			}
+		}
+		if chr != "Y" || b.InPar(v.Chr, v.Pos) || b.InXtr(v.Chr, v.Pos) {
+			continue
+		}
+		for i = range v.Samples {
+			yLrr[i] = append(yLrr[i], signal.Value(v.Samples[i], lrrIdx))
+		}
+	}
+
+	var ans []loyResult
+	var r loyResult
+	var summary sexchrom.Summary
+	var single bool
+	var conf float64
+	for i = range samples {
+		r = loyResult{sample: samples[i]}
+		if acc != nil {
+			summary = acc[i].Summary()
+			if single, conf = sexchrom.SingleX(summary, sexchrom.DefaultThresholds); !single || conf < sexchrom.DefaultThresholds.MinConfidence {
+				continue
+			}
+			r.sex = sexchrom.X0
+			if summary.YMedianLrr > sexchrom.DefaultThresholds.YLrrPresent {
+				r.sex = sexchrom.XY
+			}
+		} else {
+			r.sex = sexes[samples[i]]
+		}
+		switch {
+		case r.sex == sexchrom.X0:
+			log.Printf("WARNING: sample %s has a single X and no detectable Y (X0). Quantifying as a male with possible complete loss of Y.", samples[i])
+		case r.sex.YCopies() < 1:
+			continue
+		}
+		r.mLrrY, r.ciLow, r.ciHigh = signal.MedianCI(yLrr[i], ciZ)
+		for _, l := range yLrr[i] {
+			if !math.IsNaN(l) {
+				r.n++
+			}
+		}
+		if r.n < minMarkers {
+			log.Printf("WARNING: sample %s has %d chrY markers with signal. Skipping.", samples[i], r.n)
+			continue
+		}
+		ans = append(ans, r)
+	}
+	if len(ans) == 0 {
+		log.Fatal("ERROR: no males found to quantify")
+	}
+
+	// most males do not carry mLOY so the cohort median is the expected LRR for an intact Y
+	medians := make([]float64, len(ans))
+	for i = range ans {
+		medians[i] = ans[i].mLrrY
+	}
+	cohortMedian := signal.Median(medians)
+	log.Printf("Cohort median chrY LRR over %d males: %.4f", len(ans), cohortMedian)
+
+	for i = range ans {
+		ans[i].norm = ans[i].mLrrY - cohortMedian
+		ans[i].frac = lossFraction(ans[i].norm, compression)
+		ans[i].fracLow = lossFraction(ans[i].ciHigh-cohortMedian, compression)
+		ans[i].fracHigh = lossFraction(ans[i].ciLow-cohortMedian, compression)
+		ans[i].isLoy = ans[i].frac >= minFraction && ans[i].ciHigh-cohortMedian < 0
+	}
+	return ans
+}
+
+// lossFraction estimates the fraction of cells that lost a single-copy chromosome from its
+// normalized LRR, where LRR = compression * log2(1 - fraction).
+func lossFraction(lrr, compression float64) float64 {
+	f := 1 - math.Pow(2, lrr/compression)
+	return math.Min(math.Max(f, 0), 1)
+}
+
+func writeResults(output string, results []loyResult) {
+	out := fileio.EasyCreate(output)
+	_, err := fmt.Fprintln(out, "#SAMPLE\tSEX\tN_MARKERS\tMLRR_Y\tMLRR_Y_CI_LOW\tMLRR_Y_CI_HIGH\tMLRR_Y_NORM\tLOY_FRACTION\tLOY_FRACTION_CI_LOW\tLOY_FRACTION_CI_HIGH\tMLOY")
+	exception.PanicOnErr(err)
+	var call int
+	for _, r := range results {
+		call = 0
+		if r.isLoy {
+			call = 1
+		}
+		_, err = fmt.Fprintf(out, "%s\t%s\t%d\t%.4f\t%.4f\t%.4f\t%.4f\t%.4f\t%.4f\t%.4f\t%d\n",
+			r.sample, r.sex, r.n, r.mLrrY, r.ciLow, r.ciHigh, r.norm, r.frac, r.fracLow, r.fracHigh, call)
+		exception.PanicOnErr(err)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
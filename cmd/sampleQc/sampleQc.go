@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/qc"
+	"github.com/dasnellings/PGC_mCNV/samplesheet"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"log"
+	"math"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"sampleQc - Compute per-sample signal QC metrics from a converted VCF: LRR SD (overall and the median of per-chromosome\n" +
+			"SDs), BAF drift, heterozygous BAF SD, wave factor and GC wave factor (GC from INFO/GC), call rate, heterozygosity\n" +
+			"rate, and lag 1 LRR autocorrelation. Signal metrics use autosomes only. If any threshold is set, a QC column lists\n" +
+			"the failed metrics or PASS. Commonly used PennCNV thresholds are -maxLrrSd 0.3 -maxBafDrift 0.01 -maxWf 0.05.\n" +
+			"With a sample sheet (-samples), or ##SAMPLE lines in the VCF header written by illuminaToVcf -samples, a batch\n" +
+			"column is added after the sample and per-batch summaries are logged.\n" +
+			"The output can be used as -sampleStats for filterCalls.\n" +
+			"Usage:\n" +
+			"./sampleQc [options] -i converted.vcf -o qc.tsv\n\n")
+	flag.PrintDefaults()
+}
+
+// threshold is a QC limit on one metric. Limits of 0 are not applied.
+type threshold struct {
+	name  string
+	value func(m qc.Metrics) float64
+	limit float64
+	isMax bool
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy). Must be sorted by position.")
+	output := flag.String("o", "stdout", "Output QC table (.tsv).")
+	batchSize := flag.Int("batchSize", 500, "Number of samples loaded into memory at once. The input is read once per batch.")
+	sheetFile := flag.String("samples", "", "Tab separated sample sheet with a header line and a batch column. "+
+		"Defaults to the ##SAMPLE lines of the input header.")
+	batchColumn := flag.String("batchColumn", samplesheet.Batch, "Sample sheet column with the batch of each sample.")
+	thresholds := []threshold{
+		{name: "lrr_sd", value: func(m qc.Metrics) float64 { return m.LrrSd }, isMax: true},
+		{name: "baf_drift", value: func(m qc.Metrics) float64 { return m.BafDrift }, isMax: true},
+		{name: "baf_sd", value: func(m qc.Metrics) float64 { return m.BafSd }, isMax: true},
+		{name: "wf", value: waviness, isMax: true},
+		{name: "lrr_acf", value: func(m qc.Metrics) float64 { return m.LrrAutocorr }, isMax: true},
+		{name: "call_rate", value: func(m qc.Metrics) float64 { return m.CallRate }},
+		{name: "min_het_rate", value: func(m qc.Metrics) float64 { return m.HetRate }},
+		{name: "max_het_rate", value: func(m qc.Metrics) float64 { return m.HetRate }, isMax: true},
+	}
+	flag.Float64Var(&thresholds[0].limit, "maxLrrSd", 0, "Maximum LRR SD.")
+	flag.Float64Var(&thresholds[1].limit, "maxBafDrift", 0, "Maximum BAF drift.")
+	flag.Float64Var(&thresholds[2].limit, "maxBafSd", 0, "Maximum heterozygous BAF SD.")
+	flag.Float64Var(&thresholds[3].limit, "maxWf", 0, "Maximum absolute GC wave factor, or wave factor if markers have no GC annotation.")
+	flag.Float64Var(&thresholds[4].limit, "maxAcf", 0, "Maximum LRR autocorrelation.")
+	flag.Float64Var(&thresholds[5].limit, "minCallRate", 0, "Minimum call rate.")
+	flag.Float64Var(&thresholds[6].limit, "minHetRate", 0, "Minimum heterozygosity rate.")
+	flag.Float64Var(&thresholds[7].limit, "maxHetRate", 0, "Maximum heterozygosity rate.")
+	flag.Parse()
+
+	if *input == "" {
+		usage()
+		log.Fatal("ERROR: input VCF is required (-i)")
+	}
+	if *batchSize < 1 {
+		log.Fatal("ERROR: -batchSize must be at least 1")
+	}
+	var active []threshold
+	for _, t := range thresholds {
+		if t.limit != 0 {
+			active = append(active, t)
+		}
+	}
+
+	batches := sampleBatches(*input, *sheetFile, *batchColumn)
+	out := fileio.EasyCreate(*output)
+	header := "sample\tlrr_sd\tlrr_sd_chrom_median\tbaf_drift\tbaf_sd\twf\tgcwf\tcall_rate\thet_rate\tlrr_acf"
+	if batches != nil {
+		header = strings.Replace(header, "sample\t", "sample\tbatch\t", 1)
+	}
+	if len(active) > 0 {
+		header += "\tqc"
+	}
+	_, err := fmt.Fprintln(out, header)
+	exception.PanicOnErr(err)
+	sampleQc(*input, out, *batchSize, active, batches)
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+// sampleBatches returns the batch of each sample of the input from the sample sheet, or from the ##SAMPLE
+// header lines if there is no sheet. Returns nil if neither has batches.
+func sampleBatches(input, sheetFile, batchColumn string) []string {
+	var sheet samplesheet.Sheet
+	var found bool
+	if sheetFile != "" {
+		sheet = samplesheet.Read(sheetFile)
+		if !sheet.Has(batchColumn) {
+			log.Fatalf("ERROR: sample sheet %s does not have a '%s' column", sheetFile, batchColumn)
+		}
+	} else if sheet, found = samplesheet.ReadVcfHeader(input); !found || !sheet.Has(batchColumn) {
+		return nil
+	}
+	ans := sheet.Column(signal.SampleNames(input), batchColumn)
+	for i := range ans {
+		if ans[i] == "" {
+			ans[i] = "NA"
+		}
+	}
+	return ans
+}
+
+func sampleQc(input string, out io.Writer, batchSize int, active []threshold, batches []string) {
+	samples := signal.SampleNames(input)
+	var batch []int
+	var m qc.Metrics
+	var nFail int
+	var fail, name string
+	batchLrrSd := make(map[string][]float64)
+	batchFail := make(map[string]int)
+	var batchOrder []string
+	for start := 0; start < len(samples); start += batchSize {
+		batch = batch[:0]
+		for i := start; i < start+batchSize && i < len(samples); i++ {
+			batch = append(batch, i)
+		}
+		data := signal.Read(input, nil, batch)
+		for s := range data.Samples {
+			m = qc.Compute(data, s)
+			name = data.Samples[s]
+			if batches != nil {
+				if _, found := batchLrrSd[batches[batch[s]]]; !found {
+					batchOrder = append(batchOrder, batches[batch[s]])
+				}
+				batchLrrSd[batches[batch[s]]] = append(batchLrrSd[batches[batch[s]]], m.LrrSd)
+				name += "\t" + batches[batch[s]]
+			}
+			_, err := fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s", name, format(m.LrrSd), format(m.LrrSdChromMedian),
+				format(m.BafDrift), format(m.BafSd), format(m.WaveFactor), format(m.GcWaveFactor), format(m.CallRate), format(m.HetRate),
+				format(m.LrrAutocorr))
+			exception.PanicOnErr(err)
+			if len(active) > 0 {
+				fail = failed(m, active)
+				if fail != "PASS" {
+					nFail++
+					if batches != nil {
+						batchFail[batches[batch[s]]]++
+					}
+				}
+				_, err = fmt.Fprintf(out, "\t%s", fail)
+				exception.PanicOnErr(err)
+			}
+			_, err = fmt.Fprintln(out)
+			exception.PanicOnErr(err)
+		}
+		log.Printf("Processed %d of %d samples", start+len(batch), len(samples))
+	}
+	for _, b := range batchOrder {
+		log.Printf("Batch %s: %d samples, median LRR SD %s, %d failed QC", b, len(batchLrrSd[b]), format(signal.Median(batchLrrSd[b])), batchFail[b])
+	}
+	if len(active) > 0 {
+		log.Printf("%d of %d samples failed QC", nFail, len(samples))
+	}
+}
+
+// failed returns the names of failed metrics joined by ';', or PASS. Missing values fail.
+func failed(m qc.Metrics, active []threshold) string {
+	var ans []string
+	var x float64
+	for _, t := range active {
+		x = t.value(m)
+		if math.IsNaN(x) || (t.isMax && x > t.limit) || (!t.isMax && x < t.limit) {
+			ans = append(ans, t.name)
+		}
+	}
+	if len(ans) == 0 {
+		return "PASS"
+	}
+	return strings.Join(ans, ";")
+}
+
+// waviness returns the absolute GC wave factor, or the wave factor if there is no GC annotation.
+func waviness(m qc.Metrics) float64 {
+	if math.IsNaN(m.GcWaveFactor) {
+		return m.WaveFactor
+	}
+	return math.Abs(m.GcWaveFactor)
+}
+
+func format(f float64) string {
+	if math.IsNaN(f) {
+		return "NA"
+	}
+	return fmt.Sprintf("%.5g", f)
+}
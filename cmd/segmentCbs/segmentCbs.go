@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/cbs"
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+)
+
+func usage() {
+	fmt.Print(
+		"segmentCbs - Segment per-sample LRR and mirrored BAF along each chromosome with circular binary segmentation.\n" +
+			"LRR is segmented first and each LRR segment is then split by segmenting the mirrored BAF (|BAF-0.5|+0.5) of\n" +
+			"heterozygous markers. Change points are tested by permutation, or with the Siegmund tail approximation for\n" +
+			"segments with many markers. Output is in IGV .seg format.\n" +
+			"Usage:\n" +
+			"./segmentCbs [options] -i converted.vcf -o segments.seg\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	input := flag.String("i", "", "Input VCF with GT/BAF/LRR format fields (output of illuminaToVcf or reformatAffy). Must be sorted by position.")
+	output := flag.String("o", "stdout", "Output segments (.seg).")
+	batchSize := flag.Int("batchSize", 500, "Number of samples loaded into memory at once. The input is read once per batch.")
+	autosomesOnly := flag.Bool("autosomesOnly", false, "Only segment chromosomes 1-22.")
+	seed := flag.Int64("seed", 1, "Seed for permutations.")
+	p := cbs.DefaultParams
+	flag.Float64Var(&p.Alpha, "alpha", p.Alpha, "Significance level for accepting a change point.")
+	flag.IntVar(&p.NPerm, "nPerm", p.NPerm, "Number of permutations for change point p-values.")
+	flag.IntVar(&p.MinWidth, "minWidth", p.MinWidth, "Minimum number of markers in a segment.")
+	flag.IntVar(&p.ApproxMin, "approxMin", p.ApproxMin, "Segments with at least this many markers use the fast tail probability "+
+		"approximation instead of permutations. Set to 0 to always use the approximation.")
+	flag.Parse()
+
+	if *input == "" {
+		usage()
+		log.Fatal("ERROR: input VCF is required (-i)")
+	}
+	if *batchSize < 1 {
+		log.Fatal("ERROR: -batchSize must be at least 1")
+	}
+	if p.MinWidth < 1 {
+		log.Fatal("ERROR: -minWidth must be at least 1")
+	}
+
+	out := fileio.EasyCreate(*output)
+	_, err := fmt.Fprintln(out, cnv.SegHeader)
+	exception.PanicOnErr(err)
+	segmentCbs(*input, out, *batchSize, *autosomesOnly, *seed, p)
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+func segmentCbs(input string, out io.Writer, batchSize int, autosomesOnly bool, seed int64, p cbs.Params) {
+	var keep func(chr string, pos int) bool
+	if autosomesOnly {
+		keep = func(chr string, pos int) bool { return signal.IsAutosome(chr) }
+	}
+	samples := signal.SampleNames(input)
+	var batch []int
+	var nSegs int
+	for start := 0; start < len(samples); start += batchSize {
+		batch = batch[:0]
+		for i := start; i < start+batchSize && i < len(samples); i++ {
+			batch = append(batch, i)
+		}
+		data := signal.Read(input, keep, batch)
+		for s := range data.Samples {
+			// seed by sample so results do not depend on batch size
+			rng := rand.New(rand.NewSource(seed + int64(batch[s])))
+			for _, r := range data.ChromRanges() {
+				for _, seg := range segmentChrom(data, s, r[0], r[1], p, rng) {
+					cnv.WriteSeg(out, seg)
+					nSegs++
+				}
+			}
+		}
+		log.Printf("Processed %d of %d samples", start+len(batch), len(samples))
+	}
+	log.Printf("Wrote %d segments", nSegs)
+}
+
+// segmentChrom segments markers [start, end) of sample s.
+func segmentChrom(d signal.Data, s, start, end int, p cbs.Params, rng *rand.Rand) []cnv.Seg {
+	var idx []int
+	var x []float64
+	for m := start; m < end; m++ {
+		if !math.IsNaN(float64(d.Lrr[s][m])) {
+			idx = append(idx, m)
+			x = append(x, float64(d.Lrr[s][m]))
+		}
+	}
+	if len(x) == 0 {
+		return nil
+	}
+
+	var ans []cnv.Seg
+	lrrSegs := cbs.Run(x, p, rng)
+	var segStart, segEnd int
+	for i := range lrrSegs {
+		segStart, segEnd = start, end
+		if i > 0 {
+			segStart = idx[lrrSegs[i].Start]
+		}
+		if i < len(lrrSegs)-1 {
+			segEnd = idx[lrrSegs[i+1].Start]
+		}
+		ans = append(ans, splitByBaf(d, s, segStart, segEnd, lrrSegs[i].P, p, rng)...)
+	}
+	return ans
+}
+
+// splitByBaf segments the mirrored BAF of heterozygous markers in [start, end).
+func splitByBaf(d signal.Data, s, start, end int, lrrP float64, p cbs.Params, rng *rand.Rand) []cnv.Seg {
+	var idx []int
+	var x []float64
+	for m := start; m < end; m++ {
+		if d.Het(s, m) && !math.IsNaN(float64(d.Baf[s][m])) {
+			idx = append(idx, m)
+			x = append(x, math.Abs(float64(d.Baf[s][m])-0.5)+0.5)
+		}
+	}
+	bafSegs := cbs.Run(x, p, rng)
+	if len(bafSegs) <= 1 {
+		return []cnv.Seg{makeSeg(d, s, start, end, lrrP)}
+	}
+	ans := make([]cnv.Seg, 0, len(bafSegs))
+	var segStart, segEnd int
+	for i := range bafSegs {
+		segStart, segEnd = start, end
+		if i > 0 {
+			segStart = idx[bafSegs[i].Start]
+		}
+		if i < len(bafSegs)-1 {
+			segEnd = idx[bafSegs[i+1].Start]
+		}
+		if i == 0 {
+			ans = append(ans, makeSeg(d, s, segStart, segEnd, lrrP))
+		} else {
+			ans = append(ans, makeSeg(d, s, segStart, segEnd, bafSegs[i].P))
+		}
+	}
+	return ans
+}
+
+func makeSeg(d signal.Data, s, start, end int, p float64) cnv.Seg {
+	seg := cnv.Seg{Sample: d.Samples[s], Chr: d.Markers[start].Chr, Start: d.Markers[start].Pos, End: d.Markers[end-1].Pos,
+		NMarkers: end - start, P: p}
+	var lrr, mBaf []float64
+	for m := start; m < end; m++ {
+		lrr = append(lrr, float64(d.Lrr[s][m]))
+		if d.Het(s, m) && !math.IsNaN(float64(d.Baf[s][m])) {
+			mBaf = append(mBaf, math.Abs(float64(d.Baf[s][m])-0.5)+0.5)
+		}
+	}
+	seg.NHet = len(mBaf)
+	seg.Mean = nanMean(lrr)
+	seg.BafDev = signal.Median(mBaf) - 0.5
+	return seg
+}
+
+func nanMean(x []float64) float64 {
+	var sum float64
+	var n int
+	for i := range x {
+		if !math.IsNaN(x[i]) {
+			sum += x[i]
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	return sum / float64(n)
+}
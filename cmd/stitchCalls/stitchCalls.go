@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"stitchCalls - Merge calls of one event that were fragmented by gaps in marker coverage or noisy regions. Adjacent\n" +
+			"calls of the same type in a sample are merged if the gap between them is small relative to their combined length,\n" +
+			"or, with -vcf, if the LRR and BAF of the markers in the gap support the same event at the cell fraction of the calls.\n" +
+			"Calls can be read as BED (output of callMosaic, callPhasedMosaic, or callGermline), VCF SV records (output of\n" +
+			"callsToVcf), or .seg (output of segmentCbs), in which case the type of each segment is estimated first and copy\n" +
+			"neutral segments are dropped. Output is BED with the number and intervals of the merged input calls.\n" +
+			"Usage:\n" +
+			"./stitchCalls [options] -i calls.bed -o stitched.bed\n\n")
+	flag.PrintDefaults()
+}
+
+type settings struct {
+	maxGapFraction float64
+	minGapLlr      float64
+	minSegLlr      float64
+	defaults       cnv.Noise
+}
+
+func main() {
+	input := flag.String("i", "", "Input calls (.bed, .vcf, or .seg).")
+	output := flag.String("o", "stdout", "Output stitched calls (.bed).")
+	vcfFile := flag.String("vcf", "", "Input VCF with GT/BAF/LRR format fields used to test the signal in gaps and estimate sample noise.")
+	batchSize := flag.Int("batchSize", 500, "Number of samples loaded into memory at once with -vcf. The VCF is read once per batch.")
+	var s settings
+	flag.Float64Var(&s.maxGapFraction, "maxGapFraction", 0.2, "Merge calls if the gap between them is at most this fraction of their combined length.")
+	flag.Float64Var(&s.minGapLlr, "minGapLlr", 2, "With -vcf, merge calls if the log likelihood ratio of the gap markers carrying the same event "+
+		"at the cell fraction of the calls, against copy neutral, is greater than this value.")
+	flag.Float64Var(&s.minSegLlr, "minSegLlr", 10, "Minimum log likelihood ratio against copy neutral for a .seg segment to be used as a call.")
+	flag.Float64Var(&s.defaults.Compression, "compression", 0.5, "LRR compression of the array. Observed LRR is assumed to be compression*log2(copy ratio).")
+	flag.Float64Var(&s.defaults.LrrSd, "lrrSd", 0.2, "Per-marker LRR standard deviation used for samples not in -vcf.")
+	flag.Float64Var(&s.defaults.BafSd, "bafSd", 0.04, "Per-marker heterozygous BAF standard deviation used for samples not in -vcf.")
+	flag.Parse()
+
+	if *input == "" {
+		usage()
+		log.Fatal("ERROR: input calls are required (-i)")
+	}
+	if *batchSize < 1 {
+		log.Fatal("ERROR: -batchSize must be at least 1")
+	}
+	if s.maxGapFraction < 0 {
+		log.Fatal("ERROR: -maxGapFraction must be non-negative")
+	}
+
+	var calls []cnv.Call
+	var segs []cnv.Seg
+	switch {
+	case strings.HasSuffix(*input, ".seg") || strings.HasSuffix(*input, ".seg.gz"):
+		segs = cnv.ReadSeg(*input)
+	case strings.HasSuffix(*input, ".bed") || strings.HasSuffix(*input, ".bed.gz"):
+		calls = cnv.ReadBed(*input)
+	case cnv.IsVcf(*input):
+		calls = cnv.ReadVcf(*input)
+	default:
+		log.Fatalf("ERROR: unrecognized call file extension '%s'. Expecting .bed, .vcf, or .seg", *input)
+	}
+
+	callsBySample := make(map[string][]cnv.Call)
+	for _, c := range calls {
+		if c.Type == cnv.Neutral {
+			log.Printf("WARNING: skipping call without type at %s:%d-%d in sample %s", c.Chr, c.Start, c.End, c.Sample)
+			continue
+		}
+		callsBySample[c.Sample] = append(callsBySample[c.Sample], c)
+	}
+	segsBySample := make(map[string][]cnv.Seg)
+	for _, seg := range segs {
+		segsBySample[seg.Sample] = append(segsBySample[seg.Sample], seg)
+	}
+
+	var ans []cnv.Stitched
+	done := make(map[string]bool)
+	if *vcfFile != "" {
+		ans = stitchWithSignal(*vcfFile, callsBySample, segsBySample, done, *batchSize, s)
+	}
+	for sample := range callsBySample {
+		if !done[sample] {
+			ans = append(ans, cnv.Stitch(callsBySample[sample], s.maxGapFraction, nil)...)
+		}
+	}
+	for sample := range segsBySample {
+		if !done[sample] {
+			ans = append(ans, cnv.Stitch(segCalls(segsBySample[sample], s.defaults, s.minSegLlr), s.maxGapFraction, nil)...)
+		}
+	}
+
+	sort.SliceStable(ans, func(i, j int) bool {
+		if ans[i].Sample != ans[j].Sample {
+			return ans[i].Sample < ans[j].Sample
+		}
+		if ans[i].Chr != ans[j].Chr {
+			return cnv.ChromLess(ans[i].Chr, ans[j].Chr)
+		}
+		return ans[i].Start < ans[j].Start
+	})
+	var nIn int
+	out := fileio.EasyCreate(*output)
+	_, err := fmt.Fprintln(out, cnv.StitchedHeader)
+	exception.PanicOnErr(err)
+	for i := range ans {
+		cnv.WriteStitched(out, ans[i])
+		nIn += len(ans[i].Parts)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+	log.Printf("Stitched %d calls into %d calls", nIn, len(ans))
+}
+
+// stitchWithSignal stitches the calls of samples in the VCF, using the signal in gaps and the sample noise.
+// Processed samples are marked in done.
+func stitchWithSignal(vcfFile string, callsBySample map[string][]cnv.Call, segsBySample map[string][]cnv.Seg, done map[string]bool, batchSize int, s settings) []cnv.Stitched {
+	var sampleIdx []int
+	for i, name := range signal.SampleNames(vcfFile) {
+		if len(callsBySample[name]) > 0 || len(segsBySample[name]) > 0 {
+			sampleIdx = append(sampleIdx, i)
+		}
+	}
+
+	var ans []cnv.Stitched
+	for start := 0; start < len(sampleIdx); start += batchSize {
+		data := signal.Read(vcfFile, nil, sampleIdx[start:minInt(start+batchSize, len(sampleIdx))])
+		idx := cnv.NewMarkerIndex(data)
+		for si, sample := range data.Samples {
+			median, noise := cnv.SampleNoise(data, si, s.defaults)
+			calls := callsBySample[sample]
+			if segs, found := segsBySample[sample]; found {
+				calls = segCalls(segs, noise, s.minSegLlr)
+			}
+			consistent := func(left, right cnv.Call) bool {
+				gap := cnv.IntervalSignal(data, si, idx, left.Chr, left.End, right.Start, median)
+				if gap.NMarkers == 0 {
+					return false
+				}
+				return gapLlr(gap, noise, left, right) > s.minGapLlr
+			}
+			ans = append(ans, cnv.Stitch(calls, s.maxGapFraction, consistent)...)
+			done[sample] = true
+		}
+	}
+	return ans
+}
+
+// segCalls estimates the type of each segment and returns those with an event as calls.
+func segCalls(segs []cnv.Seg, n cnv.Noise, minLlr float64) []cnv.Call {
+	var ans []cnv.Call
+	var est cnv.Estimate
+	for _, seg := range segs {
+		est = cnv.EstimateState(cnv.SegmentSignal{Lrr: seg.Mean, BafDev: seg.BafDev, NMarkers: seg.NMarkers, NHet: seg.NHet}, n)
+		if est.Type == cnv.Neutral || est.Llr < minLlr {
+			continue
+		}
+		ans = append(ans, cnv.Call{Sample: seg.Sample, Chr: seg.Chr, Start: seg.Start - 1, End: seg.End, NMarkers: seg.NMarkers,
+			Type: est.Type, CellFraction: est.CellFraction, Score: est.Llr})
+	}
+	return ans
+}
+
+// gapLlr returns the log likelihood ratio of the gap carrying the event of the flanking calls at their
+// marker weighted cell fraction. If the calls have no cell fraction, the best fitting fraction is used.
+func gapLlr(gap cnv.SegmentSignal, n cnv.Noise, left, right cnv.Call) float64 {
+	var sum, weight float64
+	for _, c := range []cnv.Call{left, right} {
+		if !math.IsNaN(c.CellFraction) && c.NMarkers > 0 {
+			sum += c.CellFraction * float64(c.NMarkers)
+			weight += float64(c.NMarkers)
+		}
+	}
+	if weight > 0 {
+		return cnv.Llr(gap, n, left.Type, sum/weight)
+	}
+	best := math.Inf(-1)
+	for f := 0.01; f <= 1; f += 0.01 {
+		best = math.Max(best, cnv.Llr(gap, n, left.Type, f))
+	}
+	return best
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
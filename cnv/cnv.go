@@ -0,0 +1,79 @@
+package cnv
+
+import (
+	"fmt"
+	"github.com/vertgenlab/gonomics/exception"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Type of copy number event.
+type Type byte
+
+const (
+	Neutral Type = iota
+	Loss
+	Gain
+	CNLOH
+)
+
+func (t Type) String() string {
+	switch t {
+	case Loss:
+		return "LOSS"
+	case Gain:
+		return "GAIN"
+	case CNLOH:
+		return "CNLOH"
+	default:
+		return "NEUTRAL"
+	}
+}
+
+// ParseType parses a call type. Accepts the names from Type.String as well as common
+// synonyms (DEL, DUP, LOH).
+func ParseType(s string) Type {
+	switch strings.ToUpper(s) {
+	case "LOSS", "DEL", "DELETION":
+		return Loss
+	case "GAIN", "DUP", "DUPLICATION", "AMP":
+		return Gain
+	case "CNLOH", "CN-LOH", "LOH", "UPD":
+		return CNLOH
+	default:
+		return Neutral
+	}
+}
+
+// Call is a copy number event in one sample. Start is 0-based and End is 1-based (BED convention)
+// so a call spanning markers at positions 100 and 200 has Start 99 and End 200.
+type Call struct {
+	Sample        string
+	Chr           string
+	Start         int
+	End           int
+	NMarkers      int
+	Type          Type
+	CopyNumber    int  // integer copy number of germline calls, only meaningful if HasCopyNumber
+	HasCopyNumber bool // false for mosaic calls, so the zero value of Call has an unknown copy number
+	CellFraction  float64
+	Score         float64 // log likelihood ratio against the copy neutral state
+}
+
+const BedHeader string = "#CHROM\tSTART\tEND\tSAMPLE\tTYPE\tCOPY_NUMBER\tN_MARKERS\tCELL_FRACTION\tLLR"
+
+// WriteBed writes a call as a line of a BED file with the extra columns in BedHeader.
+// Unknown copy numbers are written as '.'.
+func WriteBed(out io.Writer, c Call) {
+	_, err := fmt.Fprintln(out, bedLine(c))
+	exception.PanicOnErr(err)
+}
+
+func bedLine(c Call) string {
+	cn := "."
+	if c.HasCopyNumber {
+		cn = strconv.Itoa(c.CopyNumber)
+	}
+	return fmt.Sprintf("%s\t%d\t%d\t%s\t%s\t%s\t%d\t%.4f\t%.4g", c.Chr, c.Start, c.End, c.Sample, c.Type, cn, c.NMarkers, c.CellFraction, c.Score)
+}
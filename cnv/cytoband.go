@@ -0,0 +1,68 @@
+package cnv
+
+import (
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"strings"
+)
+
+// Arm is a chromosome arm with coordinates in BED convention.
+type Arm struct {
+	Chr   string
+	Name  string // p or q
+	Start int
+	End   int
+}
+
+// acrocentric chromosomes have p arms made of repeats and rDNA without informative markers.
+var acrocentric = map[string]bool{"13": true, "14": true, "15": true, "21": true, "22": true}
+
+// IsAcrocentric returns true for human acrocentric chromosomes (13, 14, 15, 21, 22), with or without a 'chr' prefix.
+func IsAcrocentric(chr string) bool {
+	return acrocentric[strings.TrimPrefix(chr, "chr")]
+}
+
+// ReadCytoBand reads a UCSC cytoBand file (chrom, start, end, band name, stain) and returns the chromosome
+// arms in file order, and the centromere regions (bands stained acen). Bands other than acen are assigned
+// to the p or q arm by the first letter of their name.
+func ReadCytoBand(filename string) ([]Arm, Regions) {
+	var arms []Arm
+	armIdx := make(map[string]int)
+	centromeres := make(map[string][][2]int)
+	var words []string
+	var start, end, i int
+	var name, key string
+	var found bool
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		words = strings.Split(line, "\t")
+		if len(words) < 5 {
+			log.Fatalf("ERROR: expected 5 columns (chrom, start, end, name, stain) in %s:\n%s", filename, line)
+		}
+		start, end = parseInt(words[1], line), parseInt(words[2], line)
+		if words[4] == "acen" {
+			centromeres[words[0]] = append(centromeres[words[0]], [2]int{start, end})
+			continue
+		}
+		if words[3] == "" || (words[3][0] != 'p' && words[3][0] != 'q') {
+			continue // unplaced contigs without band names
+		}
+		name = words[3][:1]
+		key = words[0] + "\t" + name
+		if i, found = armIdx[key]; !found {
+			armIdx[key] = len(arms)
+			arms = append(arms, Arm{Chr: words[0], Name: name, Start: start, End: end})
+			continue
+		}
+		if start < arms[i].Start {
+			arms[i].Start = start
+		}
+		if end > arms[i].End {
+			arms[i].End = end
+		}
+	}
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return arms, NewRegions(centromeres)
+}
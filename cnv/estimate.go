@@ -0,0 +1,150 @@
+package cnv
+
+import (
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"math"
+)
+
+// Estimate is the most likely copy number state and cell fraction of a segment.
+type Estimate struct {
+	Type         Type
+	CellFraction float64
+	CfLow        float64 // confidence interval of the cell fraction
+	CfHigh       float64
+	Llr          float64 // log likelihood ratio of the estimate against the copy neutral state
+}
+
+// SegmentSignal summarizes the signal of a segment in one sample.
+type SegmentSignal struct {
+	Lrr      float64 // mean LRR, centered on the sample median
+	BafDev   float64 // median mirrored BAF of heterozygous markers minus 0.5, NaN if unknown
+	NMarkers int     // markers with LRR
+	NHet     int     // heterozygous markers with BAF
+}
+
+// Noise of single markers in one sample, along with the LRR compression of the array.
+type Noise struct {
+	LrrSd       float64
+	BafSd       float64
+	Compression float64
+}
+
+const (
+	fractionGrid float64 = 0.002
+	ciLlr        float64 = 1.92 // half of the 95% chi-square quantile with 1 df
+	medianSe     float64 = 1.2533
+)
+
+// EstimateState jointly estimates the event type and cell fraction of a segment from its LRR
+// shift and BAF deviation by maximum likelihood over a grid of cell fractions. Segment means are
+// assumed normal with standard errors from the per-marker noise. Since the median mirrored BAF is
+// biased upwards by noise, the expected deviation is the median of the folded normal distribution.
+// The confidence interval is the profile likelihood interval of the cell fraction within the
+// estimated type. Segments without evidence for an event have type Neutral.
+func EstimateState(s SegmentSignal, n Noise) Estimate {
+	neutral := logLikelihood(s, n, Neutral, 0)
+	best := Estimate{Type: Neutral}
+	bestLl := neutral
+	nGrid := int(math.Round(1 / fractionGrid))
+	grid := make(map[Type][]float64, 3)
+	var f float64
+	for _, t := range []Type{Loss, Gain, CNLOH} {
+		grid[t] = make([]float64, nGrid+1)
+		for i := range grid[t] {
+			f = float64(i) / float64(nGrid)
+			grid[t][i] = logLikelihood(s, n, t, f)
+			if grid[t][i] > bestLl {
+				bestLl = grid[t][i]
+				best = Estimate{Type: t, CellFraction: f, Llr: grid[t][i] - neutral}
+			}
+		}
+	}
+	if best.Type == Neutral {
+		return best
+	}
+
+	best.CfLow, best.CfHigh = best.CellFraction, best.CellFraction
+	for i, l := range grid[best.Type] {
+		if l >= bestLl-ciLlr {
+			f = float64(i) / float64(nGrid)
+			best.CfLow = math.Min(best.CfLow, f)
+			best.CfHigh = math.Max(best.CfHigh, f)
+		}
+	}
+	return best
+}
+
+// Llr returns the log likelihood ratio of a segment having type t at cell fraction f against the
+// copy neutral state, under the same model as EstimateState.
+func Llr(s SegmentSignal, n Noise, t Type, f float64) float64 {
+	return logLikelihood(s, n, t, f) - logLikelihood(s, n, Neutral, 0)
+}
+
+func logLikelihood(s SegmentSignal, n Noise, t Type, f float64) float64 {
+	expLrr, expDev := Expected(t, f, n.Compression)
+	var ans float64
+	if s.NMarkers > 0 && !math.IsNaN(s.Lrr) {
+		ans += logNormal(s.Lrr, expLrr, n.LrrSd/math.Sqrt(float64(s.NMarkers)))
+	}
+	if s.NHet > 0 && !math.IsNaN(s.BafDev) {
+		ans += logNormal(s.BafDev, foldedMedian(expDev, n.BafSd), medianSe*n.BafSd/math.Sqrt(float64(s.NHet)))
+	}
+	return ans
+}
+
+func logNormal(x, mu, sd float64) float64 {
+	z := (x - mu) / sd
+	return -0.5*z*z - math.Log(sd) - 0.5*math.Log(2*math.Pi)
+}
+
+// foldedMedian returns the median of |X| for X ~ Normal(mu, sd).
+func foldedMedian(mu, sd float64) float64 {
+	cdf := func(m float64) float64 {
+		return 0.5*math.Erfc(-(m-mu)/(sd*math.Sqrt2)) - 0.5*math.Erfc(-(-m-mu)/(sd*math.Sqrt2))
+	}
+	lo, hi := 0.0, math.Abs(mu)+5*sd
+	for i := 0; i < 50; i++ {
+		if cdf((lo+hi)/2) < 0.5 {
+			lo = (lo + hi) / 2
+		} else {
+			hi = (lo + hi) / 2
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// compressionSigmas is the number of standard errors by which the LRR shift and BAF deviation of a
+// segment must differ from copy neutral for the segment to be used to estimate compression.
+const compressionSigmas float64 = 4
+
+// EstimateCompression estimates the LRR compression of a sample from its segments. For each segment
+// with a clear LRR shift and BAF deviation, the event type follows from the sign of the shift and the
+// cell fraction from the BAF deviation, which does not depend on compression. The compression of the
+// segment is its LRR shift divided by the expected log2 copy ratio at that cell fraction. Returns the
+// median over segments and false if fewer than minSegments segments are informative.
+func EstimateCompression(segs []SegmentSignal, n Noise, minSegments int) (float64, bool) {
+	var ans []float64
+	var t Type
+	var f, ratio float64
+	for _, s := range segs {
+		if s.NMarkers == 0 || s.NHet == 0 || math.IsNaN(s.Lrr) || math.IsNaN(s.BafDev) ||
+			math.Abs(s.Lrr) < compressionSigmas*n.LrrSd/math.Sqrt(float64(s.NMarkers)) ||
+			s.BafDev < compressionSigmas*medianSe*n.BafSd/math.Sqrt(float64(s.NHet)) {
+			continue
+		}
+		t = Gain
+		if s.Lrr < 0 {
+			t = Loss
+		}
+		f = FractionFromBafDev(t, s.BafDev)
+		if f <= 0 || f > 1 {
+			continue
+		}
+		ratio, _ = Expected(t, f, 1)
+		ans = append(ans, s.Lrr/ratio)
+	}
+	if minSegments < 1 || len(ans) < minSegments {
+		return math.NaN(), false
+	}
+	return signal.Median(ans), true
+}
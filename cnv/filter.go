@@ -0,0 +1,227 @@
+package cnv
+
+import (
+	"fmt"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Rule is a condition that a call must satisfy to pass filtering, e.g. 'markers >= 10'.
+type Rule struct {
+	Name    string
+	Field   string
+	Op      string
+	Value   float64
+	regions Regions // for overlap fields
+}
+
+// Fields of a call that can be used in rules. Sample level values are written as sample.<column>
+// and refer to a column of the sample statistics table. Overlap with a BED file is written as
+// overlap:<file> and is the fraction of the call covered by the regions in the file.
+const (
+	FieldMarkers      string = "markers"      // number of markers
+	FieldLength       string = "length"       // length in bp
+	FieldDensity      string = "density"      // markers per Mb
+	FieldCellFraction string = "cellFraction" // estimated cell fraction
+	FieldLlr          string = "llr"          // log likelihood ratio against copy neutral
+	FieldCopyNumber   string = "copyNumber"   // integer copy number
+	samplePrefix      string = "sample."
+	overlapPrefix     string = "overlap:"
+)
+
+var ops = []string{"<", "<=", ">", ">=", "==", "!="}
+
+// String returns the rule in the format of the rules file.
+func (r Rule) String() string {
+	return fmt.Sprintf("%s %s %s %g", r.Name, r.Field, r.Op, r.Value)
+}
+
+// ReadRules reads a filter expression file. Each line is a rule with a name, field, comparison operator,
+// and value separated by whitespace, e.g.:
+//
+//	minMarkers  markers             >=  10
+//	maxSampleSd sample.lrr_sd       <=  0.35
+//	segdup      overlap:segdup.bed  <   0.5
+//
+// Lines starting with '#' are comments. Relative paths of overlap files are relative to the rules file.
+func ReadRules(filename string) []Rule {
+	var ans []Rule
+	var words []string
+	var r Rule
+	var err error
+	names := make(map[string]bool)
+	regionCache := make(map[string]Regions)
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		words = strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		if len(words) != 4 {
+			log.Fatalf("ERROR: expected 4 fields (name, field, operator, value) in rule:\n%s", line)
+		}
+		r = Rule{Name: words[0], Field: words[1], Op: words[2]}
+		if names[r.Name] {
+			log.Fatalf("ERROR: rule name '%s' is used more than once", r.Name)
+		}
+		names[r.Name] = true
+		if !validOp(r.Op) {
+			log.Fatalf("ERROR: unknown operator '%s' in rule:\n%s\nExpecting one of: %s", r.Op, line, strings.Join(ops, " "))
+		}
+		if r.Value, err = strconv.ParseFloat(words[3], 64); err != nil {
+			log.Fatalf("ERROR: could not parse value '%s' in rule:\n%s", words[3], line)
+		}
+		switch {
+		case strings.HasPrefix(r.Field, overlapPrefix):
+			path := strings.TrimPrefix(r.Field, overlapPrefix)
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(filename), path)
+			}
+			if _, found := regionCache[path]; !found {
+				regionCache[path] = ReadRegions(path)
+			}
+			r.regions = regionCache[path]
+		case strings.HasPrefix(r.Field, samplePrefix):
+		case r.Field == FieldMarkers, r.Field == FieldLength, r.Field == FieldDensity,
+			r.Field == FieldCellFraction, r.Field == FieldLlr, r.Field == FieldCopyNumber:
+		default:
+			log.Fatalf("ERROR: unknown field '%s' in rule:\n%s", r.Field, line)
+		}
+		ans = append(ans, r)
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return ans
+}
+
+func validOp(op string) bool {
+	for i := range ops {
+		if ops[i] == op {
+			return true
+		}
+	}
+	return false
+}
+
+// SampleColumns returns the sample statistic columns used by the rules.
+func SampleColumns(rules []Rule) []string {
+	var ans []string
+	for _, r := range rules {
+		if strings.HasPrefix(r.Field, samplePrefix) {
+			ans = append(ans, strings.TrimPrefix(r.Field, samplePrefix))
+		}
+	}
+	return ans
+}
+
+// Pass returns true if the call satisfies the rule. sampleStats holds per-sample values by column name
+// and may be nil if no rule uses sample fields. Rules on missing values (e.g. unknown copy number or a
+// sample without statistics) pass. Calls with no length fail overlap and density rules.
+func (r Rule) Pass(c Call, sampleStats map[string]map[string]float64) bool {
+	var x float64
+	length := float64(c.End - c.Start)
+	if length <= 0 && (r.regions != nil || r.Field == FieldDensity) {
+		return false
+	}
+	switch {
+	case r.regions != nil:
+		x = float64(r.regions.Overlap(c.Chr, c.Start, c.End)) / length
+	case strings.HasPrefix(r.Field, samplePrefix):
+		x = math.NaN()
+		if v, found := sampleStats[c.Sample][strings.TrimPrefix(r.Field, samplePrefix)]; found {
+			x = v
+		}
+	case r.Field == FieldMarkers:
+		x = float64(c.NMarkers)
+	case r.Field == FieldLength:
+		x = length
+	case r.Field == FieldDensity:
+		x = float64(c.NMarkers) / length * 1e6
+	case r.Field == FieldCellFraction:
+		x = c.CellFraction
+	case r.Field == FieldLlr:
+		x = c.Score
+	case r.Field == FieldCopyNumber:
+		x = math.NaN()
+		if c.HasCopyNumber {
+			x = float64(c.CopyNumber)
+		}
+	}
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return true
+	}
+	switch r.Op {
+	case "<":
+		return x < r.Value
+	case "<=":
+		return x <= r.Value
+	case ">":
+		return x > r.Value
+	case ">=":
+		return x >= r.Value
+	case "==":
+		return x == r.Value
+	default:
+		return x != r.Value
+	}
+}
+
+// Filter returns the names of the rules the call fails, joined by ';', or PASS if it fails none.
+func Filter(c Call, rules []Rule, sampleStats map[string]map[string]float64) string {
+	var failed []string
+	for _, r := range rules {
+		if !r.Pass(c, sampleStats) {
+			failed = append(failed, r.Name)
+		}
+	}
+	if len(failed) == 0 {
+		return "PASS"
+	}
+	return strings.Join(failed, ";")
+}
+
+const FilteredBedHeader string = BedHeader + "\tFILTER"
+
+// WriteFilteredBed writes a call as a line of a BED file with the columns of WriteBed followed by the filter.
+func WriteFilteredBed(out io.Writer, c Call, filter string) {
+	_, err := fmt.Fprintf(out, "%s\t%s\n", bedLine(c), filter)
+	exception.PanicOnErr(err)
+}
+
+// ReadSampleStats reads a table of per-sample values with a header line. The first column is the sample
+// name and the other columns are read by name. Values of '.' or NA are NaN.
+func ReadSampleStats(filename string) map[string]map[string]float64 {
+	ans := make(map[string]map[string]float64)
+	var header, words []string
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextLine(file); !done; line, done = fileio.EasyNextLine(file) {
+		if line == "" {
+			continue
+		}
+		words = strings.Split(line, "\t")
+		if header == nil {
+			header = words
+			header[0] = strings.TrimPrefix(header[0], "#")
+			continue
+		}
+		if len(words) != len(header) {
+			log.Fatalf("ERROR: expected %d columns in %s:\n%s", len(header), filename, line)
+		}
+		ans[words[0]] = make(map[string]float64, len(header)-1)
+		for i := 1; i < len(words); i++ {
+			if _, err := strconv.ParseFloat(words[i], 64); err != nil && words[i] != "." && words[i] != "NA" {
+				continue // non-numeric columns, e.g. flags
+			}
+			ans[words[0]][header[i]] = parseFloat(words[i], line)
+		}
+	}
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return ans
+}
@@ -0,0 +1,34 @@
+package cnv
+
+import "math"
+
+// Expected returns the expected LRR and deviation of heterozygous BAF from 0.5 when a fraction f
+// of cells carries an event of type t. Observed LRR is assumed to be compression*log2(copy ratio).
+func Expected(t Type, f, compression float64) (lrr, bafDev float64) {
+	switch t {
+	case Loss:
+		return compression * math.Log2((2-f)/2), f / (2 * (2 - f))
+	case Gain:
+		return compression * math.Log2((2+f)/2), f / (2 * (2 + f))
+	case CNLOH:
+		return 0, f / 2
+	default:
+		return 0, 0
+	}
+}
+
+// FractionFromBafDev inverts the BAF deviation of Expected to a cell fraction. The result may
+// exceed 1 when the deviation is not possible for the event type.
+func FractionFromBafDev(t Type, dev float64) float64 {
+	switch t {
+	case Loss:
+		return 4 * dev / (1 + 2*dev)
+	case Gain:
+		if dev >= 0.5 {
+			return math.Inf(1)
+		}
+		return 4 * dev / (1 - 2*dev)
+	default:
+		return 2 * dev
+	}
+}
@@ -0,0 +1,222 @@
+package cnv
+
+import (
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ReadBed reads calls from a BED file with the sample in the fourth column. Files with the BedHeader
+// line written before WriteBed lines are read in full. For other BED files, including generic BED9,
+// the remaining fields of Call are left empty with an unknown copy number.
+func ReadBed(filename string) []Call {
+	var ans []Call
+	var c Call
+	var words []string
+	var full bool
+	var err error
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextLine(file); !done; line, done = fileio.EasyNextLine(file) {
+		if strings.HasPrefix(line, "#") {
+			full = full || strings.HasPrefix(line, BedHeader)
+			continue
+		}
+		words = strings.Split(line, "\t")
+		if len(words) < 4 {
+			log.Fatalf("ERROR: expected at least 4 columns (chrom, start, end, sample) in %s:\n%s", filename, line)
+		}
+		c = Call{Chr: words[0], Start: parseInt(words[1], line), End: parseInt(words[2], line), Sample: words[3],
+			CellFraction: math.NaN(), Score: math.NaN()}
+		if full && len(words) >= 9 {
+			c.Type = ParseType(words[4])
+			if words[5] != "." {
+				c.CopyNumber, c.HasCopyNumber = parseInt(words[5], line), true
+			}
+			c.NMarkers = parseInt(words[6], line)
+			c.CellFraction = parseFloat(words[7], line)
+			c.Score = parseFloat(words[8], line)
+		}
+		ans = append(ans, c)
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return ans
+}
+
+// ReadSeg reads segments from a .seg file. The first four columns must be the sample, chromosome,
+// start, and end, and the last column the mean LRR. The fifth column is read as the number of markers
+// when there are at least six columns. The num.het, baf.dev, and p.value columns of WriteSeg are read
+// by name from the header, otherwise they are 0, NaN, and NaN.
+func ReadSeg(filename string) []Seg {
+	var ans []Seg
+	var s Seg
+	var words []string
+	var err error
+	hetCol, bafCol, pCol := -1, -1, -1
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		words = strings.Split(line, "\t")
+		if len(words) < 5 {
+			log.Fatalf("ERROR: expected at least 5 columns (sample, chrom, start, end, mean) in %s:\n%s", filename, line)
+		}
+		if _, err = strconv.Atoi(words[2]); err != nil { // header
+			for i := range words {
+				switch words[i] {
+				case "num.het":
+					hetCol = i
+				case "baf.dev":
+					bafCol = i
+				case "p.value":
+					pCol = i
+				}
+			}
+			continue
+		}
+		s = Seg{Sample: words[0], Chr: words[1], Start: parseInt(words[2], line), End: parseInt(words[3], line),
+			BafDev: math.NaN(), P: math.NaN(), Mean: parseFloat(words[len(words)-1], line)}
+		if len(words) >= 6 {
+			s.NMarkers = parseInt(words[4], line)
+		}
+		if hetCol != -1 {
+			s.NHet = parseInt(words[hetCol], line)
+		}
+		if bafCol != -1 {
+			s.BafDev = parseFloat(words[bafCol], line)
+		}
+		if pCol != -1 {
+			s.P = parseFloat(words[pCol], line)
+		}
+		ans = append(ans, s)
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return ans
+}
+
+func parseInt(s string, line string) int {
+	ans, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("ERROR: could not parse '%s' as an integer in line:\n%s", s, line)
+	}
+	return ans
+}
+
+// parseFloat parses a float. NA and '.' are NaN.
+func parseFloat(s string, line string) float64 {
+	if s == "NA" || s == "." {
+		return math.NaN()
+	}
+	ans, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		log.Fatalf("ERROR: could not parse '%s' as a number in line:\n%s", s, line)
+	}
+	return ans
+}
+
+// ReadVcf reads calls from the symbolic SV records (<DEL>, <DUP>, <CNV>, <CNLOH>) of a VCF such as
+// written by WriteVcf. A sample carries the event if its GT has a non-reference allele, or for <CNV>
+// records and missing GT, if its CN is not 2. Other records are skipped. Start is the VCF POS, since
+// POS is the base before the event.
+func ReadVcf(filename string) []Call {
+	var ans []Call
+	var samples, words, format, info []string
+	var svType Type
+	var isCnv bool
+	var c Call
+	var err error
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextLine(file); !done; line, done = fileio.EasyNextLine(file) {
+		if strings.HasPrefix(line, "##") {
+			continue
+		}
+		words = strings.Split(line, "\t")
+		if strings.HasPrefix(line, "#CHROM") {
+			if len(words) > 9 {
+				samples = words[9:]
+			}
+			continue
+		}
+		if len(words) < 8 {
+			log.Fatalf("ERROR: expected at least 8 columns in %s:\n%s", filename, line)
+		}
+		isCnv = words[4] == "<CNV>"
+		switch {
+		case isCnv:
+			svType = Neutral
+		case strings.HasPrefix(words[4], "<") && strings.HasSuffix(words[4], ">"):
+			svType = ParseType(strings.Trim(words[4], "<>"))
+			if svType == Neutral {
+				continue
+			}
+		default:
+			continue
+		}
+		c = Call{Chr: words[0], Start: parseInt(words[1], line), End: -1}
+		info = strings.Split(words[7], ";")
+		for i := range info {
+			switch {
+			case strings.HasPrefix(info[i], "END="):
+				c.End = parseInt(info[i][4:], line)
+			case strings.HasPrefix(info[i], "NMARKERS="):
+				c.NMarkers = parseInt(info[i][9:], line)
+			}
+		}
+		if c.End == -1 {
+			log.Fatalf("ERROR: symbolic record is missing INFO/END in %s:\n%s", filename, line)
+		}
+		if len(words) < 10 {
+			continue
+		}
+		format = strings.Split(words[8], ":")
+		for i := range samples {
+			if 9+i >= len(words) {
+				break
+			}
+			if carrier, ok := vcfSampleCall(c, svType, isCnv, format, strings.Split(words[9+i], ":"), line); ok {
+				carrier.Sample = samples[i]
+				ans = append(ans, carrier)
+			}
+		}
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return ans
+}
+
+// vcfSampleCall returns the call of one sample of a symbolic SV record and false if the sample
+// does not carry the event.
+func vcfSampleCall(c Call, svType Type, isCnv bool, format, values []string, line string) (Call, bool) {
+	var hasAlt bool
+	c.CellFraction, c.Score = math.NaN(), math.NaN()
+	for i := range format {
+		if i >= len(values) || values[i] == "." {
+			continue
+		}
+		switch format[i] {
+		case "GT":
+			hasAlt = strings.ContainsAny(values[i], "123456789")
+		case "CN":
+			c.CopyNumber, c.HasCopyNumber = parseInt(values[i], line), true
+		case "CF":
+			c.CellFraction = parseFloat(values[i], line)
+		case "LLR":
+			c.Score = parseFloat(values[i], line)
+		}
+	}
+	switch {
+	case hasAlt && !isCnv:
+		c.Type = svType
+	case !c.HasCopyNumber || svType == CNLOH:
+		return c, false
+	case c.CopyNumber < 2:
+		c.Type = Loss
+	case c.CopyNumber > 2:
+		c.Type = Gain
+	default:
+		return c, false
+	}
+	return c, true
+}
@@ -0,0 +1,88 @@
+package cnv
+
+import (
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Regions is a set of genomic intervals, merged and sorted per chromosome, for computing overlaps.
+// Intervals are 0-based half open (BED convention). Chromosomes are keyed with a 'chr' prefix so
+// "1" and "chr1" refer to the same chromosome.
+type Regions map[string][][2]int
+
+// ReadRegions reads the first three columns of a BED file. Lines starting with 'track' or 'browser'
+// are skipped.
+func ReadRegions(filename string) Regions {
+	var words []string
+	raw := make(map[string][][2]int)
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		if strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		words = strings.Fields(line)
+		if len(words) < 3 {
+			log.Fatalf("ERROR: expected at least 3 columns (chrom, start, end) in %s:\n%s", filename, line)
+		}
+		raw[words[0]] = append(raw[words[0]], [2]int{parseInt(words[1], line), parseInt(words[2], line)})
+	}
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return NewRegions(raw)
+}
+
+// NewRegions sorts and merges overlapping intervals.
+func NewRegions(intervals map[string][][2]int) Regions {
+	ans := make(Regions, len(intervals))
+	for chr, r := range intervals {
+		sorted := make([][2]int, len(r))
+		copy(sorted, r)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+		var merged [][2]int
+		for _, iv := range sorted {
+			if len(merged) > 0 && iv[0] <= merged[len(merged)-1][1] {
+				if iv[1] > merged[len(merged)-1][1] {
+					merged[len(merged)-1][1] = iv[1]
+				}
+				continue
+			}
+			merged = append(merged, iv)
+		}
+		chr = normalizeChrom(chr)
+		ans[chr] = append(ans[chr], merged...)
+		if len(ans[chr]) > len(merged) { // both "1" and "chr1" were in intervals
+			ans[chr] = NewRegions(map[string][][2]int{chr: ans[chr]})[chr]
+		}
+	}
+	return ans
+}
+
+func normalizeChrom(chr string) string {
+	return "chr" + strings.TrimPrefix(chr, "chr")
+}
+
+// Overlap returns the number of bases of [start, end) on chr covered by the regions.
+func (r Regions) Overlap(chr string, start, end int) int {
+	ivs := r[normalizeChrom(chr)]
+	i := sort.Search(len(ivs), func(i int) bool { return ivs[i][1] > start })
+	var ans, s, e int
+	for ; i < len(ivs) && ivs[i][0] < end; i++ {
+		s, e = ivs[i][0], ivs[i][1]
+		if s < start {
+			s = start
+		}
+		if e > end {
+			e = end
+		}
+		ans += e - s
+	}
+	return ans
+}
+
+// Contains returns true if pos (1-based) is in one of the regions.
+func (r Regions) Contains(chr string, pos int) bool {
+	return r.Overlap(chr, pos-1, pos) > 0
+}
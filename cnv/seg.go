@@ -0,0 +1,40 @@
+package cnv
+
+import (
+	"fmt"
+	"github.com/vertgenlab/gonomics/exception"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Seg is a segment of constant signal in one sample, as in the IGV .seg format. Start and End are
+// the 1-based positions of the first and last marker in the segment.
+type Seg struct {
+	Sample   string
+	Chr      string
+	Start    int
+	End      int
+	NMarkers int
+	NHet     int     // heterozygous markers used for the BAF deviation
+	BafDev   float64 // median mirrored BAF of heterozygous markers minus 0.5
+	P        float64 // p-value of the change point at the start of the segment. NaN if none.
+	Mean     float64 // mean LRR
+}
+
+// SegHeader is the header of .seg files. IGV plots the last column.
+const SegHeader string = "ID\tchrom\tloc.start\tloc.end\tnum.mark\tnum.het\tbaf.dev\tp.value\tseg.mean"
+
+// WriteSeg writes a segment as a line of a .seg file with the columns in SegHeader. NaN values are written as NA.
+func WriteSeg(out io.Writer, s Seg) {
+	_, err := fmt.Fprintf(out, "%s\t%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", s.Sample, s.Chr, s.Start, s.End, s.NMarkers, s.NHet,
+		formatNA(s.BafDev, 'f', 4), formatNA(s.P, 'g', 4), formatNA(s.Mean, 'f', 4))
+	exception.PanicOnErr(err)
+}
+
+func formatNA(f float64, format byte, prec int) string {
+	if math.IsNaN(f) {
+		return "NA"
+	}
+	return strconv.FormatFloat(f, format, prec, 64)
+}
@@ -0,0 +1,77 @@
+package cnv
+
+import (
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"math"
+	"sort"
+)
+
+// MarkerIndex locates the markers of signal data in genomic intervals. Markers must be sorted by
+// position within each chromosome.
+type MarkerIndex struct {
+	chromRange map[string][2]int
+	pos        []int
+}
+
+func NewMarkerIndex(d signal.Data) MarkerIndex {
+	idx := MarkerIndex{chromRange: make(map[string][2]int), pos: make([]int, len(d.Markers))}
+	for _, r := range d.ChromRanges() {
+		idx.chromRange[d.Markers[r[0]].Chr] = r
+	}
+	for i := range d.Markers {
+		idx.pos[i] = d.Markers[i].Pos
+	}
+	return idx
+}
+
+// IntervalSignal returns the signal of sample s at markers with positions in (start, end], i.e. in the
+// BED interval [start, end). LRR is centered on median.
+func IntervalSignal(d signal.Data, s int, idx MarkerIndex, chr string, start, end int, median float64) SegmentSignal {
+	ans := SegmentSignal{Lrr: math.NaN(), BafDev: math.NaN()}
+	cr, found := idx.chromRange[chr]
+	if !found {
+		return ans
+	}
+	first := cr[0] + sort.SearchInts(idx.pos[cr[0]:cr[1]], start+1)
+	var sum float64
+	var mBaf []float64
+	for m := first; m < cr[1] && idx.pos[m] <= end; m++ {
+		if !math.IsNaN(float64(d.Lrr[s][m])) {
+			sum += float64(d.Lrr[s][m]) - median
+			ans.NMarkers++
+		}
+		if d.Het(s, m) && !math.IsNaN(float64(d.Baf[s][m])) {
+			mBaf = append(mBaf, math.Abs(float64(d.Baf[s][m])-0.5)+0.5)
+		}
+	}
+	if ans.NMarkers > 0 {
+		ans.Lrr = sum / float64(ans.NMarkers)
+	}
+	ans.NHet = len(mBaf)
+	if ans.NHet > 0 {
+		ans.BafDev = signal.Median(mBaf) - 0.5
+	}
+	return ans
+}
+
+// SampleNoise returns the autosomal LRR median of sample s and its per-marker noise from
+// signal.EstimateNoise, with the compression of defaults. Returns 0 and defaults if the sample
+// has no autosomal LRR.
+func SampleNoise(d signal.Data, s int, defaults Noise) (float64, Noise) {
+	var lrr, baf []float64
+	var het []bool
+	for m := range d.Markers {
+		if signal.IsAutosome(d.Markers[m].Chr) {
+			lrr = append(lrr, float64(d.Lrr[s][m]))
+			baf = append(baf, float64(d.Baf[s][m]))
+			het = append(het, d.Het(s, m))
+		}
+	}
+	median := signal.Median(lrr)
+	if math.IsNaN(median) {
+		return 0, defaults
+	}
+	n := Noise{Compression: defaults.Compression}
+	n.LrrSd, n.BafSd = signal.EstimateNoise(lrr, baf, het)
+	return median, n
+}
@@ -0,0 +1,99 @@
+package cnv
+
+import (
+	"fmt"
+	"github.com/vertgenlab/gonomics/exception"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Stitched is a call made by merging one or more input calls, which are kept in Parts in order.
+type Stitched struct {
+	Call
+	Parts []Call
+}
+
+// Stitch merges adjacent calls of the same type in the same sample and chromosome. Two calls are adjacent
+// if no other call of the sample lies between them. They are merged if the gap between them is at most
+// maxGapFraction times their combined length, or if consistent is not nil and returns true for the pair.
+// Merging is repeated so one output call may span many input calls. The input is not modified and the
+// output is sorted by sample, chromosome, and start.
+func Stitch(calls []Call, maxGapFraction float64, consistent func(left, right Call) bool) []Stitched {
+	sorted := make([]Call, len(calls))
+	copy(sorted, calls)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Sample != sorted[j].Sample {
+			return sorted[i].Sample < sorted[j].Sample
+		}
+		if sorted[i].Chr != sorted[j].Chr {
+			return ChromLess(sorted[i].Chr, sorted[j].Chr)
+		}
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	var ans []Stitched
+	var curr *Stitched
+	var gap, length int
+	for _, c := range sorted {
+		if len(ans) > 0 {
+			curr = &ans[len(ans)-1]
+			if curr.Sample == c.Sample && curr.Chr == c.Chr && curr.Type == c.Type {
+				gap = c.Start - curr.End
+				length = (curr.End - curr.Start) + (c.End - c.Start)
+				if float64(gap) <= maxGapFraction*float64(length) || (consistent != nil && consistent(curr.Call, c)) {
+					curr.Call = mergeCalls(curr.Call, c)
+					curr.Parts = append(curr.Parts, c)
+					continue
+				}
+			}
+		}
+		ans = append(ans, Stitched{Call: c, Parts: []Call{c}})
+	}
+	return ans
+}
+
+// mergeCalls combines a and b into a single call spanning both. The cell fraction is the
+// mean weighted by number of markers and the scores are summed.
+func mergeCalls(a, b Call) Call {
+	ans := a
+	if b.Start < ans.Start {
+		ans.Start = b.Start
+	}
+	if b.End > ans.End {
+		ans.End = b.End
+	}
+	ans.NMarkers = a.NMarkers + b.NMarkers
+	if a.HasCopyNumber != b.HasCopyNumber || a.CopyNumber != b.CopyNumber {
+		ans.CopyNumber, ans.HasCopyNumber = 0, false
+	}
+	switch {
+	case math.IsNaN(a.CellFraction):
+		ans.CellFraction = b.CellFraction
+	case math.IsNaN(b.CellFraction) || ans.NMarkers == 0:
+		ans.CellFraction = a.CellFraction
+	default:
+		ans.CellFraction = (a.CellFraction*float64(a.NMarkers) + b.CellFraction*float64(b.NMarkers)) / float64(ans.NMarkers)
+	}
+	switch {
+	case math.IsNaN(a.Score):
+		ans.Score = b.Score
+	case !math.IsNaN(b.Score):
+		ans.Score = a.Score + b.Score
+	}
+	return ans
+}
+
+const StitchedHeader string = BedHeader + "\tN_PARTS\tPARTS"
+
+// WriteStitched writes a stitched call as a line of a BED file with the columns of WriteBed followed
+// by the number of merged input calls and their intervals as a comma separated list of start-end.
+func WriteStitched(out io.Writer, s Stitched) {
+	parts := make([]string, len(s.Parts))
+	for i := range s.Parts {
+		parts[i] = fmt.Sprintf("%d-%d", s.Parts[i].Start, s.Parts[i].End)
+	}
+	_, err := fmt.Fprintf(out, "%s\t%d\t%s\n", bedLine(s.Call), len(s.Parts), strings.Join(parts, ","))
+	exception.PanicOnErr(err)
+}
@@ -0,0 +1,241 @@
+package cnv
+
+import (
+	"fmt"
+	"github.com/vertgenlab/gonomics/exception"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const vcfHeader string = "##fileformat=VCFv4.2\n" +
+	"##ALT=<ID=DEL,Description=\"Deletion\">\n" +
+	"##ALT=<ID=DUP,Description=\"Duplication\">\n" +
+	"##ALT=<ID=CNV,Description=\"Copy number variant (deletions and duplications in different samples)\">\n" +
+	"##ALT=<ID=CNLOH,Description=\"Copy neutral loss of heterozygosity\">\n" +
+	"##INFO=<ID=END,Number=1,Type=Integer,Description=\"End position of the variant\">\n" +
+	"##INFO=<ID=SVLEN,Number=1,Type=Integer,Description=\"Length of the variant, negative for deletions\">\n" +
+	"##INFO=<ID=SVTYPE,Number=1,Type=String,Description=\"Type of structural variant\">\n" +
+	"##INFO=<ID=NMARKERS,Number=1,Type=Integer,Description=\"Number of array markers in the variant\">\n" +
+	"##INFO=<ID=CF,Number=1,Type=Float,Description=\"Mean cell fraction of carriers\">\n" +
+	"##INFO=<ID=NCARRIERS,Number=1,Type=Integer,Description=\"Number of samples carrying the variant\">\n" +
+	"##FORMAT=<ID=GT,Number=1,Type=String,Description=\"Genotype\">\n" +
+	"##FORMAT=<ID=CN,Number=1,Type=Integer,Description=\"Copy number\">\n" +
+	"##FORMAT=<ID=CF,Number=1,Type=Float,Description=\"Fraction of cells carrying the variant\">\n" +
+	"##FORMAT=<ID=LLR,Number=1,Type=Float,Description=\"Log likelihood ratio of the call against the copy neutral state\">\n" +
+	"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT"
+
+type svKey struct {
+	chr   string
+	start int
+	end   int
+	cnloh bool
+}
+
+// WriteVcf writes calls as VCF 4.2 symbolic SV records. Calls with identical breakpoints are merged
+// into one multi-sample record. Deletions and duplications at the same breakpoints share a <CNV> record,
+// while CN-LOH calls get separate <CNLOH> records. samples lists the columns of the output, which
+// must include every sample with a call. Samples without a call overlapping a record are written as 0/0
+// with copy number 2, and samples with a call at different breakpoints overlapping the record are written
+// as missing. refBase returns the reference base at a 1-based position; if nil, REF is N. contigs holds the
+// chromosome lengths written in ##contig lines; chromosomes with records but no length get a ##contig line
+// without length. headerLines are added before the #CHROM line (e.g. ##source).
+func WriteVcf(out io.Writer, calls []Call, samples []string, refBase func(chr string, pos int) string, contigs map[string]int, headerLines ...string) {
+	sampleIdx := make(map[string]int, len(samples))
+	for i := range samples {
+		sampleIdx[samples[i]] = i
+	}
+	records := make(map[svKey][]Call)
+	intervals := make([]map[string][][2]int, len(samples))
+	var keys []svKey
+	var k svKey
+	var s int
+	var found bool
+	for _, c := range calls {
+		if c.Type == Neutral {
+			continue
+		}
+		if s, found = sampleIdx[c.Sample]; !found {
+			log.Fatalf("ERROR: sample %s has a call but is not in the sample list", c.Sample)
+		}
+		if intervals[s] == nil {
+			intervals[s] = make(map[string][][2]int)
+		}
+		intervals[s][c.Chr] = append(intervals[s][c.Chr], [2]int{c.Start, c.End})
+		k = svKey{chr: c.Chr, start: c.Start, end: c.End, cnloh: c.Type == CNLOH}
+		if _, found = records[k]; !found {
+			keys = append(keys, k)
+		}
+		records[k] = append(records[k], c)
+	}
+	called := make([]Regions, len(samples))
+	for i := range intervals {
+		called[i] = NewRegions(intervals[i])
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].chr != keys[j].chr {
+			return ChromLess(keys[i].chr, keys[j].chr)
+		}
+		if keys[i].start != keys[j].start {
+			return keys[i].start < keys[j].start
+		}
+		if keys[i].end != keys[j].end {
+			return keys[i].end < keys[j].end
+		}
+		return !keys[i].cnloh
+	})
+
+	headerLines = append(contigLines(keys, contigs), headerLines...)
+	header := vcfHeader
+	if len(headerLines) > 0 {
+		header = strings.Replace(header, "#CHROM", strings.Join(headerLines, "\n")+"\n#CHROM", 1)
+	}
+	_, err := fmt.Fprintf(out, "%s\t%s\n", header, strings.Join(samples, "\t"))
+	exception.PanicOnErr(err)
+	for _, k = range keys {
+		writeRecord(out, k, records[k], samples, sampleIdx, called, refBase)
+	}
+}
+
+// contigLines returns the ##contig lines of the chromosomes with lengths in contigs, and of the
+// chromosomes with records that are not in contigs, in natural chromosome order.
+func contigLines(keys []svKey, contigs map[string]int) []string {
+	var chroms []string
+	for chr := range contigs {
+		chroms = append(chroms, chr)
+	}
+	for i := range keys {
+		if _, found := contigs[keys[i].chr]; !found && (i == 0 || keys[i].chr != keys[i-1].chr) {
+			chroms = append(chroms, keys[i].chr)
+		}
+	}
+	sort.Slice(chroms, func(i, j int) bool { return ChromLess(chroms[i], chroms[j]) })
+	ans := make([]string, len(chroms))
+	for i, chr := range chroms {
+		if length, found := contigs[chr]; found {
+			ans[i] = fmt.Sprintf("##contig=<ID=%s,length=%d>", chr, length)
+		} else {
+			ans[i] = fmt.Sprintf("##contig=<ID=%s>", chr)
+		}
+	}
+	return ans
+}
+
+func writeRecord(out io.Writer, k svKey, calls []Call, samples []string, sampleIdx map[string]int, called []Regions, refBase func(chr string, pos int) string) {
+	var hasLoss, hasGain bool
+	var nMarkers int
+	var cfSum float64
+	var nCf int
+	for _, c := range calls {
+		hasLoss = hasLoss || c.Type == Loss
+		hasGain = hasGain || c.Type == Gain
+		if c.NMarkers > nMarkers {
+			nMarkers = c.NMarkers
+		}
+		if !math.IsNaN(c.CellFraction) {
+			cfSum += c.CellFraction
+			nCf++
+		}
+	}
+	var svType string
+	svLen := k.end - k.start
+	switch {
+	case k.cnloh:
+		svType = "CNLOH"
+	case hasLoss && hasGain:
+		svType = "CNV"
+	case hasLoss:
+		svType = "DEL"
+		svLen = -svLen
+	default:
+		svType = "DUP"
+	}
+
+	// POS is the base before the event (BED start), or the first base of the chromosome
+	pos := k.start
+	if pos < 1 {
+		pos = 1
+	}
+	ref := "N"
+	if refBase != nil {
+		ref = refBase(k.chr, pos)
+	}
+	info := fmt.Sprintf("END=%d;SVLEN=%d;SVTYPE=%s;NMARKERS=%d;NCARRIERS=%d", k.end, svLen, svType, nMarkers, len(calls))
+	if nCf > 0 {
+		info += fmt.Sprintf(";CF=%.4g", cfSum/float64(nCf))
+	}
+
+	fields := make([]string, len(samples))
+	for i := range fields {
+		if called[i].Overlap(k.chr, k.start, k.end) > 0 {
+			fields[i] = "./.:.:.:."
+		} else {
+			fields[i] = "0/0:2:.:."
+		}
+	}
+	for _, c := range calls {
+		fields[sampleIdx[c.Sample]] = sampleField(c, svType)
+	}
+	_, err := fmt.Fprintf(out, "%s\t%d\t%s_%d_%d_%s\t%s\t<%s>\t.\tPASS\t%s\tGT:CN:CF:LLR\t%s\n",
+		k.chr, pos, k.chr, pos, k.end, svType, ref, svType, info, strings.Join(fields, "\t"))
+	exception.PanicOnErr(err)
+}
+
+func sampleField(c Call, svType string) string {
+	var gt string
+	switch {
+	case svType == "CNV":
+		gt = "./."
+	case c.Type == Loss && c.HasCopyNumber && c.CopyNumber == 0:
+		gt = "1/1"
+	default:
+		gt = "0/1"
+	}
+	cn := "."
+	if c.HasCopyNumber {
+		cn = strconv.Itoa(c.CopyNumber)
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", gt, cn, formatDot(c.CellFraction, 4), formatDot(c.Score, 4))
+}
+
+func formatDot(f float64, prec int) string {
+	if math.IsNaN(f) {
+		return "."
+	}
+	return strconv.FormatFloat(f, 'g', prec, 64)
+}
+
+// ChromLess orders chromosomes naturally (1, 2, ..., 22, X, Y, M, then others lexically),
+// ignoring any 'chr' prefix.
+func ChromLess(a, b string) bool {
+	ra, rb := chromRank(a), chromRank(b)
+	if ra != rb {
+		return ra < rb
+	}
+	return a < b
+}
+
+func chromRank(chr string) int {
+	chr = strings.TrimPrefix(chr, "chr")
+	if n, err := strconv.Atoi(chr); err == nil {
+		return n
+	}
+	switch chr {
+	case "X":
+		return 1000
+	case "Y":
+		return 1001
+	case "M", "MT":
+		return 1002
+	default:
+		return 2000
+	}
+}
+
+// IsVcf returns true if the filename has a .vcf or .vcf.gz extension.
+func IsVcf(filename string) bool {
+	return strings.HasSuffix(filename, ".vcf") || strings.HasSuffix(filename, ".vcf.gz")
+}
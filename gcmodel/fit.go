@@ -0,0 +1,138 @@
+package gcmodel
+
+import "math"
+
+// Fit accumulates the least squares regression of LRR on the GC content of each window, with an
+// intercept, from a stream of markers in constant memory.
+type Fit struct {
+	xtx [][]float64 // first row and column are the intercept
+	xty []float64
+	n   int
+	row []float64
+}
+
+func NewFit(nWindows int) *Fit {
+	f := &Fit{xtx: make([][]float64, nWindows+1), xty: make([]float64, nWindows+1), row: make([]float64, nWindows+1)}
+	for i := range f.xtx {
+		f.xtx[i] = make([]float64, nWindows+1)
+	}
+	return f
+}
+
+// Add a marker. Markers with NaN LRR or GC are skipped.
+func (f *Fit) Add(lrr float64, gc []float32) {
+	if math.IsNaN(lrr) {
+		return
+	}
+	f.row[0] = 1
+	for i := range gc {
+		if math.IsNaN(float64(gc[i])) {
+			return
+		}
+		f.row[i+1] = float64(gc[i])
+	}
+	for i := range f.row {
+		for j := range f.row {
+			f.xtx[i][j] += f.row[i] * f.row[j]
+		}
+		f.xty[i] += f.row[i] * lrr
+	}
+	f.n++
+}
+
+// N returns the number of markers in the fit.
+func (f *Fit) N() int {
+	return f.n
+}
+
+// Correction removes the fitted GC effect from LRR.
+type Correction struct {
+	Coef   []float64 // change in LRR per unit GC in each window
+	MeanGc []float64 // mean GC of each window in the fitted markers
+}
+
+// minFitMarkers is the fewest markers needed for a correction.
+const minFitMarkers int = 100
+
+// ridge is added to the diagonal to keep the fit stable when windows are nearly collinear.
+const ridge float64 = 1e-6
+
+// Solve returns the correction and false if there were too few markers to fit.
+func (f *Fit) Solve() (Correction, bool) {
+	p := len(f.xty)
+	if f.n < minFitMarkers || f.n < 2*p {
+		return Correction{}, false
+	}
+	n := float64(f.n)
+	c := Correction{Coef: make([]float64, p-1), MeanGc: make([]float64, p-1)}
+	for i := 1; i < p; i++ {
+		c.MeanGc[i-1] = f.xtx[0][i] / n
+	}
+
+	// centered normal equations for the slopes
+	a := make([][]float64, p-1)
+	b := make([]float64, p-1)
+	meanLrr := f.xty[0] / n
+	for i := 1; i < p; i++ {
+		a[i-1] = make([]float64, p-1)
+		for j := 1; j < p; j++ {
+			a[i-1][j-1] = f.xtx[i][j]/n - c.MeanGc[i-1]*c.MeanGc[j-1]
+		}
+		a[i-1][i-1] += ridge
+		b[i-1] = f.xty[i]/n - c.MeanGc[i-1]*meanLrr
+	}
+	if !solve(a, b) {
+		return Correction{}, false
+	}
+	copy(c.Coef, b)
+	return c, true
+}
+
+// Adjust returns the LRR with the GC effect removed. The correction is centered on the mean GC of the
+// fitted markers so the LRR of a marker with average GC is unchanged. LRR is returned unchanged if any
+// GC value is NaN.
+func (c Correction) Adjust(lrr float64, gc []float32) float64 {
+	var effect float64
+	for i := range c.Coef {
+		if math.IsNaN(float64(gc[i])) {
+			return lrr
+		}
+		effect += c.Coef[i] * (float64(gc[i]) - c.MeanGc[i])
+	}
+	return lrr - effect
+}
+
+// solve solves a x = b by Gaussian elimination with partial pivoting, leaving x in b.
+// Returns false if a is singular.
+func solve(a [][]float64, b []float64) bool {
+	n := len(b)
+	var pivot int
+	var factor float64
+	for col := 0; col < n; col++ {
+		pivot = col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if a[pivot][col] == 0 {
+			return false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for row := col + 1; row < n; row++ {
+			factor = a[row][col] / a[col][col]
+			for j := col; j < n; j++ {
+				a[row][j] -= factor * a[col][j]
+			}
+			b[row] -= factor * b[col]
+		}
+	}
+	for row := n - 1; row >= 0; row-- {
+		for j := row + 1; j < n; j++ {
+			b[row] -= a[row][j] * b[j]
+		}
+		b[row] /= a[row][row]
+	}
+	return true
+}
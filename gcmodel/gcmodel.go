@@ -0,0 +1,237 @@
+// Package gcmodel computes the GC content of the reference genome around array markers in windows
+// of several sizes, and corrects LRR for GC waves by regression on these values.
+package gcmodel
+
+import (
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultWindows are the window sizes in bp used to model GC waves, from the probe to the megabase scale.
+var DefaultWindows = []int{50, 500, 5000, 50000, 1000000}
+
+// ParseWindows parses a comma separated list of window sizes in bp. Sizes must be positive and
+// may not be repeated, as each window is a column of the GC table.
+func ParseWindows(s string) []int {
+	var ans []int
+	seen := make(map[int]bool)
+	for _, w := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || i < 1 {
+			log.Fatalf("ERROR: could not parse window size '%s'", w)
+		}
+		if seen[i] {
+			log.Fatalf("ERROR: window size %d is given more than once", i)
+		}
+		seen[i] = true
+		ans = append(ans, i)
+	}
+	return ans
+}
+
+// JoinWindows formats window sizes as a comma separated list, the inverse of ParseWindows.
+func JoinWindows(windows []int) string {
+	s := make([]string, len(windows))
+	for i := range windows {
+		s[i] = strconv.Itoa(windows[i])
+	}
+	return strings.Join(s, ",")
+}
+
+// faiEntry is one line of a fasta index.
+type faiEntry struct {
+	length       int
+	offset       int64
+	basesPerLine int
+	bytesPerLine int
+}
+
+// Reference reads whole chromosomes from an indexed fasta file. Unlike gonomics fasta.Seeker, sequences
+// are returned as raw bytes so IUPAC ambiguity codes are allowed.
+type Reference struct {
+	file *os.File
+	idx  map[string]faiEntry
+}
+
+// OpenReference opens a fasta file with a .fai index at filename.fai.
+func OpenReference(filename string) *Reference {
+	r := &Reference{idx: make(map[string]faiEntry)}
+	var err error
+	r.file, err = os.Open(filename)
+	exception.PanicOnErr(err)
+
+	var words []string
+	var e faiEntry
+	index := fileio.EasyOpen(filename + ".fai")
+	for line, done := fileio.EasyNextRealLine(index); !done; line, done = fileio.EasyNextRealLine(index) {
+		words = strings.Split(line, "\t")
+		if len(words) < 5 {
+			log.Fatalf("ERROR: malformed fasta index %s.fai:\n%s", filename, line)
+		}
+		e.length = atoi(words[1], line)
+		e.offset = int64(atoi(words[2], line))
+		e.basesPerLine = atoi(words[3], line)
+		e.bytesPerLine = atoi(words[4], line)
+		r.idx[words[0]] = e
+	}
+	err = index.Close()
+	exception.PanicOnErr(err)
+	return r
+}
+
+func atoi(s string, line string) int {
+	ans, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("ERROR: could not parse '%s' as an integer in line:\n%s", s, line)
+	}
+	return ans
+}
+
+// Close the fasta file.
+func (r *Reference) Close() {
+	err := r.file.Close()
+	exception.PanicOnErr(err)
+}
+
+// Name returns the name of chr in the reference, adding or removing a 'chr' prefix if needed,
+// and false if the chromosome is not in the reference.
+func (r *Reference) Name(chr string) (string, bool) {
+	for _, name := range []string{chr, "chr" + chr, strings.TrimPrefix(chr, "chr")} {
+		if _, found := r.idx[name]; found {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Chrom returns the full sequence of a chromosome. The name must be as in the reference (see Name).
+func (r *Reference) Chrom(name string) []byte {
+	e, found := r.idx[name]
+	if !found {
+		log.Fatalf("ERROR: could not find sequence for fasta record '%s'", name)
+	}
+	nLines := (e.length + e.basesPerLine - 1) / e.basesPerLine
+	raw := make([]byte, nLines*e.bytesPerLine)
+	_, err := r.file.Seek(e.offset, io.SeekStart)
+	exception.PanicOnErr(err)
+	n, err := io.ReadFull(r.file, raw)
+	if err != nil && err != io.ErrUnexpectedEOF { // last line may not end in a newline
+		exception.PanicOnErr(err)
+	}
+	raw = raw[:n]
+	ans := make([]byte, 0, e.length)
+	for i := 0; i < len(raw) && len(ans) < e.length; i += e.bytesPerLine {
+		end := i + e.basesPerLine
+		if end > len(raw) {
+			end = len(raw)
+		}
+		ans = append(ans, raw[i:end]...)
+	}
+	if len(ans) > e.length {
+		ans = ans[:e.length]
+	}
+	return ans
+}
+
+// isGc and isAcgt classify bases. N and IUPAC ambiguity codes are neither.
+func isGc(b byte) bool {
+	return b == 'G' || b == 'C' || b == 'g' || b == 'c'
+}
+
+func isAcgt(b byte) bool {
+	switch b {
+	case 'A', 'C', 'G', 'T', 'a', 'c', 'g', 't':
+		return true
+	default:
+		return false
+	}
+}
+
+// WindowGc returns the GC fraction of the window of width bp centered on each 1-based position in pos,
+// which must be sorted. N and ambiguity codes are excluded from both the GC count and the denominator.
+// Windows without any unambiguous bases are NaN. Windows are truncated at the ends of the sequence.
+func WindowGc(seq []byte, pos []int, width int) []float64 {
+	ans := make([]float64, len(pos))
+	var lo, hi int // current window is seq[lo:hi]
+	var gc, acgt int
+	var start, end int
+	for i, p := range pos {
+		start = p - 1 - width/2
+		end = start + width
+		if start < 0 {
+			start = 0
+		}
+		if end > len(seq) {
+			end = len(seq)
+		}
+		if start >= hi { // no overlap with the previous window
+			lo, hi, gc, acgt = start, start, 0, 0
+		}
+		for ; hi < end; hi++ {
+			if isAcgt(seq[hi]) {
+				acgt++
+				if isGc(seq[hi]) {
+					gc++
+				}
+			}
+		}
+		for ; lo < start; lo++ {
+			if isAcgt(seq[lo]) {
+				acgt--
+				if isGc(seq[lo]) {
+					gc--
+				}
+			}
+		}
+		if acgt == 0 {
+			ans[i] = math.NaN()
+			continue
+		}
+		ans[i] = float64(gc) / float64(acgt)
+	}
+	return ans
+}
+
+// Table is the GC content of each window around each marker, indexed [marker][window].
+type Table [][]float32
+
+// Compute returns the GC content of each window around each marker. Markers are given as parallel
+// chromosome and position slices, sorted by position within each chromosome. Markers on chromosomes
+// not in the reference have NaN values.
+func Compute(ref *Reference, chr []string, pos []int, windows []int) Table {
+	ans := make(Table, len(pos))
+	for i := range ans {
+		ans[i] = make([]float32, len(windows))
+	}
+	var start int
+	for i := 1; i <= len(chr); i++ {
+		if i < len(chr) && chr[i] == chr[start] {
+			continue
+		}
+		name, found := ref.Name(chr[start])
+		if !found {
+			log.Printf("WARNING: %s is not in the reference. GC is missing for %d markers.", chr[start], i-start)
+			for m := start; m < i; m++ {
+				for w := range windows {
+					ans[m][w] = float32(math.NaN())
+				}
+			}
+			start = i
+			continue
+		}
+		seq := ref.Chrom(name)
+		for w := range windows {
+			for j, gc := range WindowGc(seq, pos[start:i], windows[w]) {
+				ans[start+j][w] = float32(gc)
+			}
+		}
+		start = i
+	}
+	return ans
+}
@@ -0,0 +1,102 @@
+package gcmodel
+
+import (
+	"fmt"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const gcPrefix string = "GC_"
+
+// WriteTable writes the GC content of each marker with one column per window (GC_<size>). Missing
+// values are written as NA.
+func WriteTable(filename string, chr, id []string, pos []int, windows []int, t Table) {
+	out := fileio.EasyCreate(filename)
+	_, err := fmt.Fprintf(out, "#CHROM\tPOS\tID\t%s\n", strings.Join(InfoKeys(windows), "\t"))
+	exception.PanicOnErr(err)
+	values := make([]string, len(windows))
+	for m := range t {
+		for w := range t[m] {
+			values[w] = formatGc(t[m][w])
+		}
+		_, err = fmt.Fprintf(out, "%s\t%d\t%s\t%s\n", chr[m], pos[m], id[m], strings.Join(values, "\t"))
+		exception.PanicOnErr(err)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+// ReadTable reads a file written by WriteTable.
+func ReadTable(filename string) (chr []string, pos []int, windows []int, t Table) {
+	var words []string
+	var f float64
+	var err error
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextLine(file); !done; line, done = fileio.EasyNextLine(file) {
+		words = strings.Split(line, "\t")
+		if strings.HasPrefix(line, "#") {
+			for _, key := range words[3:] {
+				windows = append(windows, atoi(strings.TrimPrefix(key, gcPrefix), line))
+			}
+			continue
+		}
+		if len(words) != 3+len(windows) {
+			log.Fatalf("ERROR: expected %d columns in %s:\n%s", 3+len(windows), filename, line)
+		}
+		chr = append(chr, words[0])
+		pos = append(pos, atoi(words[1], line))
+		row := make([]float32, len(windows))
+		for w := range row {
+			if words[3+w] == "NA" {
+				row[w] = float32(math.NaN())
+				continue
+			}
+			if f, err = strconv.ParseFloat(words[3+w], 64); err != nil {
+				log.Fatalf("ERROR: could not parse '%s' as a number in line:\n%s", words[3+w], line)
+			}
+			row[w] = float32(f)
+		}
+		t = append(t, row)
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return chr, pos, windows, t
+}
+
+// WritePennCnv writes GC content in the PennCNV .gcmodel layout (Name, Chr, Position, GC percent) for use
+// with 'detect_cnv.pl -gcmodel'. Chromosomes are written without a 'chr' prefix and markers with missing
+// GC are skipped.
+func WritePennCnv(filename string, chr, id []string, pos []int, gc []float32) {
+	out := fileio.EasyCreate(filename)
+	_, err := fmt.Fprintln(out, "Name\tChr\tPosition\tGC")
+	exception.PanicOnErr(err)
+	for m := range gc {
+		if math.IsNaN(float64(gc[m])) {
+			continue
+		}
+		_, err = fmt.Fprintf(out, "%s\t%s\t%d\t%.3f\n", id[m], strings.TrimPrefix(chr[m], "chr"), pos[m], 100*gc[m])
+		exception.PanicOnErr(err)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+// InfoKeys returns the column and INFO names of the windows (GC_<size>).
+func InfoKeys(windows []int) []string {
+	ans := make([]string, len(windows))
+	for i := range windows {
+		ans[i] = gcPrefix + strconv.Itoa(windows[i])
+	}
+	return ans
+}
+
+func formatGc(f float32) string {
+	if math.IsNaN(float64(f)) {
+		return "NA"
+	}
+	return strconv.FormatFloat(float64(f), 'f', 4, 32)
+}
@@ -0,0 +1,244 @@
+package germline
+
+import (
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"math"
+)
+
+const (
+	lrrOutlierDensity float64 = 0.25 // uniform over an LRR range of 4
+	minPfb            float64 = 0.01
+	toNormal          float64 = 0.9 // fraction of transitions out of an abnormal state that return to normal
+)
+
+func normal(x, mu, sd float64) float64 {
+	z := (x - mu) / sd
+	return math.Exp(-0.5*z*z) / (sd * math.Sqrt(2*math.Pi))
+}
+
+// bafDensity returns the density of BAF under a state. Genotypes with k of c copies carrying the
+// B allele are weighted by their binomial probability given the marker PFB. Homozygous clusters are
+// half-normal since BAF is bounded by 0 and 1.
+func (m Model) bafDensity(baf, pfb float64, s State) float64 {
+	c := s.CopyNumber()
+	if c == 0 {
+		return 1
+	}
+	if s == CN2LOH {
+		return (1-pfb)*2*normal(baf, 0, m.BafHomSd) + pfb*2*normal(baf, 1, m.BafHomSd)
+	}
+	var ans, w float64
+	for k := 0; k <= c; k++ {
+		w = binom(c, k) * math.Pow(pfb, float64(k)) * math.Pow(1-pfb, float64(c-k))
+		if k == 0 || k == c {
+			ans += w * 2 * normal(baf, float64(k)/float64(c), m.BafHomSd)
+		} else {
+			ans += w * normal(baf, float64(k)/float64(c), m.BafHetSd)
+		}
+	}
+	return ans
+}
+
+func binom(n, k int) float64 {
+	ans := 1.0
+	for i := 1; i <= k; i++ {
+		ans *= float64(n-k+i) / float64(i)
+	}
+	return ans
+}
+
+// Emission returns the log likelihood of a marker in state s. Missing LRR or BAF (NaN) are
+// skipped. A NaN pfb marks a non-polymorphic marker for which BAF is not used.
+func (m Model) Emission(lrr, baf, pfb float64, s State) float64 {
+	var ans float64
+	if !math.IsNaN(lrr) {
+		ans += math.Log((1-m.Outlier)*normal(lrr, m.LrrMean[s], m.LrrSd[s]) + m.Outlier*lrrOutlierDensity)
+	}
+	if !math.IsNaN(baf) && !math.IsNaN(pfb) {
+		pfb = math.Min(math.Max(pfb, minPfb), 1-minPfb)
+		baf = math.Min(math.Max(baf, 0), 1)
+		ans += math.Log((1-m.Outlier)*m.bafDensity(baf, pfb, s) + m.Outlier)
+	}
+	return ans
+}
+
+// transitions returns log transition probabilities between markers dist bp apart.
+func (m Model) transitions(dist int) [NStates][NStates]float64 {
+	var ans [NStates][NStates]float64
+	f := 1 - math.Exp(-float64(dist)/m.Dist)
+	var leave, abnormalPrior float64
+	for j := 0; j < NStates; j++ {
+		if State(j) != CN2 {
+			abnormalPrior += m.Prior[j]
+		}
+	}
+	for i := 0; i < NStates; i++ {
+		if State(i) == CN2 {
+			leave = m.NormalLeave * f
+			for j := 0; j < NStates; j++ {
+				if i != j {
+					ans[i][j] = leave * m.Prior[j] / abnormalPrior
+				}
+			}
+		} else {
+			leave = m.EventLeave * f
+			for j := 0; j < NStates; j++ {
+				switch {
+				case i == j:
+				case State(j) == CN2:
+					ans[i][j] = leave * toNormal
+				default:
+					ans[i][j] = leave * (1 - toNormal) * m.Prior[j] / (abnormalPrior - m.Prior[i])
+				}
+			}
+		}
+		ans[i][i] = 1 - leave
+		for j := 0; j < NStates; j++ {
+			ans[i][j] = math.Log(ans[i][j])
+		}
+	}
+	return ans
+}
+
+// Viterbi returns the most likely state of each marker on one chromosome.
+func (m Model) Viterbi(pos []int, lrr, baf, pfb []float64) []State {
+	if len(pos) == 0 {
+		return nil
+	}
+	var prev, curr [NStates]float64
+	back := make([][NStates]State, len(pos))
+	var trans [NStates][NStates]float64
+	var i, j, k int
+	var s float64
+	for j = 0; j < NStates; j++ {
+		prev[j] = math.Log(m.Prior[j]) + m.Emission(lrr[0], baf[0], pfb[0], State(j))
+	}
+	for i = 1; i < len(pos); i++ {
+		trans = m.transitions(pos[i] - pos[i-1])
+		for j = 0; j < NStates; j++ {
+			curr[j] = math.Inf(-1)
+			for k = 0; k < NStates; k++ {
+				if s = prev[k] + trans[k][j]; s > curr[j] {
+					curr[j] = s
+					back[i][j] = State(k)
+				}
+			}
+			curr[j] += m.Emission(lrr[i], baf[i], pfb[i], State(j))
+		}
+		prev = curr
+	}
+
+	path := make([]State, len(pos))
+	for j = 1; j < NStates; j++ {
+		if prev[j] > prev[path[len(path)-1]] {
+			path[len(path)-1] = State(j)
+		}
+	}
+	for i = len(path) - 1; i > 0; i-- {
+		path[i-1] = back[i][path[i]]
+	}
+	return path
+}
+
+// CallChrom returns deletions and duplications on one chromosome of one sample with at least
+// minMarkers markers. Runs of the CN2LOH state are not reported. Score is the log likelihood
+// ratio of the called state against the normal state over the markers in the call.
+func (m Model) CallChrom(sample, chr string, pos []int, lrr, baf, pfb []float64, minMarkers int) []cnv.Call {
+	path := m.Viterbi(pos, lrr, baf, pfb)
+	var ans []cnv.Call
+	var c cnv.Call
+	var start int
+	for i := 1; i <= len(path); i++ {
+		if i < len(path) && path[i] == path[start] {
+			continue
+		}
+		if path[start] != CN2 && path[start] != CN2LOH && i-start >= minMarkers {
+			c = cnv.Call{Sample: sample, Chr: chr, Start: pos[start] - 1, End: pos[i-1], NMarkers: i - start,
+				CopyNumber: path[start].CopyNumber(), HasCopyNumber: true, CellFraction: 1}
+			if c.CopyNumber < 2 {
+				c.Type = cnv.Loss
+			} else {
+				c.Type = cnv.Gain
+			}
+			for k := start; k < i; k++ {
+				c.Score += m.Emission(lrr[k], baf[k], pfb[k], path[start]) - m.Emission(lrr[k], baf[k], pfb[k], CN2)
+			}
+			ans = append(ans, c)
+		}
+		start = i
+	}
+	return ans
+}
+
+// Trainer re-estimates emission parameters from decoded paths (Viterbi training).
+type Trainer struct {
+	n       [NStates]int
+	sum     [NStates]float64
+	sumSq   [NStates]float64
+	hetSq   float64
+	nHet    int
+	homSq   float64
+	nHom    int
+	nMarker int
+}
+
+// minTrain is the minimum number of markers in a state for its LRR parameters to be updated.
+const minTrain int = 100
+
+// Add the markers of one chromosome of one sample with their decoded states.
+func (t *Trainer) Add(path []State, lrr, baf, pfb []float64) {
+	var dev float64
+	for i := range path {
+		t.nMarker++
+		if !math.IsNaN(lrr[i]) {
+			t.n[path[i]]++
+			t.sum[path[i]] += lrr[i]
+			t.sumSq[path[i]] += lrr[i] * lrr[i]
+		}
+		if path[i] != CN2 || math.IsNaN(baf[i]) || math.IsNaN(pfb[i]) {
+			continue
+		}
+		switch {
+		case baf[i] < 0.25:
+			t.homSq += baf[i] * baf[i]
+			t.nHom++
+		case baf[i] > 0.75:
+			t.homSq += (1 - baf[i]) * (1 - baf[i])
+			t.nHom++
+		default:
+			dev = baf[i] - 0.5
+			t.hetSq += dev * dev
+			t.nHet++
+		}
+	}
+}
+
+// Update returns m with LRR means and standard deviations of each state, BAF cluster spreads, and
+// state priors re-estimated from the added paths. The CN2LOH state shares the LRR parameters of CN2.
+// States with too few markers keep their current parameters.
+func (t *Trainer) Update(m Model) Model {
+	var mean, total float64
+	for s := 0; s < NStates && t.nMarker > 0; s++ {
+		m.Prior[s] = math.Max(float64(t.n[s])/float64(t.nMarker), DefaultModel.Prior[s]/10)
+		total += m.Prior[s]
+	}
+	for s := 0; s < NStates; s++ {
+		if total > 0 {
+			m.Prior[s] /= total
+		}
+		if t.n[s] < minTrain || State(s) == CN2LOH {
+			continue
+		}
+		mean = t.sum[s] / float64(t.n[s])
+		m.LrrMean[s] = mean
+		m.LrrSd[s] = math.Sqrt(t.sumSq[s]/float64(t.n[s]) - mean*mean)
+	}
+	m.LrrMean[CN2LOH], m.LrrSd[CN2LOH] = m.LrrMean[CN2], m.LrrSd[CN2]
+	if t.nHet >= minTrain {
+		m.BafHetSd = math.Sqrt(t.hetSq / float64(t.nHet))
+	}
+	if t.nHom >= minTrain {
+		m.BafHomSd = math.Sqrt(t.homSq / float64(t.nHom))
+	}
+	return m
+}
@@ -0,0 +1,150 @@
+// Package germline calls germline copy number variants from array LRR and BAF with a PennCNV-style
+// hidden Markov model: per-copy-number emission models that account for the population B allele
+// frequency (PFB) of each marker and transitions that depend on the distance between markers.
+package germline
+
+import (
+	"fmt"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// State is a hidden copy number state.
+type State int
+
+const (
+	CN0     State = iota // homozygous deletion
+	CN1                  // single copy deletion
+	CN2                  // normal
+	CN2LOH               // copy neutral loss of heterozygosity
+	CN3                  // single copy duplication
+	CN4                  // double copy duplication
+	NStates int   = 6
+)
+
+var copyNumbers = [NStates]int{0, 1, 2, 2, 3, 4}
+
+// CopyNumber returns the total copy number of the state.
+func (s State) CopyNumber() int {
+	return copyNumbers[s]
+}
+
+func (s State) String() string {
+	if s == CN2LOH {
+		return "CN2LOH"
+	}
+	return fmt.Sprintf("CN%d", s.CopyNumber())
+}
+
+// Model holds the emission and transition parameters of the HMM.
+type Model struct {
+	LrrMean     [NStates]float64
+	LrrSd       [NStates]float64
+	BafHetSd    float64 // sd of BAF around heterozygous clusters (e.g. 0.5, 1/3)
+	BafHomSd    float64 // sd of BAF of homozygous genotypes from 0 or 1
+	Outlier     float64 // probability of an outlier marker under any state
+	Prior       [NStates]float64
+	NormalLeave float64 // probability of leaving the normal state between distant markers
+	EventLeave  float64 // probability of leaving an abnormal state between distant markers
+	Dist        float64 // distance scale (bp) of transitions. Nearby markers rarely change state.
+}
+
+// DefaultModel has emission parameters similar to the PennCNV model for Illumina arrays.
+var DefaultModel = Model{
+	LrrMean:     [NStates]float64{-3.527, -0.664, 0, 0, 0.395, 0.678},
+	LrrSd:       [NStates]float64{1.329, 0.284, 0.159, 0.159, 0.209, 0.181},
+	BafHetSd:    0.035,
+	BafHomSd:    0.016,
+	Outlier:     0.01,
+	Prior:       [NStates]float64{0.0001, 0.001, 0.9969, 0.001, 0.001, 0.0001},
+	NormalLeave: 1e-4,
+	EventLeave:  0.1,
+	Dist:        100000,
+}
+
+// WriteModel writes a model as a tab separated file that can be read by ReadModel.
+func WriteModel(filename string, m Model) {
+	out := fileio.EasyCreate(filename)
+	writeRow := func(key string, values ...float64) {
+		words := make([]string, len(values))
+		for i := range values {
+			words[i] = strconv.FormatFloat(values[i], 'g', 6, 64)
+		}
+		_, err := fmt.Fprintf(out, "%s\t%s\n", key, strings.Join(words, "\t"))
+		exception.PanicOnErr(err)
+	}
+	_, err := fmt.Fprintln(out, "#PARAMETER\tCN0\tCN1\tCN2\tCN2LOH\tCN3\tCN4")
+	exception.PanicOnErr(err)
+	writeRow("LRR_MEAN", m.LrrMean[:]...)
+	writeRow("LRR_SD", m.LrrSd[:]...)
+	writeRow("PRIOR", m.Prior[:]...)
+	writeRow("BAF_HET_SD", m.BafHetSd)
+	writeRow("BAF_HOM_SD", m.BafHomSd)
+	writeRow("OUTLIER", m.Outlier)
+	writeRow("NORMAL_LEAVE", m.NormalLeave)
+	writeRow("EVENT_LEAVE", m.EventLeave)
+	writeRow("DIST", m.Dist)
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+// ReadModel reads a model written by WriteModel. Parameters missing from the file keep their default values.
+func ReadModel(filename string) Model {
+	m := DefaultModel
+	file := fileio.EasyOpen(filename)
+	var words []string
+	var values []float64
+	var err error
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		words = strings.Split(line, "\t")
+		values = make([]float64, len(words)-1)
+		for i := range values {
+			values[i], err = strconv.ParseFloat(words[i+1], 64)
+			if err != nil {
+				log.Fatalf("ERROR: could not parse value in model file %s:\n%s", filename, line)
+			}
+		}
+		switch words[0] {
+		case "LRR_MEAN":
+			copy(m.LrrMean[:], perState(values, line))
+		case "LRR_SD":
+			copy(m.LrrSd[:], perState(values, line))
+		case "PRIOR":
+			copy(m.Prior[:], perState(values, line))
+		case "BAF_HET_SD":
+			m.BafHetSd = single(values, line)
+		case "BAF_HOM_SD":
+			m.BafHomSd = single(values, line)
+		case "OUTLIER":
+			m.Outlier = single(values, line)
+		case "NORMAL_LEAVE":
+			m.NormalLeave = single(values, line)
+		case "EVENT_LEAVE":
+			m.EventLeave = single(values, line)
+		case "DIST":
+			m.Dist = single(values, line)
+		default:
+			log.Fatalf("ERROR: unrecognized parameter '%s' in model file %s", words[0], filename)
+		}
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return m
+}
+
+func perState(values []float64, line string) []float64 {
+	if len(values) != NStates {
+		log.Fatalf("ERROR: expected %d values in model file line:\n%s", NStates, line)
+	}
+	return values
+}
+
+func single(values []float64, line string) float64 {
+	if len(values) != 1 {
+		log.Fatalf("ERROR: expected 1 value in model file line:\n%s", line)
+	}
+	return values[0]
+}
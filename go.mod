@@ -4,4 +4,4 @@ go 1.18
 
 require github.com/vertgenlab/gonomics v0.0.0-20220504163957-e1ca4e90d696
 
-require golang.org/x/exp v0.0.0-20220314205449-43aec2f8a4e7 // indirect
+require golang.org/x/exp v0.0.0-20220314205449-43aec2f8a4e7
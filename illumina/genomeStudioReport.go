@@ -2,7 +2,6 @@ package illumina
 
 import (
 	"github.com/vertgenlab/gonomics/exception"
-	"github.com/vertgenlab/gonomics/fileio"
 	"log"
 	"strconv"
 	"strings"
@@ -28,64 +27,120 @@ type GsReport struct {
 	BAlleleFreq   float64
 	LogRRatio     float64
 	ReportedAsFwd bool
+	Record        int   // number of data records in the report up to and including this one
+	Offset        int64 // uncompressed byte offset of the end of the record in the report
+}
+
+// ResumePoint is the position in a report after a record that was read, used to continue reading after it.
+type ResumePoint struct {
+	Record int    // number of data records read
+	Offset int64  // uncompressed byte offset of the end of the last record read
+	Marker string // name of the last record read, checked when records are skipped
+}
+
+// ResumePoint returns the position in the report after gs.
+func (gs GsReport) ResumePoint() ResumePoint {
+	return ResumePoint{Record: gs.Record, Offset: gs.Offset, Marker: gs.Marker}
 }
 
 func GoReadGsReportToChan(filename string) <-chan GsReport {
-	ans := make(chan GsReport, 100)
-	go readReportToChan(filename, ans)
+	return GoReadGsReportToChanBuffered(filename, 100)
+}
+
+// GoReadGsReportToChanBuffered reads a report with up to buffer records read ahead, which bounds the memory
+// used by each open report.
+func GoReadGsReportToChanBuffered(filename string, buffer int) <-chan GsReport {
+	ans := make(chan GsReport, buffer)
+	go readReportToChan(filename, ans, ResumePoint{}, false)
 	return ans
 }
 
-func readReportToChan(filename string, ans chan<- GsReport) {
-	file := fileio.EasyOpen(filename)
+// GoReadGsReportResume continues reading a report after the record at resume. If seek is true reading
+// continues at resume.Offset, which requires the report to be unchanged since resume was recorded.
+// Otherwise the first resume.Record records are read again and skipped, which allows a report that was
+// repaired or exported again, and the last of them must be resume.Marker.
+func GoReadGsReportResume(filename string, buffer int, resume ResumePoint, seek bool) <-chan GsReport {
+	ans := make(chan GsReport, buffer)
+	go readReportToChan(filename, ans, resume, seek)
+	return ans
+}
+
+func readReportToChan(filename string, ans chan<- GsReport, resume ResumePoint, seek bool) {
+	file := openReport(filename)
 	var gs GsReport
+	var record int
 	var processFunc func(string) GsReport
-	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+	for line, done := file.nextLine(); !done; line, done = file.nextLine() {
 		line = strings.TrimRight(line, "\t") // remove trailing tab
 		if strings.HasPrefix(line, "SNP Name") || strings.HasPrefix(line, "sample.id") {
-			if strings.Contains(line, ".") {
-				words := strings.Split(line, "\t")
-				for i := range words {
-					if !strings.Contains(words[i], ".") {
-						continue
-					}
-					words[i] = strings.Split(words[i], ".")[1]
-				}
-				line = strings.Join(words, "\t")
-			}
-			switch line {
-			case gsHeader1:
-				processFunc = processGsHeader1
-			case gsHeader2:
-				processFunc = processGsHeader2
-			case gsHeader3:
-				processFunc = processGsHeader3
-			case gsHeader4:
-				processFunc = processGsHeader1
-			case gsHeader5:
-				processFunc = processGsHeader5
-			case gsHeader6:
-				processFunc = processGsHeader6
-			case gsHeader7:
-				processFunc = processGsHeader7
-			case gsHeader8:
-				processFunc = processGsHeader8
-			default:
-				log.Fatalf("ERROR: unexpected report header. check file.\n%v\n%v", line)
+			processFunc = headerFunc(line)
+			if seek && resume.Record > 0 {
+				file.seek(resume.Offset)
+				record = resume.Record
 			}
 			continue
 		}
+		record++
+		if record < resume.Record {
+			continue
+		}
 		gs = processFunc(line)
+		if record == resume.Record {
+			if !seek && !strings.EqualFold(gs.Marker, resume.Marker) {
+				log.Fatalf("ERROR: record %d of %s is %s, but %s was read there before. The report must have the same markers in the same order to resume",
+					record, filename, gs.Marker, resume.Marker)
+			}
+			continue
+		}
 		if strings.ToLower(gs.Chrom) == "mt" {
 			gs.Chrom = "M"
 		}
+		gs.Record = record
+		gs.Offset = file.offset
 		ans <- gs
 	}
-	err := file.Close()
-	exception.PanicOnErr(err)
+	if record < resume.Record {
+		log.Fatalf("ERROR: %s has %d records, but %d were read before", filename, record, resume.Record)
+	}
+	file.close()
 	close(ans)
 }
 
+// headerFunc returns the function parsing the records of a report with the given header line.
+func headerFunc(line string) func(string) GsReport {
+	if strings.Contains(line, ".") {
+		words := strings.Split(line, "\t")
+		for i := range words {
+			if !strings.Contains(words[i], ".") {
+				continue
+			}
+			words[i] = strings.Split(words[i], ".")[1]
+		}
+		line = strings.Join(words, "\t")
+	}
+	switch line {
+	case gsHeader1:
+		return processGsHeader1
+	case gsHeader2:
+		return processGsHeader2
+	case gsHeader3:
+		return processGsHeader3
+	case gsHeader4:
+		return processGsHeader1
+	case gsHeader5:
+		return processGsHeader5
+	case gsHeader6:
+		return processGsHeader6
+	case gsHeader7:
+		return processGsHeader7
+	case gsHeader8:
+		return processGsHeader8
+	default:
+		log.Fatalf("ERROR: unexpected report header. check file.\n%v", line)
+	}
+	return nil
+}
+
 func processGsHeader1(s string) GsReport {
 	var ans GsReport
 	var err error
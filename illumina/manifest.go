@@ -4,6 +4,7 @@ import (
 	"github.com/vertgenlab/gonomics/exception"
 	"github.com/vertgenlab/gonomics/fileio"
 	"log"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -31,7 +32,7 @@ type Manifest struct {
 	GenomeBuild  string
 	Chr          string
 	Pos          int
-	GC           float64
+	GC           float64 // GC fraction of the probe context, NaN if it has no unambiguous bases
 }
 
 func GoReadManifestToChan(filename string) <-chan Manifest {
@@ -122,16 +123,18 @@ func processManifestLine(s string) Manifest {
 			totalCount++
 		case 'T', 'A':
 			totalCount++
-		default:
-			totalCount++
-			//log.Panicf("ERROR: Unknown base in '%s'. Check following line\n%s\n", seqContext, s) // they throw Y's and shit in there
+		default: // N and IUPAC ambiguity codes (e.g. Y, R) are excluded from the denominator
 		}
 	}
-	ans.GC = float64(gcCount) / float64(totalCount)
+	ans.GC = math.NaN()
+	if totalCount > 0 {
+		ans.GC = float64(gcCount) / float64(totalCount)
+	}
 	return ans
 }
 
-func revComp(base string) string {
+// RevComp returns the reverse complement of an allele or sequence. Bases other than A, C, G, and T are kept.
+func RevComp(base string) string {
 	ans := make([]byte, len(base))
 	var j int
 	for i := len(base) - 1; i >= 0; i-- {
@@ -152,3 +155,23 @@ func revComp(base string) string {
 	}
 	return string(ans)
 }
+
+func ManifestGenomeBuild(filename string) string {
+	file := fileio.EasyOpen(filename)
+	defer file.Close()
+	var throughHeader bool
+	var m Manifest
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		if strings.HasPrefix(line, "[Controls]") {
+			break
+		}
+		if throughHeader {
+			if m = processManifestLine(line); m.Chr != "" {
+				return m.GenomeBuild
+			}
+			continue
+		}
+		throughHeader = strings.HasPrefix(line, "IlmnID")
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package illumina
+
+import (
+	"bufio"
+	"compress/gzip"
+	"github.com/vertgenlab/gonomics/exception"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// reportReader reads the lines of a report and keeps the uncompressed byte offset of the next line.
+type reportReader struct {
+	name   string
+	file   *os.File
+	gz     *gzip.Reader
+	reader *bufio.Reader
+	offset int64
+}
+
+func openReport(filename string) *reportReader {
+	var err error
+	r := &reportReader{name: filename}
+	r.file, err = os.Open(filename)
+	exception.PanicOnErr(err)
+	if strings.HasSuffix(filename, ".gz") {
+		r.gz, err = gzip.NewReader(r.file)
+		if err != nil {
+			log.Fatalf("ERROR: could not read %s as gzip: %v", filename, err)
+		}
+		r.reader = bufio.NewReader(r.gz)
+	} else {
+		r.reader = bufio.NewReader(r.file)
+	}
+	return r
+}
+
+// nextLine returns the next line that does not begin with '#'. Returns true at EOF. A report that ends
+// without a newline or cannot be decompressed is truncated or corrupt, which is fatal.
+func (r *reportReader) nextLine() (string, bool) {
+	var line string
+	var err error
+	for {
+		line, err = r.reader.ReadString('\n')
+		r.offset += int64(len(line))
+		switch {
+		case err == io.EOF && line == "":
+			return "", true
+		case err == io.EOF:
+			log.Fatalf("ERROR: %s is truncated, the last line has no newline (byte %d):\n%s", r.name, r.offset, line)
+		case err != nil:
+			log.Fatalf("ERROR: %s is truncated or corrupt after byte %d: %v", r.name, r.offset, err)
+		}
+		if !strings.HasPrefix(line, "#") {
+			return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), false
+		}
+	}
+}
+
+// seek moves to offset, which must not be before the current offset. Uncompressed reports are seeked
+// directly and gzipped reports are decompressed up to offset.
+func (r *reportReader) seek(offset int64) {
+	if offset < r.offset {
+		log.Panicf("ERROR: cannot seek %s back to byte %d from %d", r.name, offset, r.offset)
+	}
+	var err error
+	if r.gz == nil {
+		_, err = r.file.Seek(offset, io.SeekStart)
+		exception.PanicOnErr(err)
+		r.reader.Reset(r.file)
+	} else {
+		_, err = io.CopyN(io.Discard, r.reader, offset-r.offset)
+		if err != nil {
+			log.Fatalf("ERROR: %s ends before byte %d: %v", r.name, offset, err)
+		}
+	}
+	r.offset = offset
+}
+
+func (r *reportReader) close() {
+	var err error
+	if r.gz != nil {
+		err = r.gz.Close()
+		exception.PanicOnErr(err)
+	}
+	err = r.file.Close()
+	exception.PanicOnErr(err)
+}
@@ -0,0 +1,237 @@
+// Package mosaic detects mosaic copy number gains, losses, and copy neutral loss of heterozygosity
+// from array LRR and heterozygous-site BAF using a hidden Markov model over a grid of cell fractions.
+package mosaic
+
+import (
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"math"
+)
+
+// Params of the mosaic HMM.
+type Params struct {
+	Compression  float64 // observed LRR = Compression * log2(copy ratio)
+	FractionStep float64 // spacing of the cell fraction grid for the HMM states
+	SwitchProb   float64 // per-marker probability of leaving the current state
+	Outlier      float64 // probability that a marker is an outlier under any state
+	MinMarkers   int     // minimum markers in a reported call
+	MinLlr       float64 // minimum log likelihood ratio against the copy neutral state
+}
+
+var DefaultParams = Params{
+	Compression:  0.5,
+	FractionStep: 0.05,
+	SwitchProb:   1e-6,
+	Outlier:      0.01,
+	MinMarkers:   10,
+	MinLlr:       20,
+}
+
+// Noise is the per-sample measurement noise of LRR and heterozygous BAF.
+type Noise struct {
+	LrrSd float64
+	BafSd float64
+}
+
+// EstimateNoise estimates LRR noise from the MAD of successive differences, which is robust to
+// copy number changes, and BAF noise from the MAD of heterozygous BAF (see signal.EstimateNoise).
+func EstimateNoise(lrr, baf []float64, het []bool) Noise {
+	var n Noise
+	n.LrrSd, n.BafSd = signal.EstimateNoise(lrr, baf, het)
+	return n
+}
+
+// NoiseAccumulator estimates the LRR median and Noise of one sample from a stream of markers
+// in constant memory, for inputs too large to load with signal.Read.
+type NoiseAccumulator struct {
+	lrr     *signal.Hist
+	lrrDiff *signal.Hist
+	hetDev  *signal.Hist
+	prevLrr float64
+}
+
+func NewNoiseAccumulator() *NoiseAccumulator {
+	return &NoiseAccumulator{
+		lrr:     signal.NewHist(-4, 4, 0.002),
+		lrrDiff: signal.NewHist(0, 4, 0.001),
+		hetDev:  signal.NewHist(0, 0.5, 0.0005),
+		prevLrr: math.NaN(),
+	}
+}
+
+// Add the next marker in position order.
+func (a *NoiseAccumulator) Add(lrr, baf float64, het bool) {
+	a.lrr.Add(lrr)
+	a.lrrDiff.Add(math.Abs(lrr - a.prevLrr))
+	a.prevLrr = lrr
+	if het {
+		a.hetDev.Add(math.Abs(baf - 0.5))
+	}
+}
+
+// LrrMedian returns the median LRR, or NaN if no markers had signal.
+func (a *NoiseAccumulator) LrrMedian() float64 {
+	return a.lrr.Median()
+}
+
+// Noise returns the same estimates as EstimateNoise, assuming differences of successive LRR
+// and heterozygous BAF are centered on 0 and 0.5.
+func (a *NoiseAccumulator) Noise() Noise {
+	n := Noise{LrrSd: 1.4826 * a.lrrDiff.Median() / math.Sqrt2, BafSd: 1.4826 * a.hetDev.Median()}
+	if math.IsNaN(n.LrrSd) || n.LrrSd < signal.MinSd {
+		n.LrrSd = signal.MinSd
+	}
+	if math.IsNaN(n.BafSd) || n.BafSd < signal.MinSd {
+		n.BafSd = signal.MinSd
+	}
+	return n
+}
+
+type state struct {
+	t      cnv.Type
+	f      float64
+	lrr    float64
+	bafDev float64
+}
+
+func makeStates(p Params) []state {
+	ans := []state{{t: cnv.Neutral}}
+	var s state
+	for _, t := range []cnv.Type{cnv.Loss, cnv.Gain, cnv.CNLOH} {
+		for f := p.FractionStep; f <= 1+1e-9; f += p.FractionStep {
+			s = state{t: t, f: math.Min(f, 1)}
+			s.lrr, s.bafDev = cnv.Expected(t, s.f, p.Compression)
+			ans = append(ans, s)
+		}
+	}
+	return ans
+}
+
+const lrrOutlierDensity float64 = 0.25 // uniform over an LRR range of 4
+
+func logNormal(x, mu, sd float64) float64 {
+	z := (x - mu) / sd
+	return -0.5*z*z - math.Log(sd) - 0.5*math.Log(2*math.Pi)
+}
+
+// emission returns the log likelihood of a marker given the expected LRR and BAF deviation.
+func emission(lrr, baf float64, het bool, expLrr, expDev float64, n Noise, outlier float64) float64 {
+	var ans float64
+	if !math.IsNaN(lrr) {
+		ans += math.Log((1-outlier)*math.Exp(logNormal(lrr, expLrr, n.LrrSd)) + outlier*lrrOutlierDensity)
+	}
+	if het && !math.IsNaN(baf) {
+		bands := 0.5*math.Exp(logNormal(baf, 0.5+expDev, n.BafSd)) + 0.5*math.Exp(logNormal(baf, 0.5-expDev, n.BafSd))
+		ans += math.Log((1-outlier)*bands + outlier)
+	}
+	return ans
+}
+
+// CallChrom returns mosaic events on one chromosome of one sample. LRR should be centered on
+// the sample median. het marks markers with heterozygous genotypes.
+func CallChrom(sample, chr string, pos []int, lrr, baf []float64, het []bool, n Noise, p Params) []cnv.Call {
+	if len(pos) == 0 {
+		return nil
+	}
+	states := makeStates(p)
+	path := viterbi(states, lrr, baf, het, n, p)
+
+	var ans []cnv.Call
+	var start int
+	for i := 1; i <= len(path); i++ {
+		if i < len(path) && states[path[i]].t == states[path[start]].t {
+			continue
+		}
+		if states[path[start]].t != cnv.Neutral {
+			if c, ok := makeCall(sample, chr, pos, lrr, baf, het, start, i, states[path[start]].t, n, p); ok {
+				ans = append(ans, c)
+			}
+		}
+		start = i
+	}
+	return ans
+}
+
+func viterbi(states []state, lrr, baf []float64, het []bool, n Noise, p Params) []int {
+	stay := math.Log(1 - p.SwitchProb)
+	move := math.Log(p.SwitchProb / float64(len(states)-1))
+	prev := make([]float64, len(states))
+	curr := make([]float64, len(states))
+	back := make([][]uint8, len(lrr))
+
+	var bestPrev, j, i int
+	for j = range states {
+		prev[j] = emission(lrr[0], baf[0], het[0], states[j].lrr, states[j].bafDev, n, p.Outlier)
+		if j != 0 {
+			prev[j] += move // start in the neutral state
+		}
+	}
+	for i = 1; i < len(lrr); i++ {
+		bestPrev = argmax(prev)
+		back[i] = make([]uint8, len(states))
+		for j = range states {
+			if prev[j]+stay >= prev[bestPrev]+move {
+				curr[j] = prev[j] + stay
+				back[i][j] = uint8(j)
+			} else {
+				curr[j] = prev[bestPrev] + move
+				back[i][j] = uint8(bestPrev)
+			}
+			curr[j] += emission(lrr[i], baf[i], het[i], states[j].lrr, states[j].bafDev, n, p.Outlier)
+		}
+		prev, curr = curr, prev
+	}
+
+	path := make([]int, len(lrr))
+	path[len(path)-1] = argmax(prev)
+	for i = len(path) - 1; i > 0; i-- {
+		path[i-1] = int(back[i][path[i]])
+	}
+	return path
+}
+
+func argmax(x []float64) int {
+	var ans int
+	for i := range x {
+		if x[i] > x[ans] {
+			ans = i
+		}
+	}
+	return ans
+}
+
+const fineFractionStep float64 = 0.01
+
+// makeCall re-estimates the cell fraction of markers [start, end) on a fine grid and scores the
+// segment against the copy neutral state.
+func makeCall(sample, chr string, pos []int, lrr, baf []float64, het []bool, start, end int, t cnv.Type, n Noise, p Params) (cnv.Call, bool) {
+	c := cnv.Call{Sample: sample, Chr: chr, Start: pos[start] - 1, End: pos[end-1], NMarkers: end - start, Type: t}
+	if c.NMarkers < p.MinMarkers {
+		return c, false
+	}
+	c.CellFraction, c.Score = FitFraction(lrr[start:end], baf[start:end], het[start:end], t, n, p)
+	return c, c.Score >= p.MinLlr
+}
+
+// FitFraction returns the maximum likelihood cell fraction for an event of type t over a set of
+// markers and the log likelihood ratio of that fit against the copy neutral state.
+func FitFraction(lrr, baf []float64, het []bool, t cnv.Type, n Noise, p Params) (frac, llr float64) {
+	var neutral float64
+	for i := range lrr {
+		neutral += emission(lrr[i], baf[i], het[i], 0, 0, n, p.Outlier)
+	}
+	best := math.Inf(-1)
+	var ll, expLrr, expDev float64
+	for f := fineFractionStep; f <= 1+1e-9; f += fineFractionStep {
+		expLrr, expDev = cnv.Expected(t, f, p.Compression)
+		ll = 0
+		for i := range lrr {
+			ll += emission(lrr[i], baf[i], het[i], expLrr, expDev, n, p.Outlier)
+		}
+		if ll > best {
+			best = ll
+			frac = math.Min(f, 1)
+		}
+	}
+	return frac, best - neutral
+}
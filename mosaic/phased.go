@@ -0,0 +1,162 @@
+package mosaic
+
+import (
+	"github.com/dasnellings/PGC_mCNV/cnv"
+	"math"
+)
+
+// CallPhased returns mosaic events on one chromosome of one sample from phased BAF (pBAF), the
+// fraction of the allele on the first haplotype minus 0.5 at phased heterozygous sites.
+// An imbalance between haplotypes shifts pBAF consistently to one side along a haplotype, so runs are
+// detected with an HMM whose states are a grid of signed deviations. phaseErr is the per-site
+// probability of a phase switch error, which flips the sign of the deviation within an event.
+// pbaf is NaN at sites that are not phased heterozygotes. LRR, centered on the sample median, is
+// used to classify each run as a loss, gain, or CN-LOH and to estimate its cell fraction.
+func CallPhased(sample, chr string, pos []int, pbaf, lrr []float64, n Noise, p Params, phaseErr float64) []cnv.Call {
+	if len(pos) == 0 {
+		return nil
+	}
+	devs := makeDevs(p)
+	path := viterbiPhased(devs, pbaf, n, p, phaseErr)
+
+	var ans []cnv.Call
+	var start int
+	for i := 1; i <= len(path); i++ {
+		if i < len(path) && (devs[path[i]] == 0) == (devs[path[start]] == 0) {
+			continue
+		}
+		if devs[path[start]] != 0 {
+			if c, ok := makePhasedCall(sample, chr, pos, pbaf, lrr, devs, path, start, i, n, p); ok {
+				ans = append(ans, c)
+			}
+		}
+		start = i
+	}
+	return ans
+}
+
+// makeDevs returns the signed pBAF deviation of each state. State 0 is balanced and each
+// following pair holds +d and -d for a CN-LOH cell fraction grid, which spans all possible deviations.
+func makeDevs(p Params) []float64 {
+	ans := []float64{0}
+	for f := p.FractionStep; f <= 1+1e-9; f += p.FractionStep {
+		ans = append(ans, math.Min(f, 1)/2, -math.Min(f, 1)/2)
+	}
+	return ans
+}
+
+func partner(j int) int {
+	if j%2 == 1 {
+		return j + 1
+	}
+	return j - 1
+}
+
+// pBafEmission returns the log likelihood of a pBAF value given the expected deviation.
+// Outliers are uniform over [-0.5, 0.5].
+func pBafEmission(x, dev float64, n Noise, outlier float64) float64 {
+	if math.IsNaN(x) {
+		return 0
+	}
+	return math.Log((1-outlier)*math.Exp(logNormal(x, dev, n.BafSd)) + outlier)
+}
+
+func viterbiPhased(devs, pbaf []float64, n Noise, p Params, phaseErr float64) []int {
+	stay := math.Log(1 - p.SwitchProb - phaseErr)
+	neutralStay := math.Log(1 - p.SwitchProb)
+	move := math.Log(p.SwitchProb / float64(len(devs)-2))
+	flip := math.Log(phaseErr)
+	prev := make([]float64, len(devs))
+	curr := make([]float64, len(devs))
+	back := make([][]uint8, len(pbaf))
+
+	var bestPrev, from, j, i int
+	var best, s float64
+	for j = range devs {
+		prev[j] = pBafEmission(pbaf[0], devs[j], n, p.Outlier)
+		if j != 0 {
+			prev[j] += move
+		}
+	}
+	for i = 1; i < len(pbaf); i++ {
+		bestPrev = argmax(prev)
+		back[i] = make([]uint8, len(devs))
+		for j = range devs {
+			if j == 0 {
+				best, from = prev[0]+neutralStay, 0
+			} else {
+				best, from = prev[j]+stay, j
+				if s = prev[partner(j)] + flip; s > best {
+					best, from = s, partner(j)
+				}
+			}
+			if s = prev[bestPrev] + move; s > best {
+				best, from = s, bestPrev
+			}
+			curr[j] = best + pBafEmission(pbaf[i], devs[j], n, p.Outlier)
+			back[i][j] = uint8(from)
+		}
+		prev, curr = curr, prev
+	}
+
+	path := make([]int, len(pbaf))
+	path[len(path)-1] = argmax(prev)
+	for i = len(path) - 1; i > 0; i-- {
+		path[i-1] = int(back[i][path[i]])
+	}
+	return path
+}
+
+// makePhasedCall refits the deviation of markers [start, end) keeping the haplotype orientation
+// from the decoded path, then classifies the event by LRR.
+func makePhasedCall(sample, chr string, pos []int, pbaf, lrr, devs []float64, path []int, start, end int, n Noise, p Params) (cnv.Call, bool) {
+	c := cnv.Call{Sample: sample, Chr: chr, Start: pos[start] - 1, End: pos[end-1], NMarkers: end - start}
+	var nHet int
+	var neutral float64
+	for i := start; i < end; i++ {
+		if !math.IsNaN(pbaf[i]) {
+			nHet++
+			neutral += pBafEmission(pbaf[i], 0, n, p.Outlier)
+		}
+	}
+	if nHet < p.MinMarkers {
+		return c, false
+	}
+
+	bestLl, dev := math.Inf(-1), 0.0
+	var ll float64
+	for d := fineFractionStep / 2; d <= 0.5+1e-9; d += fineFractionStep / 2 {
+		ll = 0
+		for i := start; i < end; i++ {
+			ll += pBafEmission(pbaf[i], math.Copysign(d, devs[path[i]]), n, p.Outlier)
+		}
+		if ll > bestLl {
+			bestLl, dev = ll, d
+		}
+	}
+
+	lrrNeutral := lrrLikelihood(lrr[start:end], 0, n, p.Outlier)
+	bestLrr := math.Inf(-1)
+	var f, expLrr float64
+	for _, t := range []cnv.Type{cnv.Loss, cnv.Gain, cnv.CNLOH} {
+		if f = cnv.FractionFromBafDev(t, dev); f > 1 {
+			continue
+		}
+		expLrr, _ = cnv.Expected(t, f, p.Compression)
+		if ll = lrrLikelihood(lrr[start:end], expLrr, n, p.Outlier); ll > bestLrr {
+			bestLrr, c.Type, c.CellFraction = ll, t, f
+		}
+	}
+	c.Score = bestLl - neutral + bestLrr - lrrNeutral
+	return c, c.Score >= p.MinLlr
+}
+
+func lrrLikelihood(lrr []float64, expLrr float64, n Noise, outlier float64) float64 {
+	var ans float64
+	for i := range lrr {
+		if !math.IsNaN(lrr[i]) {
+			ans += math.Log((1-outlier)*math.Exp(logNormal(lrr[i], expLrr, n.LrrSd)) + outlier*lrrOutlierDensity)
+		}
+	}
+	return ans
+}
@@ -0,0 +1,191 @@
+package pca
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Covariate is a sample annotation. Values that all parse as numbers or dates are numeric, otherwise
+// the covariate is categorical.
+type Covariate struct {
+	Name    string
+	Numeric bool
+	Values  []float64 // numeric value of each sample, NaN if missing
+	Levels  []string  // category of each sample, "" if missing
+}
+
+var dateLayouts = []string{"2006-01-02", "2006/01/02", "01/02/2006", "1/2/2006", "2006-01-02T15:04:05", "2006-01-02 15:04:05", "1/2/2006 3:04:05 PM"}
+
+// ParseCovariate returns the covariate with the given values for each sample. Dates are converted to days
+// since 1970-01-01. Empty values, NA, and '.' are missing.
+func ParseCovariate(name string, values []string) Covariate {
+	c := Covariate{Name: name, Numeric: true, Values: make([]float64, len(values)), Levels: make([]string, len(values))}
+	var f float64
+	var ok bool
+	for i := range values {
+		c.Levels[i] = strings.TrimSpace(values[i])
+		if c.Levels[i] == "NA" || c.Levels[i] == "." {
+			c.Levels[i] = ""
+		}
+		if c.Levels[i] == "" {
+			c.Values[i] = math.NaN()
+			continue
+		}
+		if f, ok = parseNumber(c.Levels[i]); !ok {
+			c.Numeric = false
+		}
+		c.Values[i] = f
+	}
+	return c
+}
+
+func parseNumber(s string) (float64, bool) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return float64(t.Unix()) / 86400, true
+		}
+	}
+	return math.NaN(), false
+}
+
+// Assoc is the association of a principal component with a covariate: the fraction of the component's
+// variance explained by a linear fit on a numeric covariate or by the category means of a categorical
+// covariate, with the F test p-value.
+type Assoc struct {
+	N      int // samples with the covariate
+	Levels int // number of categories, or 0 for numeric covariates
+	R2     float64
+	F      float64
+	P      float64
+}
+
+// Associate returns the association of the scores of a component with a covariate.
+func Associate(scores []float64, c Covariate) Assoc {
+	if c.Numeric {
+		return associateNumeric(scores, c.Values)
+	}
+	return associateCategorical(scores, c.Levels)
+}
+
+func associateNumeric(y, x []float64) Assoc {
+	var ans Assoc
+	var sx, sy, sxx, syy, sxy float64
+	for i := range x {
+		if math.IsNaN(x[i]) || math.IsNaN(y[i]) {
+			continue
+		}
+		ans.N++
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		syy += y[i] * y[i]
+		sxy += x[i] * y[i]
+	}
+	n := float64(ans.N)
+	varX := sxx - sx*sx/n
+	varY := syy - sy*sy/n
+	if ans.N < 3 || varX <= 0 || varY <= 0 {
+		return Assoc{N: ans.N, R2: math.NaN(), F: math.NaN(), P: math.NaN()}
+	}
+	cov := sxy - sx*sy/n
+	ans.R2 = cov * cov / (varX * varY)
+	ans.F, ans.P = fTest(ans.R2, 1, n-2)
+	return ans
+}
+
+func associateCategorical(y []float64, levels []string) Assoc {
+	var ans Assoc
+	sum := make(map[string]float64)
+	count := make(map[string]int)
+	var total float64
+	for i := range levels {
+		if levels[i] == "" || math.IsNaN(y[i]) {
+			continue
+		}
+		ans.N++
+		sum[levels[i]] += y[i]
+		count[levels[i]]++
+		total += y[i]
+	}
+	ans.Levels = len(count)
+	mean := total / float64(ans.N)
+	var ssTotal, ssBetween, d float64
+	for i := range levels {
+		if levels[i] == "" || math.IsNaN(y[i]) {
+			continue
+		}
+		ssTotal += (y[i] - mean) * (y[i] - mean)
+	}
+	for level := range count {
+		d = sum[level]/float64(count[level]) - mean
+		ssBetween += float64(count[level]) * d * d
+	}
+	if ans.Levels < 2 || ans.N <= ans.Levels || ssTotal <= 0 {
+		ans.R2, ans.F, ans.P = math.NaN(), math.NaN(), math.NaN()
+		return ans
+	}
+	ans.R2 = ssBetween / ssTotal
+	ans.F, ans.P = fTest(ans.R2, float64(ans.Levels-1), float64(ans.N-ans.Levels))
+	return ans
+}
+
+// fTest returns the F statistic and upper tail p-value for a fit explaining r2 of the variance with df1 and
+// df2 degrees of freedom.
+func fTest(r2, df1, df2 float64) (f, p float64) {
+	if r2 >= 1 {
+		return math.Inf(1), 0
+	}
+	f = (r2 / df1) / ((1 - r2) / df2)
+	return f, incompleteBeta(df2/2, df1/2, df2/(df2+df1*f))
+}
+
+// incompleteBeta returns the regularized incomplete beta function I_x(a, b) by its continued fraction.
+func incompleteBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	if x > (a+1)/(a+b+2) {
+		return 1 - incompleteBeta(b, a, 1-x)
+	}
+	lgab, _ := math.Lgamma(a + b)
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	front := math.Exp(lgab-lga-lgb+a*math.Log(x)+b*math.Log(1-x)) / a
+
+	const tiny float64 = 1e-300
+	f, c, d := 1.0, 1.0, 0.0
+	var numerator, m float64
+	for i := 0; i <= 1000; i++ {
+		m = float64(i / 2)
+		switch {
+		case i == 0:
+			numerator = 1
+		case i%2 == 0:
+			numerator = m * (b - m) * x / ((a + 2*m - 1) * (a + 2*m))
+		default:
+			numerator = -(a + m) * (a + b + m) * x / ((a + 2*m) * (a + 2*m + 1))
+		}
+		d = 1 + numerator*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		d = 1 / d
+		c = 1 + numerator/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		f *= c * d
+		if math.Abs(1-c*d) < 1e-12 {
+			break
+		}
+	}
+	return front * (f - 1)
+}
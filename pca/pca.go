@@ -0,0 +1,236 @@
+// Package pca computes principal components of large sample by marker matrices by randomized SVD and tests
+// the association of the components with sample covariates.
+package pca
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Result holds the leading principal components of a matrix with samples as rows.
+type Result struct {
+	Scores        [][]float64 // [sample][pc], the projection of each sample on the components
+	Loadings      [][]float64 // [marker][pc], unit length for each pc
+	Variance      []float64   // variance explained by each pc
+	TotalVariance float64     // sum of the variances of all markers
+}
+
+// Randomized returns the first k principal components of the matrix with markers as rows of xt and samples
+// as columns, by randomized SVD (Halko, Martinsson, and Tropp 2011) with the given oversampling and number
+// of power iterations. The rows of xt must already be centered. k is reduced if the matrix is smaller.
+// Variances are divided by n-1, so xt must have at least 2 samples.
+func Randomized(xt [][]float32, k, oversample, iters int, seed int64) Result {
+	p := len(xt)
+	if p == 0 {
+		return Result{}
+	}
+	n := len(xt[0])
+	l := minInt(k+oversample, minInt(n, p))
+	k = minInt(k, l)
+	rng := rand.New(rand.NewSource(seed))
+
+	omega := newMatrix(p, l)
+	for j := range omega {
+		for c := range omega[j] {
+			omega[j][c] = rng.NormFloat64()
+		}
+	}
+	y := multiply(xt, omega, n)
+	orthonormalize(y)
+	var z [][]float64
+	for i := 0; i < iters; i++ {
+		z = multiplyTranspose(xt, y)
+		orthonormalize(z)
+		y = multiply(xt, z, n)
+		orthonormalize(y)
+	}
+
+	// z = X'Q, so B = Q'X = z' and BB' = z'z
+	z = multiplyTranspose(xt, y)
+	bbt := newMatrix(l, l)
+	for j := range z {
+		for a := 0; a < l; a++ {
+			for b := a; b < l; b++ {
+				bbt[a][b] += z[j][a] * z[j][b]
+			}
+		}
+	}
+	for a := 0; a < l; a++ {
+		for b := 0; b < a; b++ {
+			bbt[a][b] = bbt[b][a]
+		}
+	}
+	values, vectors := eigen(bbt)
+
+	ans := Result{Scores: newMatrix(n, k), Loadings: newMatrix(p, k), Variance: make([]float64, k)}
+	var s float64
+	for c := 0; c < k; c++ {
+		s = math.Sqrt(math.Max(values[c], 0))
+		ans.Variance[c] = values[c] / float64(n-1)
+		for i := 0; i < n; i++ {
+			for a := 0; a < l; a++ {
+				ans.Scores[i][c] += y[i][a] * vectors[a][c] * s
+			}
+		}
+		if s == 0 {
+			continue
+		}
+		for j := 0; j < p; j++ {
+			for a := 0; a < l; a++ {
+				ans.Loadings[j][c] += z[j][a] * vectors[a][c] / s
+			}
+		}
+	}
+	for j := range xt {
+		for i := range xt[j] {
+			ans.TotalVariance += float64(xt[j][i]) * float64(xt[j][i])
+		}
+	}
+	ans.TotalVariance /= float64(n - 1)
+	return ans
+}
+
+// multiply returns X m where X is the transpose of xt.
+func multiply(xt [][]float32, m [][]float64, n int) [][]float64 {
+	ans := newMatrix(n, len(m[0]))
+	var x float64
+	for j := range xt {
+		for i := range xt[j] {
+			if x = float64(xt[j][i]); x == 0 {
+				continue
+			}
+			for c := range m[j] {
+				ans[i][c] += x * m[j][c]
+			}
+		}
+	}
+	return ans
+}
+
+// multiplyTranspose returns X' m where X is the transpose of xt.
+func multiplyTranspose(xt [][]float32, m [][]float64) [][]float64 {
+	ans := newMatrix(len(xt), len(m[0]))
+	var x float64
+	for j := range xt {
+		for i := range xt[j] {
+			if x = float64(xt[j][i]); x == 0 {
+				continue
+			}
+			for c := range m[i] {
+				ans[j][c] += x * m[i][c]
+			}
+		}
+	}
+	return ans
+}
+
+// orthonormalize replaces the columns of m with an orthonormal basis by modified Gram-Schmidt. Columns
+// that are linearly dependent on earlier columns are set to zero.
+func orthonormalize(m [][]float64) {
+	if len(m) == 0 {
+		return
+	}
+	var dot, norm float64
+	for c := range m[0] {
+		for prev := 0; prev < c; prev++ {
+			dot = 0
+			for i := range m {
+				dot += m[i][c] * m[i][prev]
+			}
+			for i := range m {
+				m[i][c] -= dot * m[i][prev]
+			}
+		}
+		norm = 0
+		for i := range m {
+			norm += m[i][c] * m[i][c]
+		}
+		norm = math.Sqrt(norm)
+		for i := range m {
+			if norm > 1e-12 {
+				m[i][c] /= norm
+			} else {
+				m[i][c] = 0
+			}
+		}
+	}
+}
+
+// eigen returns the eigenvalues of the symmetric matrix a in decreasing order and the matching eigenvectors
+// as columns, by cyclic Jacobi rotations. a is modified.
+func eigen(a [][]float64) ([]float64, [][]float64) {
+	n := len(a)
+	v := newMatrix(n, n)
+	for i := range v {
+		v[i][i] = 1
+	}
+	var off, theta, t, c, s, aip, aiq, vip, viq float64
+	for sweep := 0; sweep < 100; sweep++ {
+		off = 0
+		for p := 0; p < n; p++ {
+			for q := p + 1; q < n; q++ {
+				off += a[p][q] * a[p][q]
+			}
+		}
+		if off < 1e-22 {
+			break
+		}
+		for p := 0; p < n; p++ {
+			for q := p + 1; q < n; q++ {
+				if a[p][q] == 0 {
+					continue
+				}
+				theta = (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t = 1 / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				if theta < 0 {
+					t = -t
+				}
+				c = 1 / math.Sqrt(t*t+1)
+				s = t * c
+				for i := 0; i < n; i++ {
+					aip, aiq = a[i][p], a[i][q]
+					a[i][p], a[i][q] = c*aip-s*aiq, s*aip+c*aiq
+				}
+				for i := 0; i < n; i++ {
+					aip, aiq = a[p][i], a[q][i]
+					a[p][i], a[q][i] = c*aip-s*aiq, s*aip+c*aiq
+				}
+				for i := 0; i < n; i++ {
+					vip, viq = v[i][p], v[i][q]
+					v[i][p], v[i][q] = c*vip-s*viq, s*vip+c*viq
+				}
+			}
+		}
+	}
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return a[order[i]][order[i]] > a[order[j]][order[j]] })
+	values := make([]float64, n)
+	vectors := newMatrix(n, n)
+	for c, idx := range order {
+		values[c] = a[idx][idx]
+		for i := 0; i < n; i++ {
+			vectors[i][c] = v[i][idx]
+		}
+	}
+	return values, vectors
+}
+
+func newMatrix(rows, cols int) [][]float64 {
+	ans := make([][]float64, rows)
+	for i := range ans {
+		ans[i] = make([]float64, cols)
+	}
+	return ans
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
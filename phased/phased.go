@@ -0,0 +1,227 @@
+// Package phased joins array signal (BAF/LRR) VCFs with phased or imputed VCFs of the same markers.
+package phased
+
+import (
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Match describes how the alleles of a phased record correspond to a signal record.
+type Match byte
+
+const (
+	NoMatch Match = iota
+	Same          // same REF and ALT
+	Swapped       // REF and ALT swapped, so BAF must be transformed to 1-BAF
+)
+
+// MatchAlleles compares the alleles of two biallelic records. Multiallelic records never match.
+func MatchAlleles(sig, ph vcf.Vcf) Match {
+	if len(sig.Alt) != 1 || len(ph.Alt) != 1 {
+		return NoMatch
+	}
+	sRef, sAlt := strings.ToUpper(sig.Ref), strings.ToUpper(sig.Alt[0])
+	pRef, pAlt := strings.ToUpper(ph.Ref), strings.ToUpper(ph.Alt[0])
+	switch {
+	case sRef == pRef && sAlt == pAlt:
+		return Same
+	case sRef == pAlt && sAlt == pRef:
+		return Swapped
+	default:
+		return NoMatch
+	}
+}
+
+func normChr(chr string) string {
+	return strings.TrimPrefix(chr, "chr")
+}
+
+// ChromOrder scans a VCF and returns the rank of each chromosome in the order they appear.
+// Chromosome names are compared without the 'chr' prefix. Fatal if the records are not
+// grouped by chromosome and sorted by position.
+func ChromOrder(filename string) map[string]int {
+	ans := make(map[string]int)
+	file := fileio.EasyOpen(filename)
+	var prevChr string
+	var prevPos, pos int
+	var err error
+	var fields []string
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		fields = strings.SplitN(line, "\t", 3)
+		if len(fields) < 3 {
+			log.Fatalf("ERROR: malformed VCF line in %s:\n%s", filename, line)
+		}
+		pos, err = strconv.Atoi(fields[1])
+		exception.PanicOnErr(err)
+		chr := normChr(fields[0])
+		if chr != prevChr {
+			if _, seen := ans[chr]; seen {
+				log.Fatalf("ERROR: %s is not grouped by chromosome. %s found again after %s", filename, fields[0], prevChr)
+			}
+			ans[chr] = len(ans)
+			prevChr, prevPos = chr, 0
+		}
+		if pos < prevPos {
+			log.Fatalf("ERROR: %s is not sorted by position. %s:%d found after %s:%d", filename, fields[0], pos, fields[0], prevPos)
+		}
+		prevPos = pos
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return ans
+}
+
+// Join streams a signal VCF and a phased VCF and calls matched for each pair of records at the same
+// position with matching alleles. Records without a match are passed to signalOnly or phasedOnly
+// (either may be nil). Both files must be sorted by position with chromosomes in the same order.
+// Chromosomes in the phased VCF that are absent from the signal VCF are unmatched. Every phased record
+// is passed to matched or phasedOnly in input order.
+func Join(signalFile, phasedFile string, matched func(sig, ph vcf.Vcf, m Match), signalOnly, phasedOnly func(vcf.Vcf)) {
+	rank := ChromOrder(signalFile)
+	sigRecords, _ := vcf.GoReadToChan(signalFile)
+	phRecords, _ := vcf.GoReadToChan(phasedFile)
+	if signalOnly == nil {
+		signalOnly = func(vcf.Vcf) {}
+	}
+	if phasedOnly == nil {
+		phasedOnly = func(vcf.Vcf) {}
+	}
+
+	var sigBuf, phBuf []vcf.Vcf
+	sig, sigOk := <-sigRecords
+	ph, phOk := <-phRecords
+	var phRank, lastRank, lastPos int
+	var known bool
+	for sigOk || phOk {
+		if phOk {
+			phRank, known = rank[normChr(ph.Chr)]
+			if !known {
+				phasedOnly(ph)
+				ph, phOk = <-phRecords
+				continue
+			}
+			if phRank < lastRank || (phRank == lastRank && ph.Pos < lastPos) {
+				log.Fatalf("ERROR: %s is not sorted in the same chromosome order as %s. Found %s:%d after a later position",
+					phasedFile, signalFile, ph.Chr, ph.Pos)
+			}
+			lastRank, lastPos = phRank, ph.Pos
+		}
+		switch {
+		case !phOk || (sigOk && compare(rank[normChr(sig.Chr)], sig.Pos, phRank, ph.Pos) < 0):
+			signalOnly(sig)
+			sig, sigOk = <-sigRecords
+		case !sigOk || compare(rank[normChr(sig.Chr)], sig.Pos, phRank, ph.Pos) > 0:
+			phasedOnly(ph)
+			ph, phOk = <-phRecords
+		default:
+			// collect all records at this position from both files to handle split multiallelic sites
+			sigBuf, phBuf = sigBuf[:0], phBuf[:0]
+			for pos, chr := sig.Pos, normChr(sig.Chr); sigOk && sig.Pos == pos && normChr(sig.Chr) == chr; sig, sigOk = <-sigRecords {
+				sigBuf = append(sigBuf, sig)
+			}
+			for pos, chr := ph.Pos, normChr(ph.Chr); phOk && ph.Pos == pos && normChr(ph.Chr) == chr; ph, phOk = <-phRecords {
+				phBuf = append(phBuf, ph)
+			}
+			matchAtPos(sigBuf, phBuf, matched, signalOnly, phasedOnly)
+		}
+	}
+}
+
+func compare(rankA, posA, rankB, posB int) int {
+	switch {
+	case rankA != rankB:
+		return rankA - rankB
+	default:
+		return posA - posB
+	}
+}
+
+// matchAtPos greedily pairs records at the same position by their alleles. Phased records
+// are passed on in their input order.
+func matchAtPos(sigBuf, phBuf []vcf.Vcf, matched func(sig, ph vcf.Vcf, m Match), signalOnly, phasedOnly func(vcf.Vcf)) {
+	used := make([]bool, len(sigBuf))
+	var m Match
+	var found bool
+	for j := range phBuf {
+		found = false
+		for i := range sigBuf {
+			if used[i] {
+				continue
+			}
+			if m = MatchAlleles(sigBuf[i], phBuf[j]); m != NoMatch {
+				matched(sigBuf[i], phBuf[j], m)
+				used[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			phasedOnly(phBuf[j])
+		}
+	}
+	for i := range sigBuf {
+		if !used[i] {
+			signalOnly(sigBuf[i])
+		}
+	}
+}
+
+// SampleIndex returns for each phased sample the index of the signal sample with the same name,
+// or -1 if absent, along with the names found in only one of the lists.
+func SampleIndex(signalSamples, phasedSamples []string) (idx []int, signalOnly, phasedOnly []string) {
+	sigIdx := make(map[string]int, len(signalSamples))
+	for i := range signalSamples {
+		sigIdx[signalSamples[i]] = i
+	}
+	inPhased := make(map[string]bool, len(phasedSamples))
+	idx = make([]int, len(phasedSamples))
+	var found bool
+	for i := range phasedSamples {
+		inPhased[phasedSamples[i]] = true
+		idx[i], found = sigIdx[phasedSamples[i]]
+		if !found {
+			idx[i] = -1
+			phasedOnly = append(phasedOnly, phasedSamples[i])
+		}
+	}
+	for i := range signalSamples {
+		if !inPhased[signalSamples[i]] {
+			signalOnly = append(signalOnly, signalSamples[i])
+		}
+	}
+	return
+}
+
+// AltBaf returns the BAF of the ALT allele of a signal record. Records written by illuminaToVcf
+// report the fraction of the array B allele, which is REF when INFO/ALLELE_B=0.
+// Records without ALLELE_B are assumed to report the ALT allele.
+func AltBaf(sig vcf.Vcf, baf float64) float64 {
+	for _, field := range strings.Split(sig.Info, ";") {
+		if field == "ALLELE_B=0" {
+			return 1 - baf
+		}
+	}
+	return baf
+}
+
+// PBaf returns the phased BAF of a sample at a site: the fraction of the allele on the first
+// haplotype minus 0.5. altBaf is the BAF of the phased record's ALT allele. Returns NaN unless the
+// genotype is a phased heterozygote.
+func PBaf(altBaf float64, s vcf.Sample) float64 {
+	if len(s.Alleles) != 2 || len(s.Phase) != 2 || !s.Phase[1] || math.IsNaN(altBaf) {
+		return math.NaN()
+	}
+	switch {
+	case s.Alleles[0] == 1 && s.Alleles[1] == 0:
+		return altBaf - 0.5
+	case s.Alleles[0] == 0 && s.Alleles[1] == 1:
+		return 0.5 - altBaf
+	default:
+		return math.NaN()
+	}
+}
@@ -0,0 +1,232 @@
+// Package qc computes per-sample signal quality metrics in the style of PennCNV.
+package qc
+
+import (
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"math"
+	"strings"
+)
+
+// Metrics of one sample. Signal metrics are computed on autosomes. Call rate excludes chrY and chrM,
+// which are not called in females by most arrays.
+type Metrics struct {
+	LrrSd            float64 // SD of LRR
+	LrrSdChromMedian float64 // median of per-chromosome LRR SD, robust to large events
+	BafDrift         float64 // fraction of markers with BAF in (0.2, 0.25) or (0.75, 0.8)
+	BafSd            float64 // SD of heterozygous BAF around 0.5
+	WaveFactor       float64 // median absolute deviation of LRR medians in windows
+	GcWaveFactor     float64 // WaveFactor with the sign of the correlation between window LRR and GC
+	CallRate         float64 // fraction of markers with a genotype
+	HetRate          float64 // fraction of genotyped markers that are heterozygous
+	LrrAutocorr      float64 // lag 1 autocorrelation of LRR along chromosomes
+}
+
+// WaveWindow is the window size in bp for WaveFactor, and minWaveMarkers the fewest markers in a window.
+const (
+	WaveWindow     int = 1000000
+	minWaveMarkers int = 10
+)
+
+// Compute returns the Metrics of sample s. Markers must be sorted by position within chromosomes.
+func Compute(d signal.Data, s int) Metrics {
+	var ans Metrics
+	var chromSd, lrr []float64
+	var x float64
+	var nMarkers, nCalled, nAutoCalled, nHet, nBaf, nDrift, nHetBaf int
+	var bafSumSq float64
+	var allSum, allSumSq float64
+	var nLrr int
+	var prev float64
+	var acfSum float64
+	var nAcf int
+	for _, r := range d.ChromRanges() {
+		autosome := signal.IsAutosome(d.Markers[r[0]].Chr)
+		called := countsForCallRate(d.Markers[r[0]].Chr)
+		lrr = lrr[:0]
+		prev = math.NaN()
+		for m := r[0]; m < r[1]; m++ {
+			if called {
+				nMarkers++
+				if d.Gt[s][m] >= 0 {
+					nCalled++
+				}
+			}
+			if !autosome {
+				continue
+			}
+			if d.Gt[s][m] >= 0 {
+				nAutoCalled++
+			}
+			if d.Het(s, m) {
+				nHet++
+			}
+			if x = float64(d.Baf[s][m]); !math.IsNaN(x) {
+				nBaf++
+				if (x > 0.2 && x < 0.25) || (x > 0.75 && x < 0.8) {
+					nDrift++
+				}
+				if d.Het(s, m) {
+					bafSumSq += (x - 0.5) * (x - 0.5)
+					nHetBaf++
+				}
+			}
+			x = float64(d.Lrr[s][m])
+			if math.IsNaN(x) {
+				continue
+			}
+			lrr = append(lrr, x)
+			allSum += x
+			allSumSq += x * x
+			nLrr++
+			if !math.IsNaN(prev) {
+				acfSum += x * prev
+				nAcf++
+			}
+			prev = x
+		}
+		if autosome && len(lrr) > 1 {
+			chromSd = append(chromSd, sd(lrr))
+		}
+	}
+
+	ans.CallRate = ratio(nCalled, nMarkers)
+	ans.HetRate = ratio(nHet, nAutoCalled)
+	ans.BafDrift = ratio(nDrift, nBaf)
+	ans.BafSd = math.NaN()
+	if nHetBaf > 1 {
+		ans.BafSd = math.Sqrt(bafSumSq / float64(nHetBaf-1))
+	}
+	ans.LrrSd, ans.LrrAutocorr = math.NaN(), math.NaN()
+	if nLrr > 1 {
+		mean := allSum / float64(nLrr)
+		variance := allSumSq/float64(nLrr) - mean*mean
+		ans.LrrSd = math.Sqrt(variance * float64(nLrr) / float64(nLrr-1))
+		if nAcf > 0 && variance > 0 {
+			// products of successive values, centered with the overall mean
+			ans.LrrAutocorr = (acfSum/float64(nAcf) - mean*mean) / variance
+		}
+	}
+	ans.LrrSdChromMedian = signal.Median(chromSd)
+	ans.WaveFactor, ans.GcWaveFactor = WaveFactor(d, s)
+	return ans
+}
+
+// WaveFactor returns the median absolute deviation of the median LRR in autosomal windows of WaveWindow bp
+// (Diskin et al. 2008), and the same value signed by the correlation of window LRR with window mean GC
+// content. The GC wave factor is NaN if the markers have no GC annotation.
+func WaveFactor(d signal.Data, s int) (wf, gcwf float64) {
+	var winLrr, winGc []float64
+	var lrr, gc []float64
+	var winEnd int
+	flush := func() {
+		if len(lrr) >= minWaveMarkers {
+			winLrr = append(winLrr, signal.Median(lrr))
+			winGc = append(winGc, nanMean(gc))
+		}
+		lrr, gc = lrr[:0], gc[:0]
+	}
+	for _, r := range d.ChromRanges() {
+		if !signal.IsAutosome(d.Markers[r[0]].Chr) {
+			continue
+		}
+		winEnd = d.Markers[r[0]].Pos + WaveWindow
+		for m := r[0]; m < r[1]; m++ {
+			if d.Markers[m].Pos >= winEnd {
+				flush()
+				for d.Markers[m].Pos >= winEnd {
+					winEnd += WaveWindow
+				}
+			}
+			if !math.IsNaN(float64(d.Lrr[s][m])) {
+				lrr = append(lrr, float64(d.Lrr[s][m]))
+				gc = append(gc, d.Markers[m].Gc)
+			}
+		}
+		flush()
+	}
+	if len(winLrr) < 2 {
+		return math.NaN(), math.NaN()
+	}
+	med := signal.Median(winLrr)
+	dev := make([]float64, len(winLrr))
+	for i := range winLrr {
+		dev[i] = math.Abs(winLrr[i] - med)
+	}
+	wf = signal.Median(dev)
+	r := correlation(winLrr, winGc)
+	switch {
+	case math.IsNaN(r):
+		gcwf = math.NaN()
+	case r < 0:
+		gcwf = -wf
+	default:
+		gcwf = wf
+	}
+	return wf, gcwf
+}
+
+func countsForCallRate(chr string) bool {
+	switch strings.TrimPrefix(chr, "chr") {
+	case "Y", "M", "MT":
+		return false
+	default:
+		return true
+	}
+}
+
+func sd(x []float64) float64 {
+	var sum, sumSq float64
+	for i := range x {
+		sum += x[i]
+		sumSq += x[i] * x[i]
+	}
+	n := float64(len(x))
+	return math.Sqrt((sumSq - sum*sum/n) / (n - 1))
+}
+
+func nanMean(x []float64) float64 {
+	var sum float64
+	var n int
+	for i := range x {
+		if !math.IsNaN(x[i]) {
+			sum += x[i]
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	return sum / float64(n)
+}
+
+// correlation returns the Pearson correlation of the pairs where neither value is NaN.
+func correlation(x, y []float64) float64 {
+	var sx, sy, sxx, syy, sxy, n float64
+	for i := range x {
+		if math.IsNaN(x[i]) || math.IsNaN(y[i]) {
+			continue
+		}
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		syy += y[i] * y[i]
+		sxy += x[i] * y[i]
+		n++
+	}
+	if n < 3 {
+		return math.NaN()
+	}
+	cov := sxy - sx*sy/n
+	vx, vy := sxx-sx*sx/n, syy-sy*sy/n
+	if vx <= 0 || vy <= 0 {
+		return math.NaN()
+	}
+	return cov / math.Sqrt(vx*vy)
+}
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return math.NaN()
+	}
+	return float64(a) / float64(b)
+}
@@ -0,0 +1,95 @@
+package refpanel
+
+import (
+	"fmt"
+	"github.com/vertgenlab/gonomics/vcf"
+	"golang.org/x/exp/slices"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Site is a biallelic SNV from a reference-panel sites VCF (e.g. 1000G or gnomAD).
+type Site struct {
+	Chr string
+	Pos int
+	Id  string
+	Ref string
+	Alt string
+	Af  map[string]float64 // keyed by INFO field (e.g. AF, AF_afr, AF_nfe)
+}
+
+// Key returns the lookup key for a position. Chromosome names are normalized to the 'chr' prefix.
+func Key(chr string, pos int) string {
+	return fmt.Sprintf("chr%s:%d", strings.TrimPrefix(chr, "chr"), pos)
+}
+
+// Read a sites VCF into a map keyed by Key. Only biallelic SNVs are retained and only
+// the INFO fields in afKeys are stored. Sites missing all requested AF fields are skipped.
+func Read(filename string, afKeys []string) map[string]Site {
+	ans := make(map[string]Site)
+	data, _ := vcf.GoReadToChan(filename)
+	var s Site
+	var found bool
+	for v := range data {
+		if len(v.Alt) != 1 || len(v.Ref) != 1 || len(v.Alt[0]) != 1 {
+			continue
+		}
+		s = Site{
+			Chr: "chr" + strings.TrimPrefix(v.Chr, "chr"),
+			Pos: v.Pos,
+			Id:  v.Id,
+			Ref: strings.ToUpper(v.Ref),
+			Alt: strings.ToUpper(v.Alt[0]),
+			Af:  parseAf(v.Info, afKeys),
+		}
+		if len(s.Af) == 0 {
+			continue
+		}
+		if _, found = ans[Key(s.Chr, s.Pos)]; found {
+			continue // keep first record for duplicate positions
+		}
+		ans[Key(s.Chr, s.Pos)] = s
+	}
+	if len(ans) == 0 {
+		log.Printf("WARNING: no usable sites with %s found in %s", strings.Join(afKeys, ","), filename)
+	}
+	return ans
+}
+
+func parseAf(info string, afKeys []string) map[string]float64 {
+	ans := make(map[string]float64, len(afKeys))
+	var kv []string
+	var val float64
+	var err error
+	for _, field := range strings.Split(info, ";") {
+		kv = strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || !slices.Contains(afKeys, kv[0]) {
+			continue
+		}
+		val, err = strconv.ParseFloat(strings.Split(kv[1], ",")[0], 64)
+		if err != nil || math.IsNaN(val) {
+			continue
+		}
+		ans[kv[0]] = val
+	}
+	return ans
+}
+
+// Freq returns the panel frequency of base at the site for the given AF field.
+// Returns false if base is neither the REF nor ALT allele or the field is missing.
+func (s Site) Freq(base string, afKey string) (float64, bool) {
+	af, found := s.Af[afKey]
+	if !found {
+		return 0, false
+	}
+	switch base {
+	case s.Alt:
+		return af, true
+	case s.Ref:
+		return 1 - af, true
+	default:
+		return 0, false
+	}
+}
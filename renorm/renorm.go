@@ -0,0 +1,229 @@
+// Package renorm removes per-marker LRR offsets shared by the samples of a batch.
+package renorm
+
+import (
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	offsetPrefix string = "OFFSET_"
+	scalePrefix  string = "SCALE_"
+)
+
+// Table holds the LRR offset and optional scale of each marker in each batch. Values are NaN where a
+// batch had too few reference samples or the marker is not corrected.
+type Table struct {
+	Batches []string
+	Chr     []string
+	Pos     []int
+	Id      []string
+	Offset  [][]float32 // [marker][batch]
+	Scale   [][]float32 // [marker][batch], nil if the LRR is not rescaled
+}
+
+// NewTable returns an empty table for the batches.
+func NewTable(batches []string, scaled bool) *Table {
+	t := &Table{Batches: batches}
+	if scaled {
+		t.Scale = [][]float32{}
+	}
+	return t
+}
+
+// Add a marker with the LRR of the reference samples of each batch. The offset is the median and the
+// scale is the MAD, which Normalize later converts to a multiplier. Batches with fewer than minSamples
+// non-missing values are NaN.
+func (t *Table) Add(chr string, pos int, id string, lrr [][]float64, minSamples int) {
+	offset := make([]float32, len(t.Batches))
+	var scale []float32
+	if t.Scale != nil {
+		scale = make([]float32, len(t.Batches))
+	}
+	var n int
+	for b := range lrr {
+		n = 0
+		for i := range lrr[b] {
+			if !math.IsNaN(lrr[b][i]) {
+				n++
+			}
+		}
+		if n < minSamples {
+			offset[b] = float32(math.NaN())
+			if scale != nil {
+				scale[b] = float32(math.NaN())
+			}
+			continue
+		}
+		offset[b] = float32(signal.Median(lrr[b]))
+		if scale != nil {
+			scale[b] = float32(signal.Mad(lrr[b]))
+		}
+	}
+	t.Chr = append(t.Chr, chr)
+	t.Pos = append(t.Pos, pos)
+	t.Id = append(t.Id, id)
+	t.Offset = append(t.Offset, offset)
+	if scale != nil {
+		t.Scale = append(t.Scale, scale)
+	}
+}
+
+// Normalize converts the per-marker MADs stored by Add into multipliers that bring the spread of each
+// marker to the median spread of the autosomal markers of its batch, limited to [1/maxScale, maxScale].
+func (t *Table) Normalize(maxScale float64) {
+	if t.Scale == nil {
+		return
+	}
+	mads := make([]float64, 0, len(t.Scale))
+	var target, s float64
+	for b := range t.Batches {
+		mads = mads[:0]
+		for m := range t.Scale {
+			if signal.IsAutosome(t.Chr[m]) {
+				mads = append(mads, float64(t.Scale[m][b]))
+			}
+		}
+		target = signal.Median(mads)
+		for m := range t.Scale {
+			if math.IsNaN(float64(t.Scale[m][b])) || math.IsNaN(target) {
+				t.Scale[m][b] = float32(math.NaN())
+				continue
+			}
+			s = target / float64(t.Scale[m][b])
+			if math.IsInf(s, 0) || math.IsNaN(s) || s > maxScale {
+				s = maxScale
+			}
+			if s < 1/maxScale {
+				s = 1 / maxScale
+			}
+			t.Scale[m][b] = float32(s)
+		}
+	}
+}
+
+// Adjust returns the normalized LRR of marker m for a sample in batch b. LRR is returned unchanged if the
+// offset is NaN.
+func (t *Table) Adjust(lrr float64, m, b int) float64 {
+	offset := float64(t.Offset[m][b])
+	if math.IsNaN(offset) || math.IsNaN(lrr) {
+		return lrr
+	}
+	lrr -= offset
+	if t.Scale != nil && !math.IsNaN(float64(t.Scale[m][b])) {
+		lrr *= float64(t.Scale[m][b])
+	}
+	return lrr
+}
+
+// BatchIndex returns the index of a batch, or -1 if it is not in the table.
+func (t *Table) BatchIndex(batch string) int {
+	for i := range t.Batches {
+		if t.Batches[i] == batch {
+			return i
+		}
+	}
+	return -1
+}
+
+// Write the table with one OFFSET_<batch> column and, if scaled, one SCALE_<batch> column per batch.
+// Missing values are written as NA.
+func (t *Table) Write(filename string) {
+	out := fileio.EasyCreate(filename)
+	columns := make([]string, 0, 2*len(t.Batches))
+	for _, b := range t.Batches {
+		columns = append(columns, offsetPrefix+b)
+	}
+	if t.Scale != nil {
+		for _, b := range t.Batches {
+			columns = append(columns, scalePrefix+b)
+		}
+	}
+	_, err := fmt.Fprintf(out, "#CHROM\tPOS\tID\t%s\n", strings.Join(columns, "\t"))
+	exception.PanicOnErr(err)
+	values := make([]string, len(columns))
+	for m := range t.Offset {
+		for b := range t.Batches {
+			values[b] = formatValue(t.Offset[m][b])
+			if t.Scale != nil {
+				values[len(t.Batches)+b] = formatValue(t.Scale[m][b])
+			}
+		}
+		_, err = fmt.Fprintf(out, "%s\t%d\t%s\t%s\n", t.Chr[m], t.Pos[m], t.Id[m], strings.Join(values, "\t"))
+		exception.PanicOnErr(err)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
+
+// Read a table written by Write.
+func Read(filename string) *Table {
+	t := &Table{}
+	var words []string
+	var nCol, pos int
+	var err error
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextLine(file); !done; line, done = fileio.EasyNextLine(file) {
+		words = strings.Split(line, "\t")
+		if strings.HasPrefix(line, "#") {
+			for _, col := range words[3:] {
+				switch {
+				case strings.HasPrefix(col, offsetPrefix):
+					t.Batches = append(t.Batches, strings.TrimPrefix(col, offsetPrefix))
+				case strings.HasPrefix(col, scalePrefix):
+					t.Scale = [][]float32{}
+				default:
+					log.Fatalf("ERROR: unexpected column '%s' in %s", col, filename)
+				}
+			}
+			nCol = 3 + len(words[3:])
+			continue
+		}
+		if len(words) != nCol {
+			log.Fatalf("ERROR: expected %d columns in %s:\n%s", nCol, filename, line)
+		}
+		t.Chr = append(t.Chr, words[0])
+		if pos, err = strconv.Atoi(words[1]); err != nil {
+			log.Fatalf("ERROR: could not parse '%s' as a position in line:\n%s", words[1], line)
+		}
+		t.Pos = append(t.Pos, pos)
+		t.Id = append(t.Id, words[2])
+		t.Offset = append(t.Offset, parseValues(words[3:3+len(t.Batches)], line))
+		if t.Scale != nil {
+			t.Scale = append(t.Scale, parseValues(words[3+len(t.Batches):], line))
+		}
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return t
+}
+
+func parseValues(words []string, line string) []float32 {
+	ans := make([]float32, len(words))
+	var f float64
+	var err error
+	for i := range words {
+		if words[i] == "NA" {
+			ans[i] = float32(math.NaN())
+			continue
+		}
+		if f, err = strconv.ParseFloat(words[i], 64); err != nil {
+			log.Fatalf("ERROR: could not parse '%s' as a number in line:\n%s", words[i], line)
+		}
+		ans[i] = float32(f)
+	}
+	return ans
+}
+
+func formatValue(f float32) string {
+	if math.IsNaN(float64(f)) {
+		return "NA"
+	}
+	return strconv.FormatFloat(float64(f), 'f', 4, 32)
+}
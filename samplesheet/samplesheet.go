@@ -0,0 +1,127 @@
+// Package samplesheet reads tab separated tables of sample annotations such as batch, plate, and sex.
+package samplesheet
+
+import (
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"strings"
+)
+
+// Standard column names. Column names are matched case-insensitively.
+const (
+	Sample string = "sample"
+	File   string = "file"
+	Sex    string = "sex"
+	Batch  string = "batch"
+	Plate  string = "plate"
+)
+
+// Sheet is a table with a header line and one row per sample. The sample ID column is the column named
+// sample, sample_id, or id, or the first column if there is none.
+type Sheet struct {
+	Columns []string // as in the header
+	Samples []string // sample IDs in file order
+	colIdx  map[string]int
+	rows    map[string][]string
+	idCol   int
+}
+
+// Read a sample sheet. Lines starting with '##' are skipped and a leading '#' on the header is removed.
+// Missing trailing values are empty. Duplicate sample IDs are fatal.
+func Read(filename string) Sheet {
+	var s Sheet
+	var words []string
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextLine(file); !done; line, done = fileio.EasyNextLine(file) {
+		if strings.HasPrefix(line, "##") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		words = strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if s.Columns == nil {
+			words[0] = strings.TrimPrefix(words[0], "#")
+			s = New(words)
+			continue
+		}
+		if len(words) > len(s.Columns) {
+			log.Fatalf("ERROR: line in %s has more columns than the header:\n%s", filename, line)
+		}
+		if !s.Add(words) {
+			log.Fatalf("ERROR: sample %s is listed more than once in %s", words[s.idCol], filename)
+		}
+	}
+	err := file.Close()
+	exception.PanicOnErr(err)
+	if s.Columns == nil {
+		log.Fatalf("ERROR: sample sheet %s is empty", filename)
+	}
+	return s
+}
+
+// New returns an empty sheet with the given columns.
+func New(columns []string) Sheet {
+	s := Sheet{Columns: columns, colIdx: make(map[string]int), rows: make(map[string][]string), idCol: -1}
+	for i := range columns {
+		s.colIdx[strings.ToLower(columns[i])] = i
+	}
+	for _, name := range []string{Sample, "sample_id", "id"} {
+		if i, found := s.colIdx[name]; found && s.idCol == -1 {
+			s.idCol = i
+		}
+	}
+	if s.idCol == -1 {
+		s.idCol = 0
+	}
+	return s
+}
+
+// Add a row, padding missing trailing values. Returns false if the sample is already in the sheet.
+func (s *Sheet) Add(row []string) bool {
+	for len(row) < len(s.Columns) {
+		row = append(row, "")
+	}
+	if _, found := s.rows[row[s.idCol]]; found {
+		return false
+	}
+	s.Samples = append(s.Samples, row[s.idCol])
+	s.rows[row[s.idCol]] = row
+	return true
+}
+
+// Has returns true if the sheet has the column.
+func (s Sheet) Has(column string) bool {
+	_, found := s.colIdx[strings.ToLower(column)]
+	return found
+}
+
+// Get returns the value of a column for a sample and false if the sample or column is not in the sheet.
+func (s Sheet) Get(sample, column string) (string, bool) {
+	row, found := s.rows[sample]
+	if !found {
+		return "", false
+	}
+	i, found := s.colIdx[strings.ToLower(column)]
+	if !found {
+		return "", false
+	}
+	return row[i], true
+}
+
+// Column returns the values of a column for the given samples, with "" for samples not in the sheet.
+func (s Sheet) Column(samples []string, column string) []string {
+	ans := make([]string, len(samples))
+	for i := range samples {
+		ans[i], _ = s.Get(samples[i], column)
+	}
+	return ans
+}
+
+// IsTrue returns true for common spellings of a true flag value (1, true, yes, y).
+func IsTrue(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "y", "t":
+		return true
+	default:
+		return false
+	}
+}
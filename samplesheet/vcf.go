@@ -0,0 +1,124 @@
+package samplesheet
+
+import (
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"strings"
+)
+
+const metaPrefix string = "##SAMPLE=<"
+
+// MetaLines returns VCF ##SAMPLE header lines with the given columns of each sample, e.g.
+// ##SAMPLE=<ID=s1,Sex=XY,Batch=b1,Plate=p3>. Keys are the column names with the first letter
+// capitalized. Empty column names and values are omitted and values with special characters are quoted.
+func MetaLines(s Sheet, samples []string, columns []string) []string {
+	ans := make([]string, 0, len(samples))
+	var sb strings.Builder
+	var value string
+	var found bool
+	for _, sample := range samples {
+		sb.Reset()
+		sb.WriteString(metaPrefix + "ID=" + quote(sample))
+		for _, col := range columns {
+			if col == "" {
+				continue
+			}
+			if value, found = s.Get(sample, col); !found || value == "" {
+				continue
+			}
+			sb.WriteString("," + strings.ToUpper(col[:1]) + col[1:] + "=" + quote(value))
+		}
+		sb.WriteString(">")
+		ans = append(ans, sb.String())
+	}
+	return ans
+}
+
+// FromVcfHeader returns a sheet of the ##SAMPLE lines of a VCF header with a sample column and one
+// lowercase column per key. Returns false if the header has no ##SAMPLE lines. It is an error for
+// a sample to have more than one ##SAMPLE line.
+func FromVcfHeader(header vcf.Header) (Sheet, bool) {
+	var fields [][][2]string
+	columns := []string{Sample}
+	seen := map[string]bool{Sample: true}
+	for _, line := range header.Text {
+		if !strings.HasPrefix(line, metaPrefix) {
+			continue
+		}
+		kv := splitMeta(strings.TrimSuffix(strings.TrimPrefix(line, metaPrefix), ">"))
+		for i := range kv {
+			kv[i][0] = strings.ToLower(kv[i][0])
+			if kv[i][0] == "id" {
+				kv[i][0] = Sample
+			}
+			if !seen[kv[i][0]] {
+				seen[kv[i][0]] = true
+				columns = append(columns, kv[i][0])
+			}
+		}
+		fields = append(fields, kv)
+	}
+	if len(fields) == 0 {
+		return Sheet{}, false
+	}
+	s := New(columns)
+	for _, kv := range fields {
+		row := make([]string, len(columns))
+		for i := range kv {
+			row[s.colIdx[kv[i][0]]] = kv[i][1]
+		}
+		if !s.Add(row) {
+			log.Fatalf("ERROR: sample %s has more than one ##SAMPLE line in the VCF header", row[s.idCol])
+		}
+	}
+	return s, true
+}
+
+// ReadVcfHeader returns the ##SAMPLE lines of a VCF file as a sheet. See FromVcfHeader.
+func ReadVcfHeader(filename string) (Sheet, bool) {
+	file := fileio.EasyOpen(filename)
+	header := vcf.ReadHeader(file)
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return FromVcfHeader(header)
+}
+
+// splitMeta splits key=value pairs separated by commas, allowing double quoted values.
+func splitMeta(s string) [][2]string {
+	var ans [][2]string
+	var key string
+	var sb strings.Builder
+	var inQuote, inValue bool
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			inQuote = !inQuote
+		case s[i] == '\\' && inQuote && i+1 < len(s):
+			i++
+			sb.WriteByte(s[i])
+		case s[i] == '=' && !inQuote && !inValue:
+			key = sb.String()
+			sb.Reset()
+			inValue = true
+		case s[i] == ',' && !inQuote:
+			ans = append(ans, [2]string{key, sb.String()})
+			sb.Reset()
+			inValue = false
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	if inValue {
+		ans = append(ans, [2]string{key, sb.String()})
+	}
+	return ans
+}
+
+func quote(s string) string {
+	if !strings.ContainsAny(s, ",=<>\" \t") {
+		return s
+	}
+	return "\"" + strings.ReplaceAll(strings.ReplaceAll(s, "\\", "\\\\"), "\"", "\\\"") + "\""
+}
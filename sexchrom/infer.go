@@ -0,0 +1,211 @@
+package sexchrom
+
+import (
+	"fmt"
+	"github.com/dasnellings/PGC_mCNV/signal"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"math"
+	"strings"
+)
+
+// Thresholds for inferring sex from array signal on the sex chromosomes.
+type Thresholds struct {
+	HetRate       float64 // min non-PAR chrX BAF het rate for two or more X chromosomes
+	HetBafMin     float64 // BAF range counted as heterozygous
+	HetBafMax     float64
+	XLrrOneCopy   float64 // chrX median LRR below which a single X is present
+	XLrrThreeCopy float64 // chrX median LRR above which three X are present
+	YLrrPresent   float64 // chrY median LRR above which Y is present
+	MinConfidence float64 // calls below this confidence are ambiguous
+}
+
+var DefaultThresholds = Thresholds{
+	HetRate:       0.05,
+	HetBafMin:     0.2,
+	HetBafMax:     0.8,
+	XLrrOneCopy:   -0.2,
+	XLrrThreeCopy: 0.15,
+	YLrrPresent:   -1.0,
+	MinConfidence: 0.9,
+}
+
+// scales used to convert the distance of a feature from its threshold to a confidence
+const (
+	hetRateScale float64 = 0.01
+	xLrrScale    float64 = 0.03
+	yLrrScale    float64 = 0.15
+)
+
+// Summary of sex chromosome signal for one sample. PARs and the X-transposed region are excluded.
+type Summary struct {
+	XHetRate   float64
+	XMedianLrr float64
+	YMedianLrr float64
+	NX         int
+	NY         int
+}
+
+// lrr histogram used for medians so memory does not scale with marker count
+const (
+	lrrHistMin   float64 = -4
+	lrrHistMax   float64 = 4
+	lrrHistWidth float64 = 0.005
+)
+
+// Accumulator collects sex chromosome signal for a single sample.
+type Accumulator struct {
+	build  Build
+	xHet   int
+	xCount int
+	xLrr   *signal.Hist
+	yLrr   *signal.Hist
+}
+
+func NewAccumulator(b Build) *Accumulator {
+	return &Accumulator{build: b, xLrr: signal.NewHist(lrrHistMin, lrrHistMax, lrrHistWidth), yLrr: signal.NewHist(lrrHistMin, lrrHistMax, lrrHistWidth)}
+}
+
+// Add a marker. Markers on autosomes, in PARs, or in the X-transposed region are ignored.
+// NaN values are skipped.
+func (a *Accumulator) Add(chr string, pos int, baf, lrr float64, t Thresholds) {
+	var isX bool
+	switch strings.TrimPrefix(chr, "chr") {
+	case "X":
+		isX = true
+	case "Y":
+	default:
+		return
+	}
+	if a.build.InPar(chr, pos) || a.build.InXtr(chr, pos) {
+		return
+	}
+	if isX && !math.IsNaN(baf) {
+		a.xCount++
+		if baf >= t.HetBafMin && baf <= t.HetBafMax {
+			a.xHet++
+		}
+	}
+	if isX {
+		a.xLrr.Add(lrr)
+	} else {
+		a.yLrr.Add(lrr)
+	}
+}
+
+func (a *Accumulator) Summary() Summary {
+	s := Summary{XHetRate: math.NaN(), NX: a.xLrr.N(), NY: a.yLrr.N()}
+	if a.xCount > 0 {
+		s.XHetRate = float64(a.xHet) / float64(a.xCount)
+	}
+	s.XMedianLrr = a.xLrr.Median()
+	s.YMedianLrr = a.yLrr.Median()
+	return s
+}
+
+// Infer the karyotype from a signal summary. Returns Unknown when features conflict
+// (e.g. no X heterozygosity with a diploid X LRR), data is missing, or confidence is below threshold.
+// Confidence is the smallest logistic-scaled distance of any used feature from its threshold.
+func Infer(s Summary, t Thresholds) (Sex, float64) {
+	if math.IsNaN(s.XHetRate) || math.IsNaN(s.XMedianLrr) || math.IsNaN(s.YMedianLrr) {
+		return Unknown, 0
+	}
+	hasY := s.YMedianLrr > t.YLrrPresent
+	multiX := s.XHetRate >= t.HetRate
+	conf := math.Min(confidence(s.YMedianLrr-t.YLrrPresent, yLrrScale), confidence(s.XHetRate-t.HetRate, hetRateScale))
+
+	var ans Sex
+	switch {
+	case multiX && s.XMedianLrr <= t.XLrrOneCopy: // heterozygous X with single copy dosage
+		return Unknown, conf
+	case !multiX && s.XMedianLrr > t.XLrrOneCopy: // X dosage of two or more without heterozygosity (e.g. X isodisomy)
+		return Unknown, conf
+	case !multiX:
+		conf = math.Min(conf, confidence(s.XMedianLrr-t.XLrrOneCopy, xLrrScale))
+		if hasY {
+			ans = XY
+		} else {
+			ans = X0
+		}
+	case hasY:
+		conf = math.Min(conf, confidence(s.XMedianLrr-t.XLrrOneCopy, xLrrScale))
+		ans = XXY
+	default:
+		conf = math.Min(conf, confidence(s.XMedianLrr-t.XLrrOneCopy, xLrrScale))
+		conf = math.Min(conf, confidence(s.XMedianLrr-t.XLrrThreeCopy, xLrrScale))
+		if s.XMedianLrr > t.XLrrThreeCopy {
+			ans = XXX
+		} else {
+			ans = XX
+		}
+	}
+
+	if conf < t.MinConfidence {
+		return Unknown, conf
+	}
+	return ans, conf
+}
+
+// SingleX returns true if a sample has a single X chromosome from chrX heterozygosity and LRR alone,
+// along with the confidence of the call. Unlike Infer, chrY signal is not used, so males that lost Y in
+// many cells are still called. Returns false if data is missing or the features conflict.
+func SingleX(s Summary, t Thresholds) (bool, float64) {
+	if math.IsNaN(s.XHetRate) || math.IsNaN(s.XMedianLrr) {
+		return false, 0
+	}
+	conf := math.Min(confidence(s.XHetRate-t.HetRate, hetRateScale), confidence(s.XMedianLrr-t.XLrrOneCopy, xLrrScale))
+	return s.XHetRate < t.HetRate && s.XMedianLrr <= t.XLrrOneCopy, conf
+}
+
+func confidence(dist, scale float64) float64 {
+	return 1 / (1 + math.Exp(-math.Abs(dist)/scale))
+}
+
+// Compare an inferred karyotype with a declared one.
+func Compare(inferred, declared Sex) string {
+	switch {
+	case declared == Unknown:
+		return "undeclared"
+	case inferred == Unknown:
+		return "ambiguous"
+	case inferred == declared:
+		return "match"
+	case (inferred.YCopies() > 0) != (declared.YCopies() > 0):
+		return "sex_mismatch"
+	default:
+		return "karyotype_mismatch"
+	}
+}
+
+// Call is the inferred sex of one sample along with the signal it was based on.
+type Call struct {
+	Sample     string
+	Inferred   Sex
+	Confidence float64
+	Declared   Sex
+	Summary
+}
+
+// WriteTable writes calls as a tab separated table. The first two columns (sample, inferred sex)
+// can be read back with ReadSexFile. Ambiguous calls are written as 'ambiguous'.
+func WriteTable(filename string, calls []Call) {
+	out := fileio.EasyCreate(filename)
+	_, err := fmt.Fprintln(out, "#SAMPLE\tINFERRED_SEX\tCONFIDENCE\tDECLARED_SEX\tSTATUS\tX_HET_RATE\tX_MEDIAN_LRR\tY_MEDIAN_LRR\tN_X\tN_Y")
+	exception.PanicOnErr(err)
+	var inferred, declared string
+	for _, c := range calls {
+		inferred = c.Inferred.String()
+		if c.Inferred == Unknown {
+			inferred = "ambiguous"
+		}
+		declared = c.Declared.String()
+		if c.Declared == Unknown {
+			declared = "."
+		}
+		_, err = fmt.Fprintf(out, "%s\t%s\t%.4f\t%s\t%s\t%.4f\t%.4f\t%.4f\t%d\t%d\n", c.Sample, inferred, c.Confidence, declared,
+			Compare(c.Inferred, c.Declared), c.XHetRate, c.XMedianLrr, c.YMedianLrr, c.NX, c.NY)
+		exception.PanicOnErr(err)
+	}
+	err = out.Close()
+	exception.PanicOnErr(err)
+}
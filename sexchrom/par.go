@@ -0,0 +1,109 @@
+package sexchrom
+
+import (
+	"strings"
+)
+
+// Region is a 1-based closed interval on a single chromosome.
+type Region struct {
+	Chr   string
+	Start int
+	End   int
+}
+
+func (r Region) Contains(chr string, pos int) bool {
+	return r.Chr == "chr"+strings.TrimPrefix(chr, "chr") && pos >= r.Start && pos <= r.End
+}
+
+// Build holds the sex chromosome landmarks for a reference assembly.
+type Build struct {
+	Name string
+	Par1 [2]Region // X then Y
+	Par2 [2]Region // X then Y
+	XtrY []Region  // X-transposed region on Y (approximate boundaries)
+}
+
+var hg19 = Build{
+	Name: "hg19",
+	Par1: [2]Region{{"chrX", 60001, 2699520}, {"chrY", 10001, 2649520}},
+	Par2: [2]Region{{"chrX", 154931044, 155260560}, {"chrY", 59034050, 59363566}},
+	XtrY: []Region{{"chrY", 2917959, 6102616}},
+}
+
+var hg38 = Build{
+	Name: "hg38",
+	Par1: [2]Region{{"chrX", 10001, 2781479}, {"chrY", 10001, 2781479}},
+	Par2: [2]Region{{"chrX", 155701383, 156030895}, {"chrY", 56887903, 57217415}},
+	XtrY: []Region{{"chrY", 3051926, 6235111}},
+}
+
+// GetBuild returns the landmarks for a reference assembly. Accepts UCSC and GRC
+// names as well as the bare build number used in Illumina manifests (e.g. 37).
+func GetBuild(name string) (Build, bool) {
+	switch strings.ToLower(name) {
+	case "hg19", "grch37", "37", "b37":
+		return hg19, true
+	case "hg38", "grch38", "38", "b38":
+		return hg38, true
+	default:
+		return Build{}, false
+	}
+}
+
+// InPar returns true if the position falls in PAR1 or PAR2 on either sex chromosome.
+func (b Build) InPar(chr string, pos int) bool {
+	for i := range b.Par1 {
+		if b.Par1[i].Contains(chr, pos) || b.Par2[i].Contains(chr, pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// InXtr returns true if the position falls in the X-transposed region of Y.
+func (b Build) InXtr(chr string, pos int) bool {
+	for i := range b.XtrY {
+		if b.XtrY[i].Contains(chr, pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParToX places a pseudoautosomal position on chrX. Positions already in an X PAR are
+// returned as is and positions in a Y PAR are lifted to the matching X PAR coordinate.
+// Returns false if the position is not in a PAR.
+func (b Build) ParToX(pos int) (int, bool) {
+	for _, par := range [][2]Region{b.Par1, b.Par2} {
+		if par[0].Contains("chrX", pos) {
+			return pos, true
+		}
+	}
+	for _, par := range [][2]Region{b.Par1, b.Par2} {
+		if par[1].Contains("chrY", pos) {
+			return pos - par[1].Start + par[0].Start, true
+		}
+	}
+	return pos, false
+}
+
+// Ploidy returns the expected number of copies of a position for a sample with the given sex.
+// Autosomes, PARs, and samples of unknown sex are diploid. Copies are capped at 2 for genotype output.
+func Ploidy(b Build, chr string, pos int, sex Sex) int {
+	var copies int
+	switch strings.TrimPrefix(chr, "chr") {
+	case "X":
+		copies = sex.XCopies()
+	case "Y":
+		copies = sex.YCopies()
+	default:
+		return 2
+	}
+	if copies == -1 || b.InPar(chr, pos) {
+		return 2
+	}
+	if copies > 2 {
+		return 2
+	}
+	return copies
+}
@@ -0,0 +1,100 @@
+package sexchrom
+
+import (
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"strings"
+)
+
+// Sex is the sex chromosome karyotype of a sample.
+type Sex byte
+
+const (
+	Unknown Sex = iota
+	XX
+	XY
+	X0
+	XXY
+	XXX
+)
+
+func (s Sex) String() string {
+	switch s {
+	case XX:
+		return "XX"
+	case XY:
+		return "XY"
+	case X0:
+		return "X0"
+	case XXY:
+		return "XXY"
+	case XXX:
+		return "XXX"
+	default:
+		return "unknown"
+	}
+}
+
+// Parse a sex or karyotype label. Accepts karyotypes (XX, XY, X0/XO, XXY, XXX), M/F, male/female,
+// and PLINK coding (1 = male, 2 = female). Anything else is Unknown.
+func Parse(s string) Sex {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "XX", "F", "FEMALE", "2":
+		return XX
+	case "XY", "M", "MALE", "1":
+		return XY
+	case "X0", "XO", "X":
+		return X0
+	case "XXY":
+		return XXY
+	case "XXX":
+		return XXX
+	default:
+		return Unknown
+	}
+}
+
+// XCopies returns the number of X chromosomes for the karyotype, or -1 if unknown.
+func (s Sex) XCopies() int {
+	switch s {
+	case XY, X0:
+		return 1
+	case XX, XXY:
+		return 2
+	case XXX:
+		return 3
+	default:
+		return -1
+	}
+}
+
+// YCopies returns the number of Y chromosomes for the karyotype, or -1 if unknown.
+func (s Sex) YCopies() int {
+	switch s {
+	case XX, X0, XXX:
+		return 0
+	case XY, XXY:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// ReadSexFile reads a tab separated file with sample names in the first column and
+// sex in the second. Additional columns and lines beginning with '#' are ignored.
+func ReadSexFile(filename string) map[string]Sex {
+	ans := make(map[string]Sex)
+	file := fileio.EasyOpen(filename)
+	var words []string
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		words = strings.Split(line, "\t")
+		if len(words) < 2 {
+			log.Fatalf("ERROR: expecting at least 2 columns (sample, sex) in the following line of %s\n%s", filename, line)
+		}
+		ans[words[0]] = Parse(words[1])
+	}
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return ans
+}
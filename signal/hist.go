@@ -0,0 +1,57 @@
+package signal
+
+import "math"
+
+// Hist is a fixed-width histogram for approximate quantiles of a stream of values in
+// constant memory. Values outside [min, max] are clamped.
+type Hist struct {
+	min    float64
+	width  float64
+	counts []int32
+	n      int
+}
+
+func NewHist(min, max, width float64) *Hist {
+	return &Hist{min: min, width: width, counts: make([]int32, int((max-min)/width)+1)}
+}
+
+// Add a value. NaN is skipped.
+func (h *Hist) Add(x float64) {
+	if math.IsNaN(x) {
+		return
+	}
+	bin := int((x - h.min) / h.width)
+	if bin < 0 {
+		bin = 0
+	}
+	if bin >= len(h.counts) {
+		bin = len(h.counts) - 1
+	}
+	h.counts[bin]++
+	h.n++
+}
+
+// N returns the number of values added.
+func (h *Hist) N() int {
+	return h.n
+}
+
+// Quantile returns the midpoint of the bin containing the q-th quantile, or NaN if empty.
+func (h *Hist) Quantile(q float64) float64 {
+	if h.n == 0 {
+		return math.NaN()
+	}
+	var sum int
+	for i := range h.counts {
+		sum += int(h.counts[i])
+		if float64(sum) >= q*float64(h.n) {
+			return h.min + (float64(i)+0.5)*h.width
+		}
+	}
+	return h.min + (float64(len(h.counts))-0.5)*h.width
+}
+
+// Median returns the approximate median, or NaN if empty.
+func (h *Hist) Median() float64 {
+	return h.Quantile(0.5)
+}
@@ -0,0 +1,173 @@
+package signal
+
+import (
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Marker is the position and annotation of one array marker.
+type Marker struct {
+	Chr string
+	Pos int
+	Id  string
+	Gc  float64 // INFO/GC, NaN if absent
+}
+
+// Data holds array signal for a set of samples, indexed [sample][marker].
+// Genotypes are the dosage of non-reference alleles (0, 1, 2) or -1 if missing.
+// Haploid genotypes are scaled to 0 or 2 so that Het is only true for diploid heterozygotes.
+type Data struct {
+	Samples []string
+	Markers []Marker
+	Gt      [][]int8
+	Baf     [][]float32
+	Lrr     [][]float32
+}
+
+// Het returns true if sample s is heterozygous at marker m.
+func (d Data) Het(s, m int) bool {
+	return d.Gt[s][m] == 1
+}
+
+// ChromRanges returns the [start, end) marker index of each run of markers on the same
+// chromosome in the order they appear.
+func (d Data) ChromRanges() [][2]int {
+	var ans [][2]int
+	var start int
+	for i := 1; i <= len(d.Markers); i++ {
+		if i == len(d.Markers) || d.Markers[i].Chr != d.Markers[start].Chr {
+			ans = append(ans, [2]int{start, i})
+			start = i
+		}
+	}
+	return ans
+}
+
+// SampleNames returns the sample names in the header of a VCF.
+func SampleNames(filename string) []string {
+	file := fileio.EasyOpen(filename)
+	header := vcf.ReadHeader(file)
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return vcf.HeaderGetSampleList(header)
+}
+
+// Read loads signal from a GT/BAF/LRR VCF (output of illuminaToVcf or reformatAffy).
+// Only markers for which keep returns true are loaded (nil keeps all). Only the samples at
+// the indexes in sampleIdx are loaded (nil loads all), which bounds memory for large cohorts.
+func Read(filename string, keep func(chr string, pos int) bool, sampleIdx []int) Data {
+	records, header := vcf.GoReadToChan(filename)
+	allSamples := vcf.HeaderGetSampleList(header)
+	if sampleIdx == nil {
+		sampleIdx = make([]int, len(allSamples))
+		for i := range sampleIdx {
+			sampleIdx[i] = i
+		}
+	}
+
+	var d Data
+	d.Samples = make([]string, len(sampleIdx))
+	d.Gt = make([][]int8, len(sampleIdx))
+	d.Baf = make([][]float32, len(sampleIdx))
+	d.Lrr = make([][]float32, len(sampleIdx))
+	for i := range sampleIdx {
+		d.Samples[i] = allSamples[sampleIdx[i]]
+	}
+
+	var bafIdx, lrrIdx int
+	for v := range records {
+		if keep != nil && !keep(v.Chr, v.Pos) {
+			continue
+		}
+		bafIdx, lrrIdx = Index(v)
+		d.Markers = append(d.Markers, Marker{Chr: v.Chr, Pos: v.Pos, Id: v.Id, Gc: InfoFloat(v.Info, "GC")})
+		for i, j := range sampleIdx {
+			d.Gt[i] = append(d.Gt[i], Dosage(v.Samples[j]))
+			d.Baf[i] = append(d.Baf[i], float32(Value(v.Samples[j], bafIdx)))
+			d.Lrr[i] = append(d.Lrr[i], float32(Value(v.Samples[j], lrrIdx)))
+		}
+	}
+	return d
+}
+
+// Index returns the FORMAT indexes of BAF and LRR in a record.
+func Index(v vcf.Vcf) (bafIdx, lrrIdx int) {
+	bafIdx, lrrIdx = -1, -1
+	for i := range v.Format {
+		switch v.Format[i] {
+		case "BAF":
+			bafIdx = i
+		case "LRR":
+			lrrIdx = i
+		}
+	}
+	if bafIdx == -1 || lrrIdx == -1 {
+		log.Fatalf("ERROR: BAF and LRR format fields are required. Found:\n%s", v)
+	}
+	return
+}
+
+// Value parses the float in FormatData at idx. Returns NaN if missing.
+func Value(s vcf.Sample, idx int) float64 {
+	if idx >= len(s.FormatData) {
+		return math.NaN()
+	}
+	f, err := strconv.ParseFloat(s.FormatData[idx], 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return f
+}
+
+// Dosage returns the number of non-reference alleles, scaled to 2 copies for haploid calls.
+// Diploid calls with two different alleles, including two different non-reference alleles
+// (e.g. 1/2), are heterozygous with dosage 1.
+func Dosage(s vcf.Sample) int8 {
+	var ans int8
+	for _, a := range s.Alleles {
+		switch {
+		case a < 0:
+			return -1
+		case a > 0:
+			ans++
+		}
+	}
+	switch len(s.Alleles) {
+	case 1:
+		return ans * 2
+	case 2:
+		if s.Alleles[0] != s.Alleles[1] {
+			return 1
+		}
+		return ans
+	default:
+		return -1
+	}
+}
+
+// InfoFloat returns the value of a float INFO field, or NaN if absent.
+func InfoFloat(info string, key string) float64 {
+	var kv []string
+	for _, field := range strings.Split(info, ";") {
+		kv = strings.SplitN(field, "=", 2)
+		if len(kv) == 2 && kv[0] == key {
+			f, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return math.NaN()
+			}
+			return f
+		}
+	}
+	return math.NaN()
+}
+
+// IsAutosome returns true for chromosomes 1-22 with or without the 'chr' prefix.
+func IsAutosome(chr string) bool {
+	n, err := strconv.Atoi(strings.TrimPrefix(chr, "chr"))
+	return err == nil && n >= 1 && n <= 22
+}
@@ -0,0 +1,104 @@
+package signal
+
+import (
+	"math"
+	"sort"
+)
+
+// Median returns the median of the non-NaN values in x, or NaN if there are none. x is not modified.
+func Median(x []float64) float64 {
+	return Quantile(x, 0.5)
+}
+
+// Quantile returns the q-th quantile of the non-NaN values in x by linear interpolation. x is not modified.
+func Quantile(x []float64, q float64) float64 {
+	sorted := sortedFinite(x)
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	pos := q * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(pos-float64(lo))
+}
+
+// Mad returns the median absolute deviation of the non-NaN values in x scaled to be
+// consistent with the standard deviation of normally distributed data.
+func Mad(x []float64) float64 {
+	med := Median(x)
+	dev := make([]float64, 0, len(x))
+	for i := range x {
+		if !math.IsNaN(x[i]) {
+			dev = append(dev, math.Abs(x[i]-med))
+		}
+	}
+	return 1.4826 * Median(dev)
+}
+
+// MinSd is the smallest noise estimate returned by EstimateNoise.
+const MinSd float64 = 0.01
+
+// EstimateNoise estimates the per-marker LRR SD from the MAD of successive differences, which is robust
+// to copy number changes, and the heterozygous BAF SD from the MAD of heterozygous BAF. Markers must be
+// in position order. Estimates are at least MinSd.
+func EstimateNoise(lrr, baf []float64, het []bool) (lrrSd, bafSd float64) {
+	diffs := make([]float64, 0, len(lrr))
+	hetBaf := make([]float64, 0, len(baf)/4)
+	for i := range lrr {
+		if i > 0 && !math.IsNaN(lrr[i]) && !math.IsNaN(lrr[i-1]) {
+			diffs = append(diffs, lrr[i]-lrr[i-1])
+		}
+		if het[i] && !math.IsNaN(baf[i]) {
+			hetBaf = append(hetBaf, baf[i])
+		}
+	}
+	lrrSd, bafSd = Mad(diffs)/math.Sqrt2, Mad(hetBaf)
+	if math.IsNaN(lrrSd) || lrrSd < MinSd {
+		lrrSd = MinSd
+	}
+	if math.IsNaN(bafSd) || bafSd < MinSd {
+		bafSd = MinSd
+	}
+	return lrrSd, bafSd
+}
+
+// MedianCI returns the median of x and a distribution-free confidence interval from order statistics
+// for the standard normal quantile z (e.g. 1.96 for 95%).
+func MedianCI(x []float64, z float64) (med, lo, hi float64) {
+	sorted := sortedFinite(x)
+	n := len(sorted)
+	if n == 0 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	med = Median(sorted)
+	halfWidth := z * math.Sqrt(float64(n)) / 2
+	loIdx := int(math.Floor(float64(n)/2 - halfWidth))
+	hiIdx := int(math.Ceil(float64(n)/2 + halfWidth))
+	if loIdx < 0 {
+		loIdx = 0
+	}
+	if hiIdx > n-1 {
+		hiIdx = n - 1
+	}
+	return med, sorted[loIdx], sorted[hiIdx]
+}
+
+// Float64s converts a float32 slice for use with the functions above.
+func Float64s(x []float32) []float64 {
+	ans := make([]float64, len(x))
+	for i := range x {
+		ans[i] = float64(x[i])
+	}
+	return ans
+}
+
+func sortedFinite(x []float64) []float64 {
+	ans := make([]float64, 0, len(x))
+	for i := range x {
+		if !math.IsNaN(x[i]) && !math.IsInf(x[i], 0) {
+			ans = append(ans, x[i])
+		}
+	}
+	sort.Float64s(ans)
+	return ans
+}
@@ -0,0 +1,70 @@
+package signal
+
+import (
+	"fmt"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// WriteLrr copies a GT/BAF/LRR VCF to output with the LRR of each sample rewritten by adjust, which
+// is called with the index of the marker in the input, the index of the sample, and its LRR (NaN if
+// missing). The result is written to the FORMAT field given by field, which replaces LRR if field is
+// "LRR" and is otherwise added with a FORMAT header line with the given description.
+func WriteLrr(input, output, field, description string, adjust func(m, s int, lrr float64) float64) {
+	records, header := vcf.GoReadToChan(input)
+	if field != "LRR" {
+		header = addFormatHeader(header, field, description)
+	}
+	out := fileio.EasyCreate(output)
+	vcf.NewWriteHeader(out, header)
+	var m, lrrIdx, outIdx int
+	for v := range records {
+		_, lrrIdx = Index(v)
+		outIdx = formatIndex(&v, field)
+		for s := range v.Samples {
+			for len(v.Samples[s].FormatData) < len(v.Format) {
+				v.Samples[s].FormatData = append(v.Samples[s].FormatData, ".")
+			}
+			v.Samples[s].FormatData[outIdx] = formatLrr(adjust(m, s, Value(v.Samples[s], lrrIdx)))
+		}
+		vcf.WriteVcf(out, v)
+		m++
+	}
+	err := out.Close()
+	exception.PanicOnErr(err)
+}
+
+// formatIndex returns the index of field in the FORMAT of v, adding it if absent.
+func formatIndex(v *vcf.Vcf, field string) int {
+	for i := range v.Format {
+		if v.Format[i] == field {
+			return i
+		}
+	}
+	v.Format = append(v.Format, field)
+	return len(v.Format) - 1
+}
+
+// addFormatHeader adds a FORMAT line for field before #CHROM if not already present.
+func addFormatHeader(header vcf.Header, field, description string) vcf.Header {
+	for _, line := range header.Text {
+		if strings.HasPrefix(line, "##FORMAT=<ID="+field+",") {
+			return header
+		}
+	}
+	last := header.Text[len(header.Text)-1]
+	header.Text = append(header.Text[:len(header.Text)-1],
+		fmt.Sprintf("##FORMAT=<ID=%s,Number=1,Type=Float,Description=\"%s\">", field, description), last)
+	return header
+}
+
+func formatLrr(f float64) string {
+	if math.IsNaN(f) {
+		return "."
+	}
+	return strconv.FormatFloat(f, 'f', 4, 64)
+}
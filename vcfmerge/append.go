@@ -0,0 +1,130 @@
+package vcfmerge
+
+import (
+	"fmt"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// markerKey identifies a marker by chromosome, position, and ID.
+type markerKey struct {
+	chr string
+	pos int
+	id  string
+}
+
+// node is a marker in the union order of several files.
+type node struct {
+	key  markerKey
+	next *node
+}
+
+// UnionOrder returns an order for merging files that list markers in different orders or have different
+// marker sets. Markers are ordered as in the first file, and markers absent from earlier files are placed
+// after the preceding marker of the file that has them. Files must agree on the order of shared markers.
+func UnionOrder(files []string) Less {
+	head := &node{}
+	nodes := make(map[markerKey]*node)
+	var last, n *node
+	var found bool
+	for _, f := range files {
+		last = head
+		for _, key := range markerKeys(f) {
+			if n, found = nodes[key]; !found {
+				n = &node{key: key, next: last.next}
+				last.next = n
+				nodes[key] = n
+			}
+			last = n
+		}
+	}
+	rank := make(map[markerKey]int, len(nodes))
+	var i int
+	for n = head.next; n != nil; n = n.next {
+		rank[n.key] = i
+		i++
+	}
+	return func(a, b vcf.Vcf) bool {
+		return rank[markerKey{chr: a.Chr, pos: a.Pos, id: a.Id}] < rank[markerKey{chr: b.Chr, pos: b.Pos, id: b.Id}]
+	}
+}
+
+// markerKeys returns the chromosome, position, and ID of each record of a VCF without parsing samples.
+func markerKeys(filename string) []markerKey {
+	var ans []markerKey
+	var words []string
+	var pos int
+	var err error
+	file := fileio.EasyOpen(filename)
+	for line, done := fileio.EasyNextRealLine(file); !done; line, done = fileio.EasyNextRealLine(file) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = strings.SplitN(line, "\t", 4)
+		if len(words) < 4 {
+			log.Fatalf("ERROR: malformed line in %s:\n%s", filename, line)
+		}
+		if pos, err = strconv.Atoi(words[1]); err != nil {
+			log.Fatalf("ERROR: could not parse position '%s' in %s:\n%s", words[1], filename, line)
+		}
+		ans = append(ans, markerKey{chr: words[0], pos: pos, id: words[2]})
+	}
+	err = file.Close()
+	exception.PanicOnErr(err)
+	return ans
+}
+
+// HistoryLine returns a header line recording an update of a cohort VCF.
+func HistoryLine(program, command string, added []string, sources []string) string {
+	return fmt.Sprintf("##%s=<Date=%s,NewSamples=%d,Sources=\"%s\",Command=\"%s\">", program, time.Now().Format(time.RFC3339),
+		len(added), strings.Join(sources, ","), strings.ReplaceAll(command, "\"", "'"))
+}
+
+// CheckNewSamples fails if any sample of the inputs is already in the cohort or repeated among the inputs, and
+// returns the new sample names.
+func CheckNewSamples(cohort string, inputs []string) []string {
+	seen := make(map[string]string)
+	for _, s := range sampleNames(cohort) {
+		seen[s] = cohort
+	}
+	var ans []string
+	for _, f := range inputs {
+		for _, s := range sampleNames(f) {
+			if prev, found := seen[s]; found {
+				log.Fatalf("ERROR: sample %s of %s is already in %s", s, f, prev)
+			}
+			seen[s] = f
+			ans = append(ans, s)
+		}
+	}
+	return ans
+}
+
+// sampleNames returns the sample names in the header of a VCF.
+func sampleNames(filename string) []string {
+	file := fileio.EasyOpen(filename)
+	header := vcf.ReadHeader(file)
+	err := file.Close()
+	exception.PanicOnErr(err)
+	return vcf.HeaderGetSampleList(header)
+}
+
+// Append writes the cohort VCF with the samples of the inputs added after the existing samples and returns
+// the added samples. Markers missing from some files are written with missing values for their samples.
+// headerLines returns the lines added to the header (e.g. from HistoryLine) given the added samples, and may
+// be nil. At most maxOpen files are open at once.
+func Append(cohort string, inputs []string, output string, maxOpen int, tmpPrefix string, headerLines func(added []string) []string) []string {
+	added := CheckNewSamples(cohort, inputs)
+	var lines []string
+	if headerLines != nil {
+		lines = headerLines(added)
+	}
+	files := append([]string{cohort}, inputs...)
+	MergeFiles(files, output, UnionOrder(files), maxOpen, tmpPrefix, lines...)
+	return added
+}
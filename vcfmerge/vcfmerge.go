@@ -0,0 +1,231 @@
+// Package vcfmerge combines VCFs with disjoint samples into one multi-sample VCF by a streaming k-way merge.
+package vcfmerge
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"os"
+	"strings"
+)
+
+// Less orders records. Every input must be sorted by it.
+type Less func(a, b vcf.Vcf) bool
+
+// SameMarker returns true if two records are at the same marker.
+func SameMarker(a, b vcf.Vcf) bool {
+	return a.Chr == b.Chr && a.Pos == b.Pos && a.Id == b.Id
+}
+
+// source is an open input and its current record.
+type source struct {
+	name    string
+	records <-chan vcf.Vcf
+	curr    vcf.Vcf
+	order   int // input index, breaks ties so samples stay in input order
+}
+
+type sourceHeap struct {
+	s    []*source
+	less Less
+}
+
+func (h *sourceHeap) Len() int { return len(h.s) }
+func (h *sourceHeap) Less(i, j int) bool {
+	if h.less(h.s[i].curr, h.s[j].curr) {
+		return true
+	}
+	if h.less(h.s[j].curr, h.s[i].curr) {
+		return false
+	}
+	return h.s[i].order < h.s[j].order
+}
+func (h *sourceHeap) Swap(i, j int)      { h.s[i], h.s[j] = h.s[j], h.s[i] }
+func (h *sourceHeap) Push(x interface{}) { h.s = append(h.s, x.(*source)) }
+func (h *sourceHeap) Pop() interface{} {
+	x := h.s[len(h.s)-1]
+	h.s = h.s[:len(h.s)-1]
+	return x
+}
+
+// Header returns the merged header of the inputs: the meta lines of the first header except ##SAMPLE lines,
+// then the ##SAMPLE lines of all inputs, then headerLines, then the #CHROM line with the samples of all inputs
+// in order. Duplicate sample names are fatal.
+func Header(names []string, headers []vcf.Header, headerLines ...string) vcf.Header {
+	var ans vcf.Header
+	var samples []string
+	seen := make(map[string]string)
+	for i := range headers {
+		for _, s := range vcf.HeaderGetSampleList(headers[i]) {
+			if prev, found := seen[s]; found {
+				log.Fatalf("ERROR: sample %s is in both %s and %s", s, prev, names[i])
+			}
+			seen[s] = names[i]
+			samples = append(samples, s)
+		}
+	}
+	first := headers[0].Text
+	for _, line := range first[:len(first)-1] {
+		if !strings.HasPrefix(line, "##SAMPLE=") {
+			ans.Text = append(ans.Text, line)
+		}
+	}
+	for i := range headers {
+		for _, line := range headers[i].Text {
+			if strings.HasPrefix(line, "##SAMPLE=") {
+				ans.Text = append(ans.Text, line)
+			}
+		}
+	}
+	ans.Text = append(ans.Text, headerLines...)
+	chromLine := strings.Join(strings.Split(first[len(first)-1], "\t")[:9], "\t")
+	ans.Text = append(ans.Text, chromLine+"\t"+strings.Join(samples, "\t"))
+	return ans
+}
+
+// Merge writes the records of the inputs to output with the samples of all inputs. Records at the same marker
+// (chromosome, position, and ID) are combined, and samples of inputs without the marker are written as
+// missing. INFO, QUAL, and FILTER are taken from the first input with the marker. The FORMAT is the union of
+// the FORMAT fields in order of first appearance. Inputs must be sorted by less and have the same REF and
+// ALT at each marker. headerLines are added to the header.
+func Merge(inputs []string, output string, less Less, headerLines ...string) {
+	h := &sourceHeap{less: less}
+	headers := make([]vcf.Header, len(inputs))
+	var found bool
+	for i := range inputs {
+		s := &source{name: inputs[i], order: i}
+		s.records, headers[i] = vcf.GoReadToChan(inputs[i])
+		if s.curr, found = <-s.records; found {
+			h.s = append(h.s, s)
+		}
+	}
+	heap.Init(h)
+	header := Header(inputs, headers, headerLines...)
+	nSamples := make([]int, len(inputs))
+	offset := make([]int, len(inputs))
+	for i := range headers {
+		nSamples[i] = len(vcf.HeaderGetSampleList(headers[i]))
+		if i > 0 {
+			offset[i] = offset[i-1] + nSamples[i-1]
+		}
+	}
+	total := offset[len(offset)-1] + nSamples[len(nSamples)-1]
+
+	out := fileio.EasyCreate(output)
+	vcf.NewWriteHeader(out, header)
+	var group []*source
+	var prev vcf.Vcf
+	var n int
+	for h.Len() > 0 {
+		group = group[:0]
+		group = append(group, heap.Pop(h).(*source))
+		for h.Len() > 0 && SameMarker(h.s[0].curr, group[0].curr) {
+			group = append(group, heap.Pop(h).(*source))
+		}
+		vcf.WriteVcf(out, combine(group, offset, total))
+		n++
+		for _, s := range group {
+			prev = s.curr
+			if s.curr, found = <-s.records; !found {
+				continue
+			}
+			if less(s.curr, prev) {
+				log.Fatalf("ERROR: %s is not sorted: %s:%d (%s) follows %s:%d (%s)", s.name, s.curr.Chr, s.curr.Pos, s.curr.Id, prev.Chr, prev.Pos, prev.Id)
+			}
+			heap.Push(h, s)
+		}
+	}
+	err := out.Close()
+	exception.PanicOnErr(err)
+	log.Printf("Merged %d markers from %d files with %d samples", n, len(inputs), total)
+}
+
+// combine returns a record with the samples of each source placed at its offset and all other samples missing.
+func combine(group []*source, offset []int, total int) vcf.Vcf {
+	ans := group[0].curr
+	ans.Format = nil
+	fieldIdx := make(map[string]int)
+	for _, s := range group {
+		if s.curr.Ref != ans.Ref || strings.Join(s.curr.Alt, ",") != strings.Join(ans.Alt, ",") {
+			log.Fatalf("ERROR: alleles of %s differ between %s (%s>%s) and %s (%s>%s)", ans.Id, group[0].name, ans.Ref,
+				strings.Join(ans.Alt, ","), s.name, s.curr.Ref, strings.Join(s.curr.Alt, ","))
+		}
+		for _, f := range s.curr.Format {
+			if _, found := fieldIdx[f]; !found {
+				fieldIdx[f] = len(ans.Format)
+				ans.Format = append(ans.Format, f)
+			}
+		}
+	}
+	ans.Samples = make([]vcf.Sample, total)
+	for i := range ans.Samples {
+		ans.Samples[i] = Missing(ans.Format)
+	}
+	var dst *vcf.Sample
+	for _, s := range group {
+		for j := range s.curr.Samples {
+			dst = &ans.Samples[offset[s.order]+j]
+			dst.Alleles, dst.Phase = s.curr.Samples[j].Alleles, s.curr.Samples[j].Phase
+			for k, f := range s.curr.Format {
+				if k < len(s.curr.Samples[j].FormatData) {
+					dst.FormatData[fieldIdx[f]] = s.curr.Samples[j].FormatData[k]
+				}
+			}
+		}
+	}
+	return ans
+}
+
+// Missing returns a sample with a missing genotype and missing values for each FORMAT field.
+func Missing(format []string) vcf.Sample {
+	s := vcf.Sample{FormatData: make([]string, len(format))}
+	for i := range format {
+		if format[i] != "GT" {
+			s.FormatData[i] = "."
+		}
+	}
+	return s
+}
+
+// MergeFiles merges the inputs with at most maxOpen inputs open at once. With more inputs, groups of maxOpen
+// are merged into temporary files named by tmpPrefix, which are merged in turn and removed. headerLines are
+// added to the header of the output.
+func MergeFiles(inputs []string, output string, less Less, maxOpen int, tmpPrefix string, headerLines ...string) {
+	if maxOpen < 2 {
+		log.Fatal("ERROR: at least 2 files must be open to merge")
+	}
+	var level int
+	var next []string
+	var tmp string
+	for len(inputs) > maxOpen {
+		level++
+		next = next[:0]
+		for start := 0; start < len(inputs); start += maxOpen {
+			end := start + maxOpen
+			if end > len(inputs) {
+				end = len(inputs)
+			}
+			tmp = fmt.Sprintf("%s.merge%d_%d.vcf.gz", tmpPrefix, level, len(next))
+			Merge(inputs[start:end], tmp, less)
+			if level > 1 {
+				removeAll(inputs[start:end])
+			}
+			next = append(next, tmp)
+		}
+		inputs = append([]string(nil), next...)
+	}
+	Merge(inputs, output, less, headerLines...)
+	if level > 0 {
+		removeAll(inputs)
+	}
+}
+
+func removeAll(files []string) {
+	for _, f := range files {
+		err := os.Remove(f)
+		exception.PanicOnErr(err)
+	}
+}